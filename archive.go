@@ -0,0 +1,346 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// Git bundles (see gitformat-bundle(5)) hold the references of a repository and a packfile of its objects in a
+// single file. The header is made of lines that each end with a newline:
+//
+//	signature:      "# v2 git bundle" or "# v3 git bundle"
+//	capabilities:   (v3 only) "@key=value", such as "@object-format=sha256"
+//	prerequisites:  "-<hash> <comment>", the commits the bundle leaves out because the receiver already has them
+//	references:     "<hash> <refname>"
+//
+// followed by a blank line and the packfile
+const bundleV2Signature = "# v2 git bundle\n"
+const bundleV3Signature = "# v3 git bundle\n"
+
+// archiveKind is a kind of file that holds a whole repository
+type archiveKind int
+
+const (
+	notArchived archiveKind = iota
+	bundleArchive
+	tarArchive
+	gzipArchive
+	zipArchive
+)
+
+// archivedRepoKind tells which kind of file holding a whole repository a file is from its first bytes,
+// since archives are not always named after what they are
+func archivedRepoKind(filename string) (archiveKind, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return notArchived, err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return notArchived, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte(bundleV2Signature)), bytes.HasPrefix(header, []byte(bundleV3Signature)):
+		return bundleArchive, nil
+	case bytes.HasPrefix(header, []byte("\x1f\x8b")):
+		return gzipArchive, nil
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return zipArchive, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return tarArchive, nil
+	}
+	return notArchived, nil
+}
+
+// isArchivedRepo reports whether a path is a file holding a whole repository rather than a repository directory:
+// a git bundle, or a tar, gzipped tar or zip archive of a repository
+func isArchivedRepo(filename string) bool {
+	info, err := os.Stat(filename)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	kind, err := archivedRepoKind(filename)
+	return err == nil && kind != notArchived
+}
+
+// openArchivedRepo opens a git bundle, or a tar, gzipped tar or zip archive of a repository, entirely in memory
+func openArchivedRepo(filename string) (*git.Repository, error) {
+	kind, err := archivedRepoKind(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fsys := memfs.New()
+	switch kind {
+	case bundleArchive:
+		repo, err := openBundle(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading bundle %s: %w", filename, err)
+		}
+		return repo, nil
+	case tarArchive:
+		err = loadTar(fsys, f)
+	case gzipArchive:
+		var decompressed *gzip.Reader
+		decompressed, err = gzip.NewReader(f)
+		if err == nil {
+			err = loadTar(fsys, decompressed)
+			decompressed.Close()
+		}
+	case zipArchive:
+		var info fs.FileInfo
+		info, err = f.Stat()
+		if err == nil {
+			err = loadZip(fsys, f, info.Size())
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a git bundle or an archive of a repository", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive %s: %w", filename, err)
+	}
+
+	gitDir, err := findGitDir(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	root, err := fsys.Chroot(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	return git.Open(filesystem.NewStorage(root, cache.NewObjectLRUDefault()), nil)
+}
+
+// archivedRepoSource is the URL that an archived repository is cached under: archives of clones still know where
+// they came from, bundles only have the file they are in
+func archivedRepoSource(repo *git.Repository, filename string) (string, error) {
+	if origin, err := getOriginUrlFromRepo(repo); err == nil {
+		return origin, nil
+	}
+	return filepath.Abs(filename)
+}
+
+// openBundle reads a git bundle into memory. The bundle has to be complete,
+// since the commits that an incremental bundle leaves out are part of the lineage ID
+func openBundle(r io.Reader) (*git.Repository, error) {
+	reader := bufio.NewReader(r)
+	signature, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if signature != bundleV2Signature && signature != bundleV3Signature {
+		return nil, errors.New("not a git bundle of a supported version")
+	}
+
+	algorithm := HashSHA1
+	refs := []*plumbing.Reference{}
+	prerequisites := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("bundle header is truncated: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		switch {
+		case signature == bundleV3Signature && strings.HasPrefix(line, "@"):
+			// other capabilities, like the @filter of bundles without some blobs, don't matter to commits
+			if format, ok := strings.CutPrefix(line, "@object-format="); ok {
+				if algorithm, err = parseHashAlgorithm(format); err != nil {
+					return nil, err
+				}
+			}
+		case strings.HasPrefix(line, "-"):
+			prerequisites++
+		default:
+			hash, name, ok := strings.Cut(line, " ")
+			if _, err := hex.DecodeString(hash); !ok || err != nil || len(hash) != algorithm.Size()*2 {
+				return nil, fmt.Errorf("bundle has an invalid reference %q", line)
+			}
+			refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(name), plumbing.NewHash(hash)))
+		}
+	}
+	if prerequisites > 0 {
+		return nil, fmt.Errorf("bundle is incremental, it leaves out the history of %d commits", prerequisites)
+	}
+	if algorithm != compiledHashAlgorithm {
+		return nil, fmt.Errorf("a %s bundle can't be read by a build for %s objects: %w", algorithm, compiledHashAlgorithm, ErrHashAlgorithmMismatch)
+	}
+	if len(refs) == 0 {
+		return nil, errors.New("bundle has no references")
+	}
+
+	storage := memory.NewStorage()
+	if err := packfile.UpdateObjectStorage(storage, reader); err != nil {
+		return nil, fmt.Errorf("error reading bundle packfile: %w", err)
+	}
+	for _, ref := range refs {
+		if err := storage.SetReference(ref); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := storage.Reference(plumbing.HEAD); err != nil {
+		// bundles of some of the branches don't list HEAD
+		err = storage.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, bundleHead(refs)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	repo, err := git.Open(storage, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := setRepoHashAlgorithm(repo, algorithm); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// bundleHead picks the reference that HEAD would point to in a clone of a bundle that doesn't list HEAD
+func bundleHead(refs []*plumbing.Reference) plumbing.ReferenceName {
+	for _, name := range []plumbing.ReferenceName{plumbing.Master, plumbing.Main} {
+		for _, ref := range refs {
+			if ref.Name() == name {
+				return name
+			}
+		}
+	}
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			return ref.Name()
+		}
+	}
+	return refs[0].Name()
+}
+
+// loadTar copies the regular files and directories of a tar archive into a filesystem
+func loadTar(fsys billy.Filesystem, r io.Reader) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// rooted, so that no name can point outside of the archive
+		name := path.Clean("/" + header.Name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = fsys.MkdirAll(name, 0755)
+		case tar.TypeReg:
+			err = writeArchivedFile(fsys, name, archive)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// loadZip copies the regular files and directories of a zip archive into a filesystem
+func loadZip(fsys billy.Filesystem, r io.ReaderAt, size int64) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, file := range archive.File {
+		name := path.Clean("/" + file.Name)
+		if file.Mode().IsDir() {
+			if err := fsys.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		contents, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = writeArchivedFile(fsys, name, contents)
+		contents.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeArchivedFile(fsys billy.Filesystem, name string, r io.Reader) error {
+	f, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return errors.Join(err, f.Close())
+}
+
+// findGitDir finds the repository in the files of an archive: the shallowest directory with a HEAD file and an
+// objects directory, which is the .git directory of a worktree or a bare repository itself. Being the shallowest
+// passes over the repositories of submodules, which are in .git/modules
+func findGitDir(fsys billy.Filesystem) (string, error) {
+	depth := func(name string) int {
+		return strings.Count(strings.TrimSuffix(name, "/"), "/")
+	}
+	found := ""
+	err := util.Walk(fsys, "/", func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || (found != "" && depth(name) >= depth(found)) {
+			return nil
+		}
+		head, err := fsys.Stat(path.Join(name, "HEAD"))
+		if err != nil || !head.Mode().IsRegular() {
+			return nil
+		}
+		if objects, err := fsys.Stat(path.Join(name, "objects")); err != nil || !objects.IsDir() {
+			return nil
+		}
+		found = name
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", errors.New("archive does not contain a git repository")
+	}
+	return found, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// archiveRepo writes the files of a directory into an archive of the given kind, under prefix
+func archiveRepo(t *testing.T, dir string, prefix string, kind archiveKind) string {
+	filename := filepath.Join(t.TempDir(), "archive")
+	out, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	var add func(name string, info fs.FileInfo, contents io.Reader) error
+	var closeArchive func() error
+	switch kind {
+	case tarArchive, gzipArchive:
+		var w io.Writer = out
+		var compressed *gzip.Writer
+		if kind == gzipArchive {
+			compressed = gzip.NewWriter(out)
+			w = compressed
+		}
+		archive := tar.NewWriter(w)
+		add = func(name string, info fs.FileInfo, contents io.Reader) error {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			if err := archive.WriteHeader(header); err != nil {
+				return err
+			}
+			if contents != nil {
+				_, err = io.Copy(archive, contents)
+			}
+			return err
+		}
+		closeArchive = func() error {
+			if err := archive.Close(); err != nil || compressed == nil {
+				return err
+			}
+			return compressed.Close()
+		}
+	case zipArchive:
+		archive := zip.NewWriter(out)
+		add = func(name string, info fs.FileInfo, contents io.Reader) error {
+			if info.IsDir() {
+				_, err := archive.Create(name + "/")
+				return err
+			}
+			w, err := archive.Create(name)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, contents)
+			return err
+		}
+		closeArchive = archive.Close
+	}
+
+	err = filepath.Walk(dir, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(dir, name)
+		name = filepath.ToSlash(filepath.Join(prefix, relative))
+		if info.IsDir() {
+			return add(name, info, nil)
+		}
+		f, err := os.Open(filepath.Join(dir, relative))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return add(name, info, f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeArchive(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestArchivedRepository(t *testing.T) {
+	repo, dir := commitGraphFixture(t)
+	expected := objectWalkLineageID(t, repo)
+
+	for name, kind := range map[string]archiveKind{"tar": tarArchive, "gzip": gzipArchive, "zip": zipArchive} {
+		// as the .git directory of a worktree, and as a bare repository at the root of the archive
+		for _, prefix := range []string{"project/.git", ""} {
+			archive := archiveRepo(t, dir, prefix, kind)
+			if found, err := archivedRepoKind(archive); err != nil || found != kind {
+				t.Fatalf(`archivedRepoKind() of a %s archive = %v, %v`, name, found, err)
+			}
+			archived, err := openArchivedRepo(archive)
+			if err != nil {
+				t.Fatalf(`openArchivedRepo() of a %s archive with prefix %q: %v`, name, prefix, err)
+			}
+			if id, err := getLineageIDFromRepo(archived, 4); err != nil || id != expected {
+				t.Errorf(`lineage ID of a %s archive with prefix %q = %q, %v, was not %q`, name, prefix, id, err, expected)
+			}
+		}
+	}
+
+	// the commit-graph of an archived repository is read from memory
+	encodeCommitGraph(t, repo, repo.Storer.(*filesystem.Storage).Filesystem())
+	_, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{"https://example.com/owner/project"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := archiveRepo(t, dir, "project/.git", gzipArchive)
+	archived, err := openArchivedRepo(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := commitGraphLineageID(t, archived); id != expected {
+		t.Errorf(`lineage ID from the archived commit-graph = %q, was not %q`, id, expected)
+	}
+	analyzed, err := analyzeRepo(archive, 4)
+	if err != nil || analyzed.LineageID != expected || analyzed.URL != "https://example.com/owner/project" || analyzed.HashAlgorithm != compiledHashAlgorithm.String() {
+		t.Errorf(`analyzeRepo() of an archive = %+v, %v`, analyzed, err)
+	}
+
+	pipeline := importPipeline{StorageDir: t.TempDir(), Workers: 1, PrefixLength: 4}
+	result := <-pipeline.Run([]fingerprintJob{{Source: archive}})
+	if result.Err != nil || result.LineageID != expected || result.HashAlgorithm != compiledHashAlgorithm {
+		t.Errorf(`pipeline computed %q (%v), %v for an archive, expected %q`, result.LineageID, result.HashAlgorithm, result.Err, expected)
+	}
+	// cached under the same URL as when it is analyzed
+	if result.Source != analyzed.URL {
+		t.Errorf(`pipeline source of an archive = %q, analyze found %q`, result.Source, analyzed.URL)
+	}
+}
+
+func TestArchiveWithoutRepository(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a repository"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := archiveRepo(t, dir, "project", tarArchive)
+	if _, err := openArchivedRepo(archive); err == nil || !strings.Contains(err.Error(), "does not contain a git repository") {
+		t.Errorf(`openArchivedRepo() of an archive without a repository = %v`, err)
+	}
+
+	if isArchivedRepo(dir) {
+		t.Errorf(`isArchivedRepo() of a directory should be false`)
+	}
+	if isArchivedRepo(filepath.Join(dir, "README")) {
+		t.Errorf(`isArchivedRepo() of a text file should be false`)
+	}
+	if !isArchivedRepo(archive) {
+		t.Errorf(`isArchivedRepo() of a tar archive should be true`)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	dir, expected := gitFixture(t, "sha1")
+	bundles := t.TempDir()
+	bundle := func(name string, args ...string) string {
+		filename := filepath.Join(bundles, name)
+		gitCommand(t, dir, append([]string{"bundle", "create", "-q", filename}, args...)...)
+		return filename
+	}
+
+	all := bundle("all.bundle", "--all")
+	// without HEAD, which points to master when the bundle is opened
+	master := bundle("master.bundle", "master")
+	for _, filename := range []string{all, master} {
+		if !isArchivedRepo(filename) {
+			t.Fatalf(`isArchivedRepo() of a bundle should be true`)
+		}
+		repo, err := openArchivedRepo(filename)
+		if compiledHashAlgorithm != HashSHA1 {
+			if !errors.Is(err, ErrHashAlgorithmMismatch) {
+				t.Errorf(`openArchivedRepo() of a SHA-1 bundle in a %s build = %v`, compiledHashAlgorithm, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+			t.Errorf(`lineage ID of %s = %q, %v, was not %q`, filepath.Base(filename), id, err, expected)
+		}
+	}
+
+	if compiledHashAlgorithm == HashSHA1 {
+		absolute, _ := filepath.Abs(all)
+		if analyzed, err := analyzeRepo(all, 4); err != nil || analyzed.LineageID != expected || analyzed.URL != absolute {
+			t.Errorf(`analyzeRepo() of a bundle = %+v, %v`, analyzed, err)
+		}
+		// imported by a relative path, but cached under the same absolute one
+		wd, _ := os.Getwd()
+		relative, err := filepath.Rel(wd, all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline := importPipeline{StorageDir: t.TempDir(), Workers: 1, PrefixLength: 4}
+		if result := <-pipeline.Run([]fingerprintJob{{Source: relative}}); result.Err != nil || result.Source != absolute {
+			t.Errorf(`pipeline source of a bundle = %q, %v, expected %q`, result.Source, result.Err, absolute)
+		}
+	}
+
+	incremental := bundle("incremental.bundle", "master~3..master")
+	if _, err := openArchivedRepo(incremental); err == nil || !strings.Contains(err.Error(), "incremental") {
+		t.Errorf(`openArchivedRepo() of an incremental bundle = %v`, err)
+	}
+}
+
+func TestSHA256Bundle(t *testing.T) {
+	dir, expected := gitFixture(t, "sha256")
+	filename := filepath.Join(t.TempDir(), "sha256.bundle")
+	gitCommand(t, dir, "bundle", "create", "-q", filename, "--all")
+
+	repo, err := openArchivedRepo(filename)
+	if compiledHashAlgorithm != HashSHA256 {
+		if !errors.Is(err, ErrHashAlgorithmMismatch) {
+			t.Errorf(`openArchivedRepo() of a SHA-256 bundle in a %s build = %v`, compiledHashAlgorithm, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+		t.Errorf(`lineage ID of a SHA-256 bundle = %q, %v, was not %q`, id, err, expected)
+	}
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/csv"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/url"
 	"os"
+	"slices"
 	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -34,6 +37,24 @@ func getOriginUrlFromRepo(repo *git.Repository) (string, error) {
 }
 
 func getLineageIDFromRepo(repo *git.Repository, prefixLength uint8) (string, error) {
+	builder, err := lineageFromRepo(repo, prefixLength)
+	if err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
+
+// lineageFromRepo walks the history of a repository into a LineageBuilder,
+// which also knows the hash algorithm and the time of the root commit
+func lineageFromRepo(repo *git.Repository, prefixLength uint8) (*LineageBuilder, error) {
+	algorithm, err := repoHashAlgorithm(repo)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm != compiledHashAlgorithm {
+		return lineageFromCommitGraphOnly(repo, algorithm, prefixLength)
+	}
+
 	// ... retrieving the HEAD reference
 	refs := []string{"refs/heads/master", "refs/heads/main"}
 	ref, err := repo.Head()
@@ -48,8 +69,27 @@ func getLineageIDFromRepo(repo *git.Repository, prefixLength uint8) (string, err
 			}
 		}
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+	}
+
+	builder, err := NewLineageBuilder(prefixLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// the commit-graph has the parents of every commit without having to find and decode their objects
+	graph, err := repoCommitGraph(repo)
+	if err == nil {
+		err = pushHistoryFromCommitGraph(repo, graph, ref.Hash(), builder)
+		graph.Close()
+		if err == nil {
+			return builder, nil
 		}
+		builder, _ = NewLineageBuilder(prefixLength)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "could not use the commit-graph, walking commit objects instead:", err)
 	}
 
 	// ... retrieves the commit history
@@ -58,27 +98,33 @@ func getLineageIDFromRepo(repo *git.Repository, prefixLength uint8) (string, err
 	cIter, err := repo.Log(&git.LogOptions{From: ref.Hash(), Order: git.LogOrderDFSPostNoMerge})
 	// , Since: &since, Until: &until
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var commit_hashes []CommitHash
-
 	err = cIter.ForEach(func(c *object.Commit) error {
-		// here we convert the type so we arent passing around a plumbing.Hash everywhere
-		cache := []byte{}
-		// fmt.Println(c.Hash.String())
-		for _, b := range c.Hash {
-			cache = append(cache, b)
-		}
-		// fmt.Println(hex.EncodeToString(cache))
-		commit_hashes = append(commit_hashes, CommitHash(cache))
-		return nil
+		if c.NumParents() == 0 {
+			builder.SetFirstCommit(c.Committer.When)
+		}
+		return builder.Push(c.Hash[:])
 	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return builder, nil
+}
+
+// lineageOf computes the lineage ID of a repository along with the hash algorithm of the commits it was made from
+// and the commit time of its root commit (zero if that could not be found)
+func lineageOf(repo *git.Repository, prefixLength uint8) (string, HashAlgorithm, time.Time, error) {
+	algorithm, err := repoHashAlgorithm(repo)
+	if err != nil {
+		return "", algorithm, time.Time{}, err
+	}
+	builder, err := lineageFromRepo(repo, prefixLength)
+	if err != nil {
+		return "", algorithm, time.Time{}, err
 	}
-	lineageID := LineageIDFromHashes(commit_hashes, prefixLength)
-	return lineageID.String(), nil
+	return builder.String(), algorithm, builder.FirstCommit(), nil
 }
 
 // isValidUrl tests a string to determine if it is a well-structured url or not.
@@ -126,7 +172,7 @@ func repoOwnerAndNameFromURL(repourl string) (string, string) {
 	return owner, reponame
 }
 
-func lineageIDFromGitHub(repourl string, prefixLength uint8) string {
+func lineageIDFromGitHub(repourl string, prefixLength uint8) (string, HashAlgorithm, time.Time) {
 
 	// TODO: maybe use  https://github.com/shurcooL/githubv4
 	if !isValidUrl(repourl) {
@@ -138,7 +184,9 @@ func lineageIDFromGitHub(repourl string, prefixLength uint8) string {
 
 	owner, reponame := repoOwnerAndNameFromURL(repourl)
 
-	var allCommits []*github.RepositoryCommit
+	// commits are pushed as the pages come in, so only the current page is ever held in memory
+	builder, err := NewLineageBuilder(prefixLength)
+	check(err)
 
 	var opt = &github.CommitsListOptions{
 		SHA:         "HEAD",
@@ -152,7 +200,12 @@ func lineageIDFromGitHub(repourl string, prefixLength uint8) string {
 		// if err != nil {
 		// 	return err
 		// }
-		allCommits = append(allCommits, commits...)
+		for _, commit := range commits {
+			if len(commit.Parents) == 0 {
+				builder.SetFirstCommit(commit.GetCommit().GetCommitter().GetDate().Time)
+			}
+			CheckIfError(builder.PushHex(commit.GetSHA()))
+		}
 		if resp.NextPage == 0 {
 			break
 		}
@@ -160,24 +213,13 @@ func lineageIDFromGitHub(repourl string, prefixLength uint8) string {
 		opt.Page = resp.NextPage
 	}
 
-	var commit_hashes []CommitHash
-
-	for _, commit := range allCommits {
-		hashbytes, err := hex.DecodeString(*commit.SHA)
-		CheckIfError(err)
-		commit_hashes = append(commit_hashes, CommitHash(hashbytes))
-
-	}
-
-	lineageID := LineageIDFromHashes(commit_hashes, prefixLength)
-
 	// err = os.WriteFile(cacheFilename, d1, 0644)
 	// check(err)
-	return lineageID.String()
+	return builder.String(), builder.Algorithm(), builder.FirstCommit()
 }
 
-func cloneRepo(repourl string, into string) error {
-	if !strings.HasPrefix(repourl, "http") {
+func cloneRepo(repourl string, into string, progress io.Writer) error {
+	if !strings.Contains(repourl, "://") {
 		repourl = "https://" + repourl
 	}
 	_, err := git.PlainClone(into, true, &git.CloneOptions{
@@ -190,13 +232,13 @@ func cloneRepo(repourl string, into string) error {
 		SingleBranch: true,
 		// Not a net positive change for performance, this was added
 		// to better align the output when compared with the git CLI.
-		Progress: os.Stdout,
+		Progress: progress,
 	})
 	return err
 }
 
 func lineageIDFromGitClone(repourl string, tempdir string, prefixLength uint8) string {
-	err := cloneRepo(repourl, tempdir)
+	err := cloneRepo(repourl, tempdir, os.Stdout)
 	repo, err := git.PlainOpen(tempdir)
 	CheckIfError(err)
 
@@ -247,18 +289,33 @@ func importManyRepos(filename string) ([]RepoImport, error) {
 	return repos, nil
 }
 
-func analyzeRepo(analysisPath string, prefixLength uint8) (string, string, error) {
+// analyzeRepo fingerprints a repository from a URL or a path, returning it as it would be cached (without a nickname)
+func analyzeRepo(analysisPath string, prefixLength uint8) (utils.IdentityValue, error) {
 	fmt.Println("Starting analysis for", analysisPath)
-	var lineageID string
-	var source string
+	var analyzed utils.IdentityValue
+	var algorithm HashAlgorithm
 
 	// classify path type
 	if isValidUrl(analysisPath) {
 		fmt.Println("Querying from github...")
-		lineageID = lineageIDFromGitHub(analysisPath, prefixLength)
-		source = analysisPath
+		analyzed.LineageID, algorithm, analyzed.FirstCommit = lineageIDFromGitHub(analysisPath, prefixLength)
+		analyzed.URL = analysisPath
 	} else if _, err := os.Stat(analysisPath); errors.Is(err, os.ErrNotExist) {
-		return "", "", err
+		return analyzed, err
+	} else if isArchivedRepo(analysisPath) {
+		fmt.Println("Reading from archive...")
+		repo, err := openArchivedRepo(analysisPath)
+		if err != nil {
+			return analyzed, err
+		}
+		analyzed.LineageID, algorithm, analyzed.FirstCommit, err = lineageOf(repo, prefixLength)
+		if err != nil {
+			return analyzed, err
+		}
+		analyzed.URL, err = archivedRepoSource(repo, analysisPath)
+		if err != nil {
+			return analyzed, err
+		}
 	} else {
 		fmt.Println("Reading from disk...")
 		var repo *git.Repository
@@ -270,22 +327,42 @@ func analyzeRepo(analysisPath string, prefixLength uint8) (string, string, error
 			fmt.Println(err)
 		}
 
-		lineageID, err = getLineageIDFromRepo(repo, prefixLength)
+		analyzed.LineageID, algorithm, analyzed.FirstCommit, err = lineageOf(repo, prefixLength)
 		if err != nil {
 			fmt.Println("error in get id:")
 			fmt.Println(err)
 		}
-		source, err = getOriginUrlFromRepo(repo)
+		analyzed.URL, err = getOriginUrlFromRepo(repo)
 		if err != nil {
 			fmt.Println("error in get origin:")
 			fmt.Println(err)
 		}
 
 	}
-	return source, lineageID, nil
+	analyzed.HashAlgorithm = algorithm.String()
+	analyzed.PrefixLength = prefixLength
+	return analyzed, nil
 }
 
-
+// promptMergeConflict asks on the terminal which side of each conflict to keep during an interactive cache merge
+func promptMergeConflict(in *bufio.Reader) utils.MergePrompt {
+	return func(conflict utils.MergeConflict) (bool, error) {
+		fmt.Printf("%s conflict for %s: local %q, incoming %q\n", conflict.Kind, conflict.URL, conflict.Local, conflict.Incoming)
+		for {
+			fmt.Print("keep [l]ocal or take [i]ncoming? ")
+			answer, err := in.ReadString('\n')
+			if err != nil {
+				return false, fmt.Errorf("no answer for the %s conflict of %s: %w", conflict.Kind, conflict.URL, err)
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "l", "local":
+				return false, nil
+			case "i", "incoming":
+				return true, nil
+			}
+		}
+	}
+}
 
 func writeResults(data [][]string, headers []string, destination string) error {
 
@@ -336,25 +413,173 @@ type Analyze struct {
 	Enabled bool `hidden:"true" no-ini:"true"`
 
 	Args struct {
-		Repository string `description:"The repository to analyze" required:"true"`
+		Repository string `description:"The repository to analyze: a URL, a path, or a git bundle or tar/zip archive of a repository" required:"true"`
 		Nickname   string `description:"A nickname to assign to the new record"`
 	} ` positional-args:"yes"`
 }
 
 type Export struct {
-	Enabled bool   `hidden:"true" no-ini:"true"`
-	Path    string `long:"path" description:"The path to export to" default:"database.csv"`
+	Enabled   bool   `hidden:"true" no-ini:"true"`
+	Path      string `long:"path" description:"The path to export to (defaults to database.<format>)"`
+	Format    string `long:"format" choice:"csv" choice:"json" choice:"ndjson" choice:"parquet" default:"csv" description:"the format to export in"`
+	Positions string `long:"positions" description:"parquet only: also write an exploded table with one row per (repository, position, prefix) to this path"`
 }
 
 type ImportCommand struct {
 	Enabled       bool   `hidden:"true" no-ini:"true"`
+	Jobs          int    `long:"jobs" short:"j" default:"1" description:"the number of repositories to clone at the same time"`
 	Path          string `long:"path" description:"The path to import from" required:"true"`
 	CloneExisting bool   `long:"clone-existing" description:"whether or not to clone a repository if it exists in the cache"`
 	PreserveClone bool   `long:"preserve-clone" description:"whether to preserve cloned repositories after they have been identified and cached"`
+	FromExport    bool   `long:"from-export" description:"restore a file written by the export command instead of cloning from a url,nickname list"`
+	Format        string `long:"format" choice:"csv" choice:"json" choice:"ndjson" description:"the format of the export file (guessed from the extension if not given)"`
+}
+
+type RefreshCommand struct {
+	Enabled       bool          `hidden:"true" no-ini:"true"`
+	OlderThan     time.Duration `long:"older-than" default:"168h" description:"refresh repositories that were last fingerprinted longer ago than this"`
+	Filter        string        `long:"filter" description:"only refresh repositories whose url or nickname contains this"`
+	Jobs          int           `long:"jobs" short:"j" default:"1" description:"the number of repositories to refresh at the same time"`
+	PreserveClone bool          `long:"preserve-clone" description:"keep the clones around so the next refresh only needs to fetch"`
+	DryRun        bool          `long:"dry-run" description:"only list the repositories that would be refreshed"`
 }
 
 type SimilarityCommand struct {
+	Enabled bool   `hidden:"true" no-ini:"true"`
+	Rebuild bool   `long:"rebuild" description:"rebuild the similarity tree from scratch instead of loading the one saved next to the cache"`
+	Metric  string `long:"metric" choice:"shared-fraction" choice:"jaccard" choice:"containment" choice:"divergence" choice:"distance" description:"also list every pair of related repositories, closest first according to this metric"`
+	Format  string `long:"format" choice:"text" choice:"dot" choice:"mermaid" choice:"newick" choice:"phyloxml" default:"text" description:"text report, or only the tree as a Graphviz DOT or Mermaid graph, or as a Newick or PhyloXML phylogenetic tree"`
+	Cluster bool   `long:"cluster" description:"dot and mermaid only: group each family of repositories in a box"`
+	HTML    string `long:"html" description:"write a self-contained html report with a searchable table and a collapsible tree to this path"`
+}
+
+type FamiliesCommand struct {
+	Enabled     bool    `hidden:"true" no-ini:"true"`
+	MinShared   int     `long:"min-shared" default:"16" description:"repositories sharing at least this many commits are in the same family (0 to disable)"`
+	MinFraction float64 `long:"min-fraction" default:"0.5" description:"repositories sharing at least this fraction of the shorter history are in the same family (0 to disable)"`
+	Singletons  bool    `long:"singletons" description:"also list repositories that are not related to any other"`
+}
+
+type UpstreamCommand struct {
+	Enabled     bool    `hidden:"true" no-ini:"true"`
+	Fetch       bool    `long:"fetch" description:"fetch fork, star and activity metadata from GitHub for family members that have none yet (uses GITHUB_TOKEN if set)"`
+	Top         int     `long:"top" default:"3" description:"the number of candidates to show per family"`
+	MinShared   int     `long:"min-shared" default:"16" description:"see the families command"`
+	MinFraction float64 `long:"min-fraction" default:"0.5" description:"see the families command"`
+}
+
+type CompareCommand struct {
+	Enabled bool   `hidden:"true" no-ini:"true"`
+	Metric  string `long:"metric" choice:"shared-fraction" choice:"jaccard" choice:"containment" choice:"divergence" choice:"distance" description:"only show this metric (all of them are shown by default)"`
+
+	Args struct {
+		A string `description:"The nickname, URL or alias of a cached repository" required:"true"`
+		B string `description:"The nickname, URL or alias of the cached repository to compare it to" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type RelatedCommand struct {
 	Enabled bool `hidden:"true" no-ini:"true"`
+	Top     int  `long:"top" short:"k" default:"10" description:"the number of related repositories to show (0 for all of them)"`
+
+	Args struct {
+		Repository string `description:"The nickname, URL or alias of a cached repository" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type AliasAddCommand struct {
+	Enabled bool `hidden:"true" no-ini:"true"`
+	URL     bool `long:"url" description:"record the alias as an additional URL (e.g. a mirror) instead of a nickname"`
+
+	Args struct {
+		Repository string `description:"The nickname, URL or alias of a cached repository" required:"true"`
+		Alias      string `description:"The alias to add" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type AliasListCommand struct {
+	Enabled bool `hidden:"true" no-ini:"true"`
+
+	Args struct {
+		Repository string `description:"The nickname, URL or alias of a cached repository" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type AliasMergeCommand struct {
+	Enabled bool `hidden:"true" no-ini:"true"`
+
+	Args struct {
+		Keep      string `description:"The repository to keep" required:"true"`
+		Duplicate string `description:"The repository to fold into the kept one" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type AliasSplitCommand struct {
+	Enabled   bool     `hidden:"true" no-ini:"true"`
+	Nicknames []string `long:"nickname" description:"a nickname alias to move to the new repository (may be repeated)"`
+
+	Args struct {
+		Repository string `description:"The repository to split from" required:"true"`
+		URL        string `description:"The url alias to turn into its own repository" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type AliasCommand struct {
+	Add   AliasAddCommand   `command:"add" description:"add a nickname or url alias to a repository"`
+	List  AliasListCommand  `command:"list" description:"list the aliases of a repository"`
+	Merge AliasMergeCommand `command:"merge" description:"merge two repositories that are the same project"`
+	Split AliasSplitCommand `command:"split" description:"split a url alias off into its own repository"`
+}
+
+type CacheMergeCommand struct {
+	Enabled bool   `hidden:"true" no-ini:"true"`
+	Policy  string `long:"policy" choice:"newest" choice:"history" choice:"interactive" choice:"report" default:"report" description:"how to resolve conflicts: newest wins, newest wins but keep the other lineage as history, ask about each one, or only report what would happen"`
+
+	Args struct {
+		Other string `description:"The cache database to merge into this one" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type CacheCommand struct {
+	Merge CacheMergeCommand `command:"merge" description:"merge another cache database into this one"`
+}
+
+type IndexBuildCommand struct {
+	Enabled bool `hidden:"true" no-ini:"true"`
+}
+
+type IndexLookupCommand struct {
+	Enabled bool `hidden:"true" no-ini:"true"`
+
+	Args struct {
+		LineageID string `description:"The lineage ID to look up" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type IndexPrefixCommand struct {
+	Enabled bool `hidden:"true" no-ini:"true"`
+
+	Args struct {
+		Prefix string `description:"The start of a lineage ID" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type IndexNearestCommand struct {
+	Enabled bool `hidden:"true" no-ini:"true"`
+	Top     int  `long:"top" short:"k" default:"10" description:"the number of related repositories to show (0 for all of them)"`
+	ID      bool `long:"id" description:"the argument is a lineage ID rather than a cached repository"`
+
+	Args struct {
+		Repository string `description:"The nickname, URL or alias of a cached repository" required:"true"`
+	} ` positional-args:"yes"`
+}
+
+type IndexCommand struct {
+	Path    string              `long:"path" description:"the index file to use (defaults to the cache path with .index appended)"`
+	Build   IndexBuildCommand   `command:"build" description:"build a memory-mapped similarity index of every cached repository"`
+	Lookup  IndexLookupCommand  `command:"lookup" description:"list the repositories with exactly this lineage ID"`
+	Prefix  IndexPrefixCommand  `command:"prefix" description:"list the repositories whose history starts with this part of a lineage ID"`
+	Nearest IndexNearestCommand `command:"nearest" description:"list the repositories most closely related to a repository"`
 }
 
 type BenchmarkCommand struct {
@@ -366,10 +591,18 @@ type MainCmd struct {
 	Verbosity  []bool            `short:"v" long:"verbose" description:"Show verbose debug information"`
 	CachePath  string            `long:"cachepath" default:"cache.sqlite" description:"The path to the cache database to use"`
 	Analyze    Analyze           `command:"analyze" description:"Analyze a repository"`
-	Export     Export            `command:"export" description:"export the database to CSV"`
-	Import     ImportCommand     `command:"import" description:"import from CSV"`
+	Export     Export            `command:"export" description:"export the database to CSV, JSON, NDJSON or Parquet"`
+	Import     ImportCommand     `command:"import" description:"import from CSV or from an export"`
 	Similarity SimilarityCommand `command:"similarity" description:"run repo similarity report"`
+	Families   FamiliesCommand   `command:"families" description:"group the cached repositories into families of related repositories"`
+	Upstream   UpstreamCommand   `command:"upstream" description:"find the likely original repository of each family"`
+	Compare    CompareCommand    `command:"compare" description:"compare the lineages of two cached repositories"`
+	Related    RelatedCommand    `command:"related" description:"list the cached repositories most closely related to a repository"`
 	Benchmark  BenchmarkCommand  `command:"benchmark" description:"run a benchmark"`
+	Refresh    RefreshCommand    `command:"refresh" description:"re-fingerprint cached repositories that have gone stale"`
+	Alias      AliasCommand      `command:"alias" description:"manage repository aliases"`
+	Cache      CacheCommand      `command:"cache" description:"manage the cache database"`
+	Index      IndexCommand      `command:"index" description:"build and query a similarity index for corpora too large for the similarity tree"`
 }
 
 // Detect when the subcommand is used.
@@ -385,14 +618,70 @@ func (c *ImportCommand) Execute(args []string) error {
 	c.Enabled = true
 	return nil
 }
+func (c *RefreshCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
 func (c *SimilarityCommand) Execute(args []string) error {
 	c.Enabled = true
 	return nil
 }
+func (c *FamiliesCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *UpstreamCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *CompareCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *RelatedCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
 func (c *BenchmarkCommand) Execute(args []string) error {
 	c.Enabled = true
 	return nil
 }
+func (c *AliasAddCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *AliasListCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *AliasMergeCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *AliasSplitCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *IndexBuildCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *IndexLookupCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *IndexPrefixCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *IndexNearestCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
+func (c *CacheMergeCommand) Execute(args []string) error {
+	c.Enabled = true
+	return nil
+}
 
 func main() {
 	var opts MainCmd
@@ -415,22 +704,30 @@ func main() {
 
 	if opts.Analyze.Enabled {
 		analysisPath := opts.Analyze.Args.Repository
-		source, lineageID, err := analyzeRepo(analysisPath, 4)
+		analyzed, err := analyzeRepo(analysisPath, 4)
 		if errors.Is(err, os.ErrNotExist) {
 			fmt.Println("Could not Analyze. Attempting fetch from cache...")
 			// assume its a name and fetch from cache
-			cached, err := cache.GetByNickname(analysisPath)
+			cached, err := cache.Resolve(analysisPath)
 			if err != nil {
 				panic(err)
 			}
-			lineageID = cached.LineageID
-			source = cached.URL
+			analyzed = *cached
+		} else if err != nil {
+			fmt.Println("error in analysis:")
+			fmt.Println(err)
+			return
 		}
+		lineageID := analyzed.LineageID
+		source := analyzed.URL
 
 		if !cache.Has(source) {
 			newValue := utils.IdentityValue{
-				URL:       source,
-				LineageID: lineageID,
+				URL:           source,
+				LineageID:     lineageID,
+				HashAlgorithm: analyzed.HashAlgorithm,
+				PrefixLength:  analyzed.PrefixLength,
+				FirstCommit:   analyzed.FirstCommit,
 			}
 			if opts.Analyze.Args.Nickname != "" {
 				newValue.Nickname = opts.Analyze.Args.Nickname
@@ -438,6 +735,15 @@ func main() {
 				newValue.Nickname = source
 			}
 			cache.Add(newValue)
+		} else if nickname := opts.Analyze.Args.Nickname; nickname != "" {
+			// already known, so remember the new name as an alias
+			if cached, err := cache.Resolve(source); err == nil && cached.Nickname != nickname {
+				err = cache.AddAlias(cached.ID, utils.AliasNickname, nickname)
+				if err != nil {
+					fmt.Println("error adding alias:")
+					fmt.Println(err)
+				}
+			}
 		}
 
 		fmt.Println(lineageID)
@@ -445,114 +751,342 @@ func main() {
 
 	}
 
-	if opts.Import.Enabled {
+	if opts.Import.Enabled && opts.Import.FromExport {
+		fmt.Println("Restoring export from", opts.Import.Path)
+		format := utils.ExportFormat(opts.Import.Format)
+		if format == "" {
+			format, err = utils.ExportFormatFromPath(opts.Import.Path)
+			CheckIfError(err)
+		}
+		summary, err := cache.ImportFromFile(opts.Import.Path, format)
+		CheckIfError(err)
+		fmt.Println("added", summary.Added, "updated", summary.Updated, "unchanged", summary.Unchanged)
+	}
+
+	if opts.Import.Enabled && !opts.Import.FromExport {
 		fmt.Println("Importing from", opts.Import.Path)
 		repos, err := importManyRepos(opts.Import.Path)
 		CheckIfError(err)
 
-		tempdir := repositoryStorageDir
-
-		totalRepos := len(repos)
-		fmt.Println("Beginning Cloning of", totalRepos, "repositories")
-
-		// Creating a channel
-
-		cleanupRepos := !opts.Import.PreserveClone
-
-
-
+		jobs := []fingerprintJob{}
 		for _, repo := range repos {
-			if !opts.Import.CloneExisting && cache.Has(repo.RepoSource) {
-				fmt.Println("\t Source exists in cache, skipping")
-				// processedRepos += 1
+			existing, err := cache.Resolve(repo.RepoSource)
+			if err != nil {
+				existing = nil
+			}
+			if !opts.Import.CloneExisting && (existing != nil || cache.Has(repo.RepoSource)) {
+				fmt.Println("\t Source exists in cache, skipping", repo.RepoSource)
 				continue
 			}
+			jobs = append(jobs, fingerprintJob{
+				Source:   repo.RepoSource,
+				Nickname: repo.Nickname,
+				Existing: existing,
+			})
+		}
 
-			owner, repoName := repoOwnerAndNameFromURL(repo.RepoSource)
-			fmt.Println("Importing", repoName, "from", owner, "as \""+repo.Nickname+"\"")
-			cloneDir := tempdir + "/" + owner + "_" + repoName
+		fmt.Println("Beginning Cloning of", len(jobs), "repositories")
 
-			err := os.MkdirAll(cloneDir, 0755)
-			if err != nil {
-				fmt.Println("error in mkdir:")
-				fmt.Println(err)
+		pipeline := importPipeline{
+			StorageDir:     repositoryStorageDir,
+			Workers:        opts.Import.Jobs,
+			PreserveClones: opts.Import.PreserveClone,
+			PrefixLength:   4,
+		}
+		for result := range pipeline.Run(jobs) {
+			repo := result.Job
+			if result.Err != nil {
+				fmt.Println("Failed to import", repo.Source)
+				fmt.Println(result.Err)
 				continue
 			}
-			err = cloneRepo(repo.RepoSource, cloneDir)
-			if err != nil {
-				fmt.Println("error in clone:")
-				fmt.Println(err)
-				err = os.RemoveAll(cloneDir)
+			existing := repo.Existing
+			if existing == nil && result.Source != repo.Source {
+				// archives are only known by the URL they are cached under once they have been opened
+				existing, _ = cache.Resolve(result.Source)
+				if existing != nil && !opts.Import.CloneExisting {
+					fmt.Println("\t Source exists in cache, skipping", result.Source)
+					continue
+				}
+			}
+			fmt.Println("Imported", repo.Source, "as \""+repo.Nickname+"\"")
+
+			if existing != nil {
+				_, err := cache.UpdateLineage(existing.ID, pipeline.identity(result), "import")
 				if err != nil {
-					fmt.Println("error during cleanup of error")
+					fmt.Println("error updating cache")
 					fmt.Println(err)
 				}
 				continue
 			}
-
-			gitrepo, err := git.PlainOpen(cloneDir)
+			newValue := pipeline.identity(result)
+			if repo.Nickname != "" {
+				newValue.Nickname = repo.Nickname
+			}
+			err := cache.Add(newValue)
 			if err != nil {
-				fmt.Println("error opening repo")
+				fmt.Println("error addding to cache")
 				fmt.Println(err)
+			}
+		}
+	}
+
+	if opts.Refresh.Enabled {
+		stale, err := cache.GetStale(time.Now().Add(-opts.Refresh.OlderThan))
+		CheckIfError(err)
+
+		jobs := []fingerprintJob{}
+		for _, v := range stale {
+			if opts.Refresh.Filter != "" && !strings.Contains(v.URL, opts.Refresh.Filter) && !strings.Contains(v.Nickname, opts.Refresh.Filter) {
 				continue
 			}
+			jobs = append(jobs, fingerprintJob{
+				Source:   v.URL,
+				Nickname: v.Nickname,
+				Existing: &v,
+			})
+		}
+		fmt.Println(len(jobs), "repositories were last fingerprinted more than", opts.Refresh.OlderThan, "ago")
+
+		if opts.Refresh.DryRun {
+			for _, job := range jobs {
+				fmt.Println("\t", job.Nickname, "("+job.Source+")", "last fingerprinted", job.Existing.Timestamp.Format(time.RFC3339))
+			}
+			return
+		}
 
-			lineageID, err := getLineageIDFromRepo(gitrepo, 4)
+		pipeline := importPipeline{
+			StorageDir:     repositoryStorageDir,
+			Workers:        opts.Refresh.Jobs,
+			PreserveClones: opts.Refresh.PreserveClone,
+			Incremental:    true,
+			PrefixLength:   4,
+		}
+		changed, unchanged, failed := 0, 0, 0
+		for result := range pipeline.Run(jobs) {
+			repo := result.Job
+			if result.Err != nil {
+				fmt.Println("Failed to refresh", repo.Source)
+				fmt.Println(result.Err)
+				failed += 1
+				continue
+			}
+			previous, err := cache.UpdateLineage(repo.Existing.ID, pipeline.identity(result), "refresh")
 			if err != nil {
-				fmt.Println("error getting id")
+				fmt.Println("error updating cache")
 				fmt.Println(err)
+				failed += 1
 				continue
 			}
+			how := "cloned"
+			if result.Incremental {
+				how = "fetched"
+			}
+			if previous != result.LineageID {
+				changed += 1
+				fmt.Println("Refreshed", repo.Nickname, "("+how+"):", len(previous), "->", len(result.LineageID), "commits")
+			} else {
+				unchanged += 1
+				fmt.Println("Refreshed", repo.Nickname, "("+how+"): unchanged")
+			}
+		}
+		fmt.Println("changed", changed, "unchanged", unchanged, "failed", failed)
+	}
 
-			if !cache.Has(repo.RepoSource) {
-				newValue := utils.IdentityValue{
-					URL:       repo.RepoSource,
-					LineageID: lineageID,
-				}
-				if repo.Nickname != "" {
-					newValue.Nickname = repo.Nickname
-				}
-				err := cache.Add(newValue)
-				if err != nil {
-					fmt.Println("error addding to cache")
-					fmt.Println(err)
-					continue
+	if opts.Alias.Add.Enabled {
+		identity, err := cache.Resolve(opts.Alias.Add.Args.Repository)
+		CheckIfError(err)
+		kind := utils.AliasNickname
+		if opts.Alias.Add.URL {
+			kind = utils.AliasURL
+		}
+		err = cache.AddAlias(identity.ID, kind, opts.Alias.Add.Args.Alias)
+		CheckIfError(err)
+		fmt.Println("Added", kind, "alias", opts.Alias.Add.Args.Alias, "to", identity.Nickname)
+	}
+
+	if opts.Alias.List.Enabled {
+		identity, err := cache.Resolve(opts.Alias.List.Args.Repository)
+		CheckIfError(err)
+		aliases, err := cache.Aliases(identity.ID)
+		CheckIfError(err)
+		fmt.Println("nickname:\t", identity.Nickname)
+		fmt.Println("url:\t\t", identity.URL)
+		for _, alias := range aliases {
+			fmt.Println(string(alias.Kind)+" alias:\t", alias.Value)
+		}
+	}
+
+	if opts.Alias.Merge.Enabled {
+		keep, err := cache.Resolve(opts.Alias.Merge.Args.Keep)
+		CheckIfError(err)
+		duplicate, err := cache.Resolve(opts.Alias.Merge.Args.Duplicate)
+		CheckIfError(err)
+		if keep.LineageID != duplicate.LineageID {
+			fmt.Println("Warning: merging repositories with different lineage IDs, keeping", keep.LineageID)
+		}
+		err = cache.Merge(keep.ID, duplicate.ID)
+		CheckIfError(err)
+		fmt.Println("Merged", duplicate.Nickname, "into", keep.Nickname)
+	}
+
+	if opts.Alias.Split.Enabled {
+		identity, err := cache.Resolve(opts.Alias.Split.Args.Repository)
+		CheckIfError(err)
+		created, err := cache.Split(identity.ID, opts.Alias.Split.Args.URL, opts.Alias.Split.Nicknames...)
+		CheckIfError(err)
+		fmt.Println("Split", created.URL, "from", identity.Nickname, "as", created.Nickname)
+	}
+
+	if opts.Cache.Merge.Enabled {
+		if _, err := os.Stat(opts.Cache.Merge.Args.Other); err != nil {
+			// dont let the merge create an empty database by accident
+			CheckIfError(err)
+		}
+		other := utils.IdentityCache{
+			Filename: opts.Cache.Merge.Args.Other,
+		}
+		policy := utils.MergePolicy(opts.Cache.Merge.Policy)
+		fmt.Println("Merging", other.Filename, "into", cache.Filename, "using policy", policy)
+		summary, err := cache.MergeFrom(&other, policy, promptMergeConflict(bufio.NewReader(os.Stdin)))
+		CheckIfError(err)
+		if policy == utils.MergeReport {
+			fmt.Println("Report only, nothing was changed. Use --policy to apply the merge.")
+		}
+		fmt.Println("added", summary.Added, "updated", summary.Updated, "unchanged", summary.Unchanged, "conflicting", summary.Conflicting)
+		fmt.Println(len(summary.Conflicts), "conflicts")
+		for _, conflict := range summary.Conflicts {
+			fmt.Println("\t", conflict)
+		}
+	}
+
+	indexPath := opts.Index.Path
+	if indexPath == "" {
+		indexPath = similarityIndexPath(&cache)
+	}
+
+	if opts.Index.Build.Enabled {
+		rows, err := cache.GetAll()
+		CheckIfError(err)
+		ids, algorithm, err := cachedLineageIDs(rows)
+		CheckIfError(err)
+		CheckIfError(writeSimilarityIndexFile(indexPath, ids, algorithm))
+		fmt.Println("Indexed", len(ids), "repositories in", indexPath)
+	}
+
+	if opts.Index.Lookup.Enabled || opts.Index.Prefix.Enabled || opts.Index.Nearest.Enabled {
+		index, err := OpenSimilarityIndex(indexPath)
+		CheckIfError(err)
+		defer index.Close()
+
+		if opts.Index.Lookup.Enabled {
+			sources, err := index.Lookup(opts.Index.Lookup.Args.LineageID)
+			CheckIfError(err)
+			if len(sources) == 0 {
+				fmt.Println("No indexed repository has this lineage ID")
+			}
+			for _, source := range sources {
+				fmt.Println(source)
+			}
+		}
+
+		if opts.Index.Prefix.Enabled {
+			found, err := index.WithPrefix(opts.Index.Prefix.Args.Prefix)
+			CheckIfError(err)
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tCOMMITS")
+			for _, r := range found {
+				fmt.Fprintf(w, "%s\t%d\n", r.Source, r.Length)
+			}
+			w.Flush()
+		}
+
+		if opts.Index.Nearest.Enabled {
+			lineageID := opts.Index.Nearest.Args.Repository
+			exclude := []string{}
+			if !opts.Index.Nearest.ID {
+				cached, err := cache.Resolve(opts.Index.Nearest.Args.Repository)
+				CheckIfError(err)
+				algorithm, err := parseHashAlgorithm(cached.HashAlgorithm)
+				CheckIfError(err)
+				if algorithm != index.Algorithm() {
+					CheckIfError(fmt.Errorf("%s is fingerprinted from %s commits but the index from %s ones: %w",
+						treeSource(*cached), algorithm, index.Algorithm(), ErrHashAlgorithmMismatch))
 				}
-				if cleanupRepos {
-					err = os.RemoveAll(cloneDir)
-					if err != nil {
-						fmt.Println("cleanup error")
-						fmt.Println(err)
-						// errors <- err
-						continue
-					}
+				lineageID = cached.LineageID
+				exclude = append(exclude, treeSource(*cached))
+			}
+			related, err := index.Nearest(lineageID, opts.Index.Nearest.Top, exclude...)
+			CheckIfError(err)
+
+			if len(related) == 0 {
+				fmt.Println("No indexed repositories share any history with", opts.Index.Nearest.Args.Repository)
+			} else {
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "REPOSITORY\tSHARED\tDIVERGES AT\tONLY HERE\tONLY THERE")
+				for _, r := range related {
+					fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", r.Source, r.SharedLength, r.DivergesAt, r.UniqueToQuery, r.UniqueToOther)
 				}
+				w.Flush()
 			}
 		}
 	}
 
 	if opts.Export.Enabled {
-		fmt.Println("Exporting db to", opts.Export.Path)
-		cache.ExportAllToCSV(opts.Export.Path)
+		path := opts.Export.Path
+		if path == "" {
+			path = "database." + opts.Export.Format
+		}
+		fmt.Println("Exporting db to", path)
+		if opts.Export.Format == string(utils.FormatParquet) {
+			err := cache.ExportParquetToFile(path, opts.Export.Positions)
+			CheckIfError(err)
+		} else {
+			err := cache.ExportToFile(path, utils.ExportFormat(opts.Export.Format))
+			CheckIfError(err)
+		}
 	}
 
 	if opts.Similarity.Enabled {
-		tree := NewSimilarityTree()
-
-		cache, err := cache.GetAll()
+		tree, err := similarityTreeForCache(&cache, opts.Similarity.Rebuild)
 		CheckIfError(err)
-		// Add all repos to tree
-		for _, v := range cache {
-			// TODO: use url if no nickname available
-			err = tree.Add(v.Nickname, v.LineageID)
+
+		if opts.Similarity.HTML != "" {
+			rows, err := cache.GetAll()
 			CheckIfError(err)
+			CheckIfError(WriteSimilarityReportToFile(opts.Similarity.HTML, tree, rows))
+			fmt.Println("Wrote similarity report to", opts.Similarity.HTML)
+			return
+		}
+
+		renderOptions := RenderOptions{ClusterFamilies: opts.Similarity.Cluster}
+		switch opts.Similarity.Format {
+		case "dot":
+			CheckIfError(tree.WriteDOT(os.Stdout, renderOptions))
+			return
+		case "mermaid":
+			CheckIfError(tree.WriteMermaid(os.Stdout, renderOptions))
+			return
+		case "newick":
+			CheckIfError(tree.WriteNewick(os.Stdout))
+			return
+		case "phyloxml":
+			CheckIfError(tree.WritePhyloXML(os.Stdout))
+			return
 		}
 
-		tree.Root.Print(0)
+		tree.Print()
 		fmt.Println("")
 		fmt.Println("===========")
 		fmt.Println("")
 
+		familyOf := map[string]Family{}
+		for _, family := range tree.Families(DefaultFamilyOptions) {
+			for _, member := range family.Members {
+				familyOf[member] = family
+			}
+		}
+
 		leafFamilies := []string{}
 
 		for id, leaf := range tree.Leaves {
@@ -560,7 +1094,10 @@ func main() {
 			idString += " \t( "
 			idString += id
 			idString += " ):\t "
-			idString += leaf.Family()
+			idString += "family " + familyOf[id].ID + " (" + familyOf[id].Representative + ")"
+			if sources := tree.SourcesAt(leaf); len(sources) > 1 {
+				idString += " \t[mirrored by " + strings.Join(slices.DeleteFunc(sources, func(s string) bool { return s == id }), ", ") + "]"
+			}
 			leafFamilies = append(leafFamilies, idString)
 		}
 
@@ -570,19 +1107,211 @@ func main() {
 			fmt.Println(str)
 		}
 
+		if mirrors := tree.Mirrors(); len(mirrors) > 0 {
+			fmt.Println("")
+			for _, group := range mirrors {
+				fmt.Printf("these %d repos are exact mirrors: %s\n", len(group), strings.Join(group, ", "))
+			}
+		}
+
+		if opts.Similarity.Metric != "" {
+			metric := SimilarityMetric(opts.Similarity.Metric)
+			type pair struct {
+				a, b  string
+				value float64
+			}
+			pairs := []pair{}
+			for _, related := range tree.RelatedPairs() {
+				directions := []SourcePair{related}
+				// containment is the only asymmetric metric, so it is the only one listing both directions
+				if metric == MetricContainment {
+					directions = append(directions, related.Swap())
+				}
+				for _, p := range directions {
+					value, err := p.Metric(metric)
+					CheckIfError(err)
+					pairs = append(pairs, pair{p.A, p.B, value})
+				}
+			}
+			sort.Slice(pairs, func(i, j int) bool {
+				if pairs[i].value != pairs[j].value {
+					return (pairs[i].value < pairs[j].value) == metric.LowerIsCloser()
+				}
+				return pairs[i].a+"\x00"+pairs[i].b < pairs[j].a+"\x00"+pairs[j].b
+			})
+
+			fmt.Println("")
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "A\tB\t%s\n", strings.ToUpper(string(metric)))
+			for _, p := range pairs {
+				fmt.Fprintf(w, "%s\t%s\t%.4g\n", p.a, p.b, p.value)
+			}
+			w.Flush()
+		}
+
 		// sanity check with prefix lengths
 
 	}
 
-	if opts.Benchmark.Enabled {
+	if opts.Families.Enabled {
+		tree, err := similarityTreeForCache(&cache, false)
+		CheckIfError(err)
+
+		families := tree.Families(FamilyOptions{
+			MinShared:   opts.Families.MinShared,
+			MinFraction: opts.Families.MinFraction,
+		})
+		singletons := 0
+		for _, family := range families {
+			if len(family.Members) == 1 && !opts.Families.Singletons {
+				singletons += 1
+				continue
+			}
+			fmt.Printf("family %s: %d repositories sharing %d commits, represented by %s\n", family.ID, len(family.Members), family.SharedCommits, family.Representative)
+			for _, member := range family.Members {
+				fmt.Println("\t" + member)
+			}
+		}
+		if singletons > 0 {
+			fmt.Printf("%d repositories are not related to any other (use --singletons to list them)\n", singletons)
+		}
+	}
 
+	if opts.Upstream.Enabled {
+		tree, err := similarityTreeForCache(&cache, false)
+		CheckIfError(err)
+		rows, err := cache.GetAll()
+		CheckIfError(err)
+
+		families := tree.Families(FamilyOptions{
+			MinShared:   opts.Upstream.MinShared,
+			MinFraction: opts.Upstream.MinFraction,
+		})
+
+		metadata, err := cache.Metadata()
+		CheckIfError(err)
+
+		if opts.Upstream.Fetch {
+			inFamily := map[string]bool{}
+			for _, family := range families {
+				if len(family.Members) > 1 {
+					for _, member := range family.Members {
+						inFamily[member] = true
+					}
+				}
+			}
+			client := github.NewClient(nil)
+			if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+				client = client.WithAuthToken(token)
+			}
+			for _, v := range rows {
+				if _, has := metadata[v.ID]; has || !inFamily[treeSource(v)] {
+					continue
+				}
+				m, err := fetchGitHubMetadata(context.Background(), client, v.URL)
+				if errors.Is(err, errUnsupportedForge) {
+					continue
+				} else if err != nil {
+					fmt.Println("Could not fetch metadata for", v.URL+":", err)
+					continue
+				}
+				m.IdentityID = v.ID
+				CheckIfError(cache.SetMetadata(m))
+				metadata[v.ID] = m
+			}
+		}
+
+		signals := UpstreamSignals{
+			URLs:         map[string]string{},
+			Metadata:     map[string]utils.RepoMetadata{},
+			FirstCommits: map[string]time.Time{},
+		}
+		for _, v := range rows {
+			signals.URLs[treeSource(v)] = v.URL
+			if !v.FirstCommit.IsZero() {
+				signals.FirstCommits[treeSource(v)] = v.FirstCommit
+			}
+			if m, has := metadata[v.ID]; has {
+				signals.Metadata[treeSource(v)] = m
+			}
+		}
+
+		for _, result := range InferUpstreams(tree, families, signals) {
+			fmt.Printf("family %s (%d repositories): likely upstream %s (confidence %.2f)\n", result.Family.ID, len(result.Family.Members), result.Candidates[0].Source, result.Confidence)
+			for i, candidate := range result.Candidates {
+				if opts.Upstream.Top > 0 && i >= opts.Upstream.Top {
+					break
+				}
+				fmt.Printf("\t%d. %s (score %.2f)\n", i+1, candidate.Source, candidate.Score)
+				for _, evidence := range candidate.Evidence {
+					fmt.Println("\t\t- " + evidence)
+				}
+			}
+		}
+	}
+
+	if opts.Compare.Enabled {
+		a, err := cache.Resolve(opts.Compare.Args.A)
+		CheckIfError(err)
+		b, err := cache.Resolve(opts.Compare.Args.B)
+		CheckIfError(err)
+
+		lineageA, err := cachedLineageID(*a)
+		CheckIfError(err)
+		lineageB, err := cachedLineageID(*b)
+		CheckIfError(err)
+		if lineageA.Algorithm() != lineageB.Algorithm() {
+			CheckIfError(fmt.Errorf("%s is fingerprinted from %s commits but %s from %s ones: %w",
+				treeSource(*a), lineageA.Algorithm(), treeSource(*b), lineageB.Algorithm(), ErrHashAlgorithmMismatch))
+		}
+		// compared in the tree, the same way that similarity --metric does
+		tree, err := similarityTreeForCache(&cache, false)
+		CheckIfError(err)
+		comparison, err := tree.Compare(treeSource(*a), treeSource(*b))
+		CheckIfError(err)
+		fmt.Printf("%s: %d commits, %s: %d commits, %d shared\n", treeSource(*a), comparison.LengthA, treeSource(*b), comparison.LengthB, comparison.Shared)
+
+		metrics := SimilarityMetrics
+		if opts.Compare.Metric != "" {
+			metrics = []SimilarityMetric{SimilarityMetric(opts.Compare.Metric)}
+		}
+		for _, metric := range metrics {
+			value, err := comparison.Metric(metric)
+			CheckIfError(err)
+			fmt.Printf("%s:\t%.4g\n", metric, value)
+		}
+	}
+
+	if opts.Related.Enabled {
+		cached, err := cache.Resolve(opts.Related.Args.Repository)
+		CheckIfError(err)
+
+		tree, err := similarityTreeForCache(&cache, false)
+		CheckIfError(err)
+
+		related, err := tree.Related(treeSource(*cached), opts.Related.Top)
+		CheckIfError(err)
+
+		if len(related) == 0 {
+			fmt.Println("No cached repositories share any history with", treeSource(*cached))
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tSHARED\tDIVERGES AT\tONLY HERE\tONLY THERE")
+			for _, r := range related {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", r.Source, r.SharedLength, r.DivergesAt, r.UniqueToQuery, r.UniqueToOther)
+			}
+			w.Flush()
+		}
+	}
+
+	if opts.Benchmark.Enabled {
 
 		benchResults := [][]string{}
 
 		benchResultsFile := opts.Benchmark.BenchmarkType + ".csv"
 
 		if opts.Benchmark.BenchmarkType == "tree" {
-			// take subsequently more items from the cache and load them into the tree, measuring the time to do so
+			// build trees out of subsequently more items from the cache, measuring the time to do so
 
 			// loop through all repos in the repositories folder, calculating their ID
 			benchHeaders := []string{"number of items", "duration"}
@@ -595,13 +1324,16 @@ func main() {
 			// start timer
 			globalStart := time.Now()
 
-			benchTree := NewSimilarityTree()
 			for i := 100; i < cacheLength; i += 100 {
+				items, _, err := cachedLineageIDs(allCache[:i])
+				if err != nil {
+					fmt.Println(err)
+					break
+				}
 				singleStart := time.Now()
-				items := allCache[:i]
 
-				for _, item := range items {
-					benchTree.Add(item.Nickname, item.LineageID)
+				if _, err := BuildSimilarityTree(items); err != nil {
+					fmt.Println(err)
 				}
 
 				// end timer
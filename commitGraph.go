@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// Commit-graph files (see gitformat-commit-graph(5)) store the hash and parents of every commit in a repository in
+// sorted, fixed size records, so that history can be walked without finding and inflating every commit object.
+// Only the chunks needed to follow first parents are read. All integers are big endian.
+//
+//	header:       "CGPH", version (1 byte), hash version (1 byte), number of chunks (1 byte), number of base files (1 byte)
+//	chunk table:  chunk ID (4 bytes) and offset (uint64) of every chunk, then a terminating entry with the end offset
+//	OIDF:         256 cumulative counts (uint32 each) of the commits whose hash starts with each byte value
+//	OIDL:         the hashes of the commits, sorted
+//	CDAT:         per commit: tree hash, first parent, second parent (uint32 each), generation (30 bits) and commit time (34 bits)
+const commitGraphSignature = "CGPH"
+const commitGraphVersion = 1
+const commitGraphHeaderSize = 8
+
+// commitGraphNoParent is the parent position of a commit that has no (further) parents
+const commitGraphNoParent = 0x70000000
+
+const commitGraphFile = "objects/info/commit-graph"
+const commitGraphChainDir = "objects/info/commit-graphs"
+
+// commitGraphLayer is one commit-graph file. Positions in it continue from the files below it in a chain
+type commitGraphLayer struct {
+	data     []byte
+	mapped   bool
+	hashSize int
+	fanout   []byte
+	oids     []byte
+	commits  []byte
+	bases    int
+	// the number of commits in the files below this one
+	base  uint32
+	count uint32
+}
+
+// commitGraph is the commit-graph of a repository: a single file, or a chain of them with the base file first
+type commitGraph struct {
+	layers []*commitGraphLayer
+	count  uint32
+}
+
+func parseCommitGraphLayer(data []byte) (*commitGraphLayer, error) {
+	if len(data) < commitGraphHeaderSize || string(data[:4]) != commitGraphSignature {
+		return nil, errors.New("not a commit-graph file")
+	}
+	if data[4] != commitGraphVersion {
+		return nil, fmt.Errorf("unsupported commit-graph version %d", data[4])
+	}
+	layer := &commitGraphLayer{data: data, bases: int(data[7])}
+	switch data[5] {
+	case 1:
+		layer.hashSize = HashSHA1.Size()
+	case 2:
+		layer.hashSize = HashSHA256.Size()
+	default:
+		return nil, fmt.Errorf("unsupported commit-graph hash version %d", data[5])
+	}
+
+	chunks := int(data[6])
+	table := data[commitGraphHeaderSize:]
+	if len(table) < (chunks+1)*12 {
+		return nil, errors.New("commit-graph is truncated")
+	}
+	for i := 0; i < chunks; i++ {
+		entry := table[i*12:]
+		start := binary.BigEndian.Uint64(entry[4:])
+		end := binary.BigEndian.Uint64(entry[16:])
+		if start > end || end > uint64(len(data)) {
+			return nil, errors.New("commit-graph chunk is out of bounds")
+		}
+		chunk := data[start:end]
+		switch string(entry[:4]) {
+		case "OIDF":
+			layer.fanout = chunk
+		case "OIDL":
+			layer.oids = chunk
+		case "CDAT":
+			layer.commits = chunk
+		}
+	}
+
+	if len(layer.fanout) != 256*4 || layer.oids == nil || layer.commits == nil {
+		return nil, errors.New("commit-graph is missing a required chunk")
+	}
+	layer.count = binary.BigEndian.Uint32(layer.fanout[255*4:])
+	if uint64(len(layer.oids)) != uint64(layer.count)*uint64(layer.hashSize) ||
+		uint64(len(layer.commits)) != uint64(layer.count)*uint64(layer.hashSize+16) {
+		return nil, errors.New("commit-graph chunk sizes do not match its number of commits")
+	}
+	return layer, nil
+}
+
+// lookup returns the position of a commit within the file
+func (layer *commitGraphLayer) lookup(hash []byte) (uint32, bool) {
+	if len(hash) != layer.hashSize {
+		return 0, false
+	}
+	var first uint32
+	if hash[0] > 0 {
+		first = binary.BigEndian.Uint32(layer.fanout[(int(hash[0])-1)*4:])
+	}
+	last := binary.BigEndian.Uint32(layer.fanout[int(hash[0])*4:])
+	if first > last || last > layer.count {
+		return 0, false
+	}
+	i := first + uint32(sort.Search(int(last-first), func(i int) bool {
+		return bytes.Compare(layer.oid(first+uint32(i)), hash) >= 0
+	}))
+	if i < last && bytes.Equal(layer.oid(i), hash) {
+		return i, true
+	}
+	return 0, false
+}
+
+func (layer *commitGraphLayer) oid(i uint32) []byte {
+	return layer.oids[int(i)*layer.hashSize : int(i+1)*layer.hashSize]
+}
+
+func (layer *commitGraphLayer) firstParent(i uint32) uint32 {
+	return binary.BigEndian.Uint32(layer.commits[int(i)*(layer.hashSize+16)+layer.hashSize:])
+}
+
+// commitTime returns the commit time of the commit at i, in the low 34 bits of the 8 bytes after its parents
+func (layer *commitGraphLayer) commitTime(i uint32) time.Time {
+	record := layer.commits[int(i)*(layer.hashSize+16)+layer.hashSize+8:]
+	seconds := int64(binary.BigEndian.Uint32(record)&0x3)<<32 | int64(binary.BigEndian.Uint32(record[4:]))
+	return time.Unix(seconds, 0)
+}
+
+// layer returns the file that the commit at a position is in
+func (graph *commitGraph) layer(position uint32) *commitGraphLayer {
+	for i := len(graph.layers) - 1; i > 0; i-- {
+		if position >= graph.layers[i].base {
+			return graph.layers[i]
+		}
+	}
+	return graph.layers[0]
+}
+
+// position returns the position of a commit in the commit-graph, if it is in there
+func (graph *commitGraph) position(hash CommitHash) (uint32, bool) {
+	for _, layer := range graph.layers {
+		if i, ok := layer.lookup(hash); ok {
+			return layer.base + i, true
+		}
+	}
+	return 0, false
+}
+
+// pushFirstParents pushes the commit at a position and its first parents, all the way to the root commit,
+// and records the commit time of the root commit
+func (graph *commitGraph) pushFirstParents(position uint32, builder *LineageBuilder) error {
+	// a commit can't be its own ancestor, so a longer walk than there are commits means the file is corrupt
+	for steps := uint32(0); steps < graph.count; steps++ {
+		layer := graph.layer(position)
+		i := position - layer.base
+		if err := builder.Push(layer.oid(i)); err != nil {
+			return err
+		}
+		parent := layer.firstParent(i)
+		if parent == commitGraphNoParent {
+			builder.SetFirstCommit(layer.commitTime(i))
+			return nil
+		}
+		if parent >= graph.count {
+			return fmt.Errorf("commit-graph has a parent position %d out of range", parent)
+		}
+		position = parent
+	}
+	return errors.New("commit-graph has a cycle")
+}
+
+func (graph *commitGraph) Close() error {
+	var errs []error
+	for _, layer := range graph.layers {
+		if layer.mapped {
+			errs = append(errs, unmapFile(layer.data))
+		}
+	}
+	graph.layers = nil
+	return errors.Join(errs...)
+}
+
+// osPath returns where a file of a go-git filesystem is on disk, if the filesystem is on disk at all
+func osPath(fsys billy.Filesystem, name string) (string, bool) {
+	var basic billy.Basic = fsys
+	for {
+		switch f := basic.(type) {
+		case *osfs.ChrootOS, *osfs.BoundOS:
+			return filepath.Join(fsys.Root(), filepath.FromSlash(name)), true
+		case interface{ Underlying() billy.Basic }:
+			basic = f.Underlying()
+		default:
+			return "", false
+		}
+	}
+}
+
+// loadCommitGraphLayer maps a commit-graph file into memory if it is on disk, or reads it otherwise
+func loadCommitGraphLayer(fsys billy.Filesystem, name string) (*commitGraphLayer, error) {
+	var data []byte
+	mapped := false
+	if filename, ok := osPath(fsys, name); ok {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() < commitGraphHeaderSize {
+			return nil, fmt.Errorf("%s is not a commit-graph file", name)
+		}
+		data, err = mapFile(f, int(info.Size()))
+		if err != nil {
+			return nil, err
+		}
+		mapped = true
+	} else {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		data, err = io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	layer, err := parseCommitGraphLayer(data)
+	if err != nil {
+		if mapped {
+			unmapFile(data)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	layer.mapped = mapped
+	return layer, nil
+}
+
+// openCommitGraph opens the commit-graph of a repository, given the filesystem of its .git directory: the single
+// commit-graph file if there is one, like git does, and the chain of split commit-graph files otherwise.
+// Returns an error satisfying errors.Is(err, fs.ErrNotExist) if the repository has neither
+func openCommitGraph(fsys billy.Filesystem) (*commitGraph, error) {
+	graph := &commitGraph{}
+	layer, err := loadCommitGraphLayer(fsys, commitGraphFile)
+	if err == nil {
+		graph.layers = append(graph.layers, layer)
+		graph.count = layer.count
+		return graph, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	chain, err := fsys.Open(path.Join(commitGraphChainDir, "commit-graph-chain"))
+	if err != nil {
+		return nil, err
+	}
+	defer chain.Close()
+	lines := bufio.NewScanner(chain)
+	for lines.Scan() {
+		hash := strings.TrimSpace(lines.Text())
+		if hash == "" {
+			continue
+		}
+		layer, err := loadCommitGraphLayer(fsys, path.Join(commitGraphChainDir, "graph-"+hash+".graph"))
+		if err != nil {
+			graph.Close()
+			return nil, err
+		}
+		graph.layers = append(graph.layers, layer)
+		if layer.bases != len(graph.layers)-1 {
+			graph.Close()
+			return nil, fmt.Errorf("commit-graph file %s does not belong at position %d of the chain", hash, len(graph.layers)-1)
+		}
+		layer.base = graph.count
+		graph.count += layer.count
+	}
+	if err := lines.Err(); err != nil {
+		graph.Close()
+		return nil, err
+	}
+	if len(graph.layers) == 0 {
+		return nil, errors.New("commit-graph chain is empty")
+	}
+	return graph, nil
+}
+
+// repoCommitGraph opens the commit-graph of a repository, see openCommitGraph
+func repoCommitGraph(repo *git.Repository) (*commitGraph, error) {
+	storage, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return openCommitGraph(storage.Filesystem())
+}
+
+// pushHistoryFromCommitGraph pushes the first-parent history of a commit to the builder, newest commit first, the same
+// way that walking the commit objects in git.LogOrderDFSPostNoMerge does. Commits made since the commit-graph was
+// written are not in it, so those are read from their objects until one that is in the commit-graph is reached
+func pushHistoryFromCommitGraph(repo *git.Repository, graph *commitGraph, head plumbing.Hash, builder *LineageBuilder) error {
+	hash := head
+	for {
+		if position, ok := graph.position(hash[:]); ok {
+			return graph.pushFirstParents(position, builder)
+		}
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return err
+		}
+		if err := builder.Push(commit.Hash[:]); err != nil {
+			return err
+		}
+		if commit.NumParents() == 0 {
+			builder.SetFirstCommit(commit.Committer.When)
+			return nil
+		}
+		hash = commit.ParentHashes[0]
+	}
+}
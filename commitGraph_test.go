@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	commitgraph "github.com/go-git/go-git/v5/plumbing/format/commitgraph/v2"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// commitGraphFixture creates a bare repository on disk whose history has merges in both directions: one that merges
+// a side branch into master, and one that makes the side branch the first parent. Returns the repository and its path
+func commitGraphFixture(t *testing.T) (*git.Repository, string) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordObjectFormat(t, repo)
+	commits := func(head plumbing.Hash, name string, n int) plumbing.Hash {
+		for i := 0; i < n; i++ {
+			if head.IsZero() {
+				head = storeCommit(t, repo, name+" "+strconv.Itoa(i))
+			} else {
+				head = storeCommit(t, repo, name+" "+strconv.Itoa(i), head)
+			}
+		}
+		return head
+	}
+
+	base := commits(plumbing.ZeroHash, "master", 20)
+	side := commits(base, "side", 10)
+	master := commits(base, "master after branching", 5)
+	master = storeCommit(t, repo, "merge side into master", master, side)
+	side = commits(side, "side after merging", 5)
+	master = commits(master, "master after merging", 5)
+	// the side branch is the first parent from here on
+	master = storeCommit(t, repo, "merge master into side", side, master)
+	master = commits(master, "master", 10)
+	setHead(t, repo, master)
+	return repo, dir
+}
+
+// objectWalkLineageID computes the lineage ID of a repository by walking its commit objects
+func objectWalkLineageID(t *testing.T, repo *git.Repository) string {
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.Log(&git.LogOptions{From: head.Hash(), Order: git.LogOrderDFSPostNoMerge})
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, _ := NewLineageBuilder(4)
+	err = commits.ForEach(func(c *object.Commit) error {
+		return builder.Push(c.Hash[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return builder.String()
+}
+
+// encodeCommitGraph writes a commit-graph file of every commit in a repository with go-git
+func encodeCommitGraph(t *testing.T, repo *git.Repository, fsys billy.Filesystem) {
+	index := commitgraph.NewMemoryIndex()
+	commits, err := repo.CommitObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = commits.ForEach(func(c *object.Commit) error {
+		index.Add(c.Hash, &commitgraph.CommitData{
+			TreeHash:     c.TreeHash,
+			ParentHashes: c.ParentHashes,
+			When:         c.Committer.When,
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Create(commitGraphFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := commitgraph.NewEncoder(f).Encode(index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commitGraphLineageID computes the lineage ID of a repository from its commit-graph alone
+func commitGraphLineageID(t *testing.T, repo *git.Repository) string {
+	graph, err := repoCommitGraph(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer graph.Close()
+	head, _ := repo.Head()
+	hash := head.Hash()
+	position, ok := graph.position(hash[:])
+	if !ok {
+		t.Fatalf(`commit-graph does not have the head commit`)
+	}
+	builder, _ := NewLineageBuilder(4)
+	if err := graph.pushFirstParents(position, builder); err != nil {
+		t.Fatal(err)
+	}
+	return builder.String()
+}
+
+func TestCommitGraphLineageID(t *testing.T) {
+	repo, dir := commitGraphFixture(t)
+	expected := objectWalkLineageID(t, repo)
+	if _, err := repoCommitGraph(repo); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf(`repoCommitGraph() of a repository without a commit-graph = %v`, err)
+	}
+
+	encodeCommitGraph(t, repo, repo.Storer.(*filesystem.Storage).Filesystem())
+	if _, err := os.Stat(filepath.Join(dir, "objects", "info", "commit-graph")); err != nil {
+		t.Fatal(err)
+	}
+	if id := commitGraphLineageID(t, repo); id != expected {
+		t.Errorf(`lineage ID from the commit-graph = %q, was not %q`, id, expected)
+	}
+	if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+		t.Errorf(`getLineageIDFromRepo() = %q, %v, was not %q`, id, err, expected)
+	}
+
+	// commits made after the commit-graph was written are read from their objects
+	head, _ := repo.Head()
+	side := storeCommit(t, repo, "unmerged", head.Hash())
+	setHead(t, repo, storeCommit(t, repo, "newer than the commit-graph", head.Hash(), side))
+	expected = objectWalkLineageID(t, repo)
+	if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+		t.Errorf(`getLineageIDFromRepo() with a stale commit-graph = %q, %v, was not %q`, id, err, expected)
+	}
+
+	// a corrupt commit-graph is ignored
+	if err := os.WriteFile(filepath.Join(dir, "objects", "info", "commit-graph"), []byte("CGPH\x01\x01\x03\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repoCommitGraph(repo); err == nil {
+		t.Errorf(`repoCommitGraph() of a corrupt commit-graph should fail`)
+	}
+	if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+		t.Errorf(`getLineageIDFromRepo() with a corrupt commit-graph = %q, %v, was not %q`, id, err, expected)
+	}
+}
+
+func TestCommitGraphInMemory(t *testing.T) {
+	repo := syntheticRepository(t, 100)
+	fsys := memfs.New()
+	encodeCommitGraph(t, repo, fsys)
+
+	graph, err := openCommitGraph(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer graph.Close()
+	if graph.count != 100 || graph.layers[0].mapped {
+		t.Errorf(`commit-graph has %d commits, mapped: %v`, graph.count, graph.layers[0].mapped)
+	}
+	head, _ := repo.Head()
+	hash := head.Hash()
+	position, ok := graph.position(hash[:])
+	if !ok {
+		t.Fatalf(`commit-graph does not have the head commit`)
+	}
+	builder, _ := NewLineageBuilder(4)
+	if err := graph.pushFirstParents(position, builder); err != nil {
+		t.Fatal(err)
+	}
+	if expected := objectWalkLineageID(t, repo); builder.String() != expected {
+		t.Errorf(`lineage ID from the commit-graph = %q, was not %q`, builder.String(), expected)
+	}
+	missing := plumbing.NewHash("0123456789012345678901234567890123456789")
+	if _, ok := graph.position(missing[:]); ok {
+		t.Errorf(`position() of a commit that is not in the commit-graph should fail`)
+	}
+}
+
+// TestCommitGraphChain checks split commit-graph chains, which go-git can't write, so it needs git
+func TestCommitGraphChain(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo, dir := commitGraphFixture(t)
+	writeSplit := func() {
+		out, err := exec.Command("git", "-C", dir, "commit-graph", "write", "--reachable", "--split=no-merge").CombinedOutput()
+		if err != nil {
+			t.Fatalf("git commit-graph write: %v\n%s", err, out)
+		}
+	}
+	writeSplit()
+	head, _ := repo.Head()
+	setHead(t, repo, storeCommit(t, repo, "in the second layer", head.Hash()))
+	writeSplit()
+	head, _ = repo.Head()
+	setHead(t, repo, storeCommit(t, repo, "not in the commit-graph", head.Hash()))
+
+	chain, err := os.ReadFile(filepath.Join(dir, "objects", "info", "commit-graphs", "commit-graph-chain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layers := strings.Count(string(chain), "\n"); layers != 2 {
+		t.Fatalf(`commit-graph chain has %d files, expected 2`, layers)
+	}
+
+	expected := objectWalkLineageID(t, repo)
+	if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+		t.Errorf(`getLineageIDFromRepo() with a commit-graph chain = %q, %v, was not %q`, id, err, expected)
+	}
+	graph, err := repoCommitGraph(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer graph.Close()
+	// the 57 commits of the fixture and the one in the second layer
+	if len(graph.layers) != 2 || graph.count != 58 {
+		t.Errorf(`commit-graph chain has %d files and %d commits`, len(graph.layers), graph.count)
+	}
+}
+
+func BenchmarkCommitGraph(b *testing.B) {
+	const commits = 10_000
+	dir := b.TempDir()
+	repo, err := git.PlainInit(dir, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	recordObjectFormat(b, repo)
+	head := storeCommit(b, repo, "commit 0")
+	for i := 1; i < commits; i++ {
+		head = storeCommit(b, repo, "commit "+strconv.Itoa(i), head)
+	}
+	setHead(b, repo, head)
+
+	run := func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			id, err := getLineageIDFromRepo(repo, 4)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(id) != commits {
+				b.Fatalf(`lineage ID has %d commits, expected %d`, len(id), commits)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*commits), "ns/commit")
+	}
+	b.Run("objects", run)
+	out, err := exec.Command("git", "-C", dir, "commit-graph", "write", "--reachable").CombinedOutput()
+	if err != nil {
+		b.Skipf("git commit-graph write: %v\n%s", err, out)
+	}
+	b.Run("commit-graph", run)
+}
+
+func TestFirstCommitTime(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordObjectFormat(t, repo)
+	when := time.Date(2009, 11, 10, 23, 0, 0, 0, time.UTC)
+	root := storeObject(t, repo, &object.Commit{
+		Author:    object.Signature{Name: "test", Email: "test@example.com", When: when},
+		Committer: object.Signature{Name: "test", Email: "test@example.com", When: when},
+		Message:   "root",
+		TreeHash:  storeObject(t, repo, &object.Tree{}),
+	})
+	head := root
+	for i := 0; i < 5; i++ {
+		head = storeCommit(t, repo, "commit "+strconv.Itoa(i), head)
+	}
+	setHead(t, repo, head)
+
+	// from the commit objects, then from the commit-graph
+	for _, withCommitGraph := range []bool{false, true} {
+		if withCommitGraph {
+			encodeCommitGraph(t, repo, repo.Storer.(*filesystem.Storage).Filesystem())
+		}
+		builder, err := lineageFromRepo(repo, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !builder.FirstCommit().Equal(when) {
+			t.Errorf(`first commit with a commit-graph: %v = %v, expected %v`, withCommitGraph, builder.FirstCommit(), when)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+// FamilyOptions is the rule deciding whether two repositories belong to the same family.
+// Two repositories are related when they share at least MinShared commits, or when the commits they share make up
+// at least MinFraction of the shorter of the two histories. Zero disables either condition.
+// Repositories with identical lineage IDs (exact mirrors) are always related.
+// Families are the transitive closure of that relation (single linkage): if a is related to b and b to c,
+// all three are in the same family even if a and c are not related themselves
+type FamilyOptions struct {
+	MinShared   int
+	MinFraction float64
+}
+
+// DefaultFamilyOptions considers repositories related when they share 16 commits, or half of the shorter history.
+// Single commits are not enough: lineage IDs only keep 4 bits per commit, so one in 16 unrelated repositories
+// would share the first one
+var DefaultFamilyOptions = FamilyOptions{MinShared: 16, MinFraction: 0.5}
+
+// Family is a group of related repositories
+type Family struct {
+	// derived from the lineage shared by every member, so it stays the same across runs and machines
+	ID string
+	// the member with the shortest history (i.e. the one the others most likely continued from), ties broken by name
+	Representative string
+	// sorted by name
+	Members []string
+	// the number of commits every member has in common
+	SharedCommits int
+
+	// the node the family was found at, and whether everything below it is part of the family too
+	// (otherwise the family is just the mirrors ending at that node)
+	root    *SimilarityTreeNode
+	subtree bool
+}
+
+// familyIDLength is the number of hex characters of the hash that are used as a family ID
+const familyIDLength = 12
+
+func familyID(sharedLineage string) string {
+	sum := sha256.Sum256([]byte(sharedLineage))
+	return hex.EncodeToString(sum[:])[:familyIDLength]
+}
+
+// related checks a pair of repositories against the rule in the options
+func (opts FamilyOptions) related(shared int, shorter int) bool {
+	if shared == 0 {
+		return false
+	}
+	return (opts.MinShared > 0 && shared >= opts.MinShared) ||
+		(opts.MinFraction > 0 && float64(shared) >= opts.MinFraction*float64(shorter))
+}
+
+// Families groups every source in the tree into families according to opts.
+// The result does not depend on the order sources were added or on map iteration order:
+// families are sorted by size (largest first) and then by representative.
+//
+// For any node at depth L, every pair of sources below it shares at least L commits. The pair that is the easiest
+// to relate through that node always includes the shortest source below it, so if that one is related to the rest
+// of the subtree, the whole subtree is one family. Otherwise the subtrees of the children are checked in the same way
+func (graph *SimilarityTree) Families(opts FamilyOptions) []Family {
+	shortest := graph.shortestSources(graph.Root)
+
+	// the depth of a node is the length of the lineage ID of a source ending there, i.e. its end()
+	families := []Family{}
+	stack := []*SimilarityTreeNode{graph.Root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if shortest[node] < 0 {
+			continue
+		}
+		if node != graph.Root && opts.related(int(node.end()), shortest[node]) {
+			families = append(families, graph.newFamily(graph.SourcesUnder(node), node, true))
+			continue
+		}
+		if sources := graph.SourcesAt(node); len(sources) > 0 {
+			// mirrors always stay together
+			families = append(families, graph.newFamily(sources, node, false))
+		}
+		stack = append(stack, node.Children()...)
+	}
+
+	slices.SortFunc(families, func(a, b Family) int {
+		if len(a.Members) != len(b.Members) {
+			return len(b.Members) - len(a.Members)
+		}
+		return strings.Compare(a.Representative, b.Representative)
+	})
+	return families
+}
+
+// FamilyOf returns the family that a source belongs to.
+// Only the ancestors of the source's node can be the root of its family, so instead of finding every family
+// this goes down from the top of the source's branch and stops at the first ancestor that Families would stop at
+func (graph *SimilarityTree) FamilyOf(source string, opts FamilyOptions) (Family, bool) {
+	leaf, found := graph.Leaves[source]
+	if !found {
+		return Family{}, false
+	}
+	// ending with the root, which never holds a family of its own
+	chain := leaf.parentChain()
+	if len(chain) < 2 {
+		return graph.newFamily(graph.SourcesAt(leaf), leaf, false), true
+	}
+	shortest := graph.shortestSources(chain[len(chain)-2])
+	for i := len(chain) - 2; i >= 0; i-- {
+		if opts.related(int(chain[i].end()), shortest[chain[i]]) {
+			return graph.newFamily(graph.SourcesUnder(chain[i]), chain[i], true), true
+		}
+	}
+	return graph.newFamily(graph.SourcesAt(leaf), leaf, false), true
+}
+
+// shortestSources returns the length of the shortest source at or below node and each of its descendants
+// (-1 where there is none), measured from the bottom up by going through the nodes in reverse pre-order
+func (graph *SimilarityTree) shortestSources(node *SimilarityTreeNode) map[*SimilarityTreeNode]int {
+	preorder := []*SimilarityTreeNode{}
+	stack := []*SimilarityTreeNode{node}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		preorder = append(preorder, n)
+		stack = append(stack, n.Children()...)
+	}
+	shortest := make(map[*SimilarityTreeNode]int, len(preorder))
+	for i := len(preorder) - 1; i >= 0; i-- {
+		n, length := preorder[i], -1
+		if len(graph.SourcesAt(n)) > 0 {
+			length = int(n.end())
+		}
+		for _, child := range n.Children() {
+			if l := shortest[child]; l >= 0 && (length < 0 || l < length) {
+				length = l
+			}
+		}
+		shortest[n] = length
+	}
+	return shortest
+}
+
+// newFamily describes a group of members found at root
+func (graph *SimilarityTree) newFamily(members []string, root *SimilarityTreeNode, subtree bool) Family {
+	shared := graph.Leaves[members[0]]
+	for _, member := range members[1:] {
+		ancestor, err := shared.CommonAncestorWith(graph.Leaves[member])
+		if err == nil {
+			shared = ancestor
+		}
+	}
+	sharedLineage := shared.FullValue()
+	return Family{
+		ID:             familyID(sharedLineage),
+		Representative: slices.MinFunc(members, func(a, b string) int { return compareByLength(graph, a, b) }),
+		Members:        members,
+		SharedCommits:  len(sharedLineage),
+		root:           root,
+		subtree:        subtree,
+	}
+}
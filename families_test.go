@@ -0,0 +1,138 @@
+package main
+
+import (
+	"maps"
+	"math/rand"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+var familyFixture = map[string]string{
+	"upstream":  "0123456789abcdef",
+	"fork":      "0123456789abcdef0011",
+	"old-fork":  "0123456789ab",
+	"mirror":    "0123456789abcdef",
+	"cousin":    "01234567ffff",
+	"unrelated": "fedcba9876543210",
+	"tiny":      "fe",
+}
+
+func familyTree(t *testing.T, order []string) SimilarityTree {
+	graph := NewSimilarityTree()
+	for _, source := range order {
+		if err := graph.Add(source, familyFixture[source]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return graph
+}
+
+func familyMembers(families []Family) [][]string {
+	members := [][]string{}
+	for _, family := range families {
+		members = append(members, family.Members)
+	}
+	return members
+}
+
+func TestFamilies(t *testing.T) {
+	sources := []string{}
+	for source := range familyFixture {
+		sources = append(sources, source)
+	}
+	slices.Sort(sources)
+
+	graph := familyTree(t, sources)
+	families := graph.Families(FamilyOptions{MinShared: 12})
+	expected := [][]string{{"fork", "mirror", "old-fork", "upstream"}, {"cousin"}, {"tiny"}, {"unrelated"}}
+	if m := familyMembers(families); !reflect.DeepEqual(m, expected) {
+		t.Fatalf(`Families() = %v, expected %v`, m, expected)
+	}
+	if f := families[0]; f.Representative != "old-fork" || f.SharedCommits != 12 {
+		t.Errorf(`unexpected family %+v`, f)
+	}
+
+	// cousin shares 8 of its 12 commits, which is enough with a fraction
+	families = graph.Families(FamilyOptions{MinFraction: 0.6})
+	expected = [][]string{{"cousin", "fork", "mirror", "old-fork", "upstream"}, {"tiny", "unrelated"}}
+	if m := familyMembers(families); !reflect.DeepEqual(m, expected) {
+		t.Errorf(`Families() = %v, expected %v`, m, expected)
+	}
+
+	// only histories contained in one another: unrelated has both of the commits of tiny,
+	// and old-fork, upstream and fork each continue the one before
+	families = graph.Families(FamilyOptions{MinFraction: 1})
+	expected = [][]string{{"fork", "mirror", "old-fork", "upstream"}, {"tiny", "unrelated"}, {"cousin"}}
+	if m := familyMembers(families); !reflect.DeepEqual(m, expected) {
+		t.Errorf(`Families() = %v, expected %v`, m, expected)
+	}
+
+	// mirrors are always related, even if nothing else is
+	families = graph.Families(FamilyOptions{})
+	if len(families) != 6 || !slices.Equal(families[0].Members, []string{"mirror", "upstream"}) {
+		t.Errorf(`Families() = %v, expected only the mirrors to be grouped`, familyMembers(families))
+	}
+}
+
+func TestFamiliesAreDeterministic(t *testing.T) {
+	sources := []string{}
+	for source := range familyFixture {
+		sources = append(sources, source)
+	}
+	slices.Sort(sources)
+	first := familyTree(t, sources)
+	expected := first.Families(DefaultFamilyOptions)
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		random.Shuffle(len(sources), func(a, b int) { sources[a], sources[b] = sources[b], sources[a] })
+		graph := familyTree(t, sources)
+		families := graph.Families(DefaultFamilyOptions)
+		for j := range families {
+			// the unexported fields point into different trees
+			families[j].root = nil
+			expected[j].root = nil
+		}
+		if !reflect.DeepEqual(families, expected) {
+			t.Fatalf(`Families() depends on insertion order: %+v != %+v`, families, expected)
+		}
+	}
+}
+
+func TestFamilyOf(t *testing.T) {
+	graph := familyTree(t, []string{"upstream", "fork", "unrelated"})
+	family, found := graph.FamilyOf("fork", DefaultFamilyOptions)
+	if !found || family.Representative != "upstream" || len(family.ID) != familyIDLength {
+		t.Errorf(`FamilyOf() = %+v, %v`, family, found)
+	}
+	if _, found := graph.FamilyOf("missing", DefaultFamilyOptions); found {
+		t.Errorf(`FamilyOf() found a family for an unknown source`)
+	}
+
+	// every source has to end up in the same family as Families() puts it in
+	sources := slices.Sorted(maps.Keys(familyFixture))
+	graph = familyTree(t, sources)
+	for _, opts := range []FamilyOptions{{MinShared: 12}, {MinFraction: 0.6}, DefaultFamilyOptions} {
+		for _, expected := range graph.Families(opts) {
+			for _, source := range expected.Members {
+				if family, found := graph.FamilyOf(source, opts); !found || !reflect.DeepEqual(family, expected) {
+					t.Errorf(`FamilyOf(%q, %+v) = %+v, expected %+v`, source, opts, family, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestNodeFamily(t *testing.T) {
+	graph := familyTree(t, []string{"upstream", "fork", "cousin", "unrelated"})
+	if f := graph.Leaves["fork"].Family(); f != "0123456789abcdef" {
+		t.Errorf(`Family() of fork = %q, expected the end of upstream`, f)
+	}
+	if f := graph.Leaves["cousin"].Family(); f != "01234567" {
+		t.Errorf(`Family() of cousin = %q, expected where it branches off`, f)
+	}
+	if f := graph.Leaves["unrelated"].Family(); f != "orphan" {
+		t.Errorf(`Family() of unrelated = %q, expected %q`, f, "orphan")
+	}
+}
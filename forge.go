@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MoralCode/CodeDNA/utils"
+	"github.com/google/go-github/v69/github"
+)
+
+// normalizeRepoURL makes urls of the same repository comparable:
+// "https://GitHub.com/owner/name.git/" and "https://github.com/owner/name" are the same repository
+func normalizeRepoURL(repourl string) string {
+	repourl = strings.TrimSuffix(strings.TrimSpace(repourl), "/")
+	repourl = strings.TrimSuffix(repourl, ".git")
+	return strings.ToLower(repourl)
+}
+
+// errUnsupportedForge is returned for repositories hosted somewhere metadata cannot be fetched from
+var errUnsupportedForge = errors.New("metadata can only be fetched for repositories hosted on github.com")
+
+// fetchGitHubMetadata looks a repository up with the GitHub REST API
+func fetchGitHubMetadata(ctx context.Context, client *github.Client, repourl string) (utils.RepoMetadata, error) {
+	parsed, err := url.Parse(repourl)
+	if err != nil {
+		return utils.RepoMetadata{}, err
+	}
+	if !strings.EqualFold(parsed.Host, "github.com") && !strings.EqualFold(parsed.Host, "www.github.com") {
+		return utils.RepoMetadata{}, errUnsupportedForge
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) < 2 {
+		return utils.RepoMetadata{}, errors.New("url does not name a repository")
+	}
+	owner, name := parts[0], strings.TrimSuffix(parts[1], ".git")
+
+	repo, _, err := client.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		return utils.RepoMetadata{}, err
+	}
+	metadata := utils.RepoMetadata{
+		Forge:     "github",
+		IsFork:    repo.GetFork(),
+		Parent:    repo.GetParent().GetHTMLURL(),
+		Stars:     repo.GetStargazersCount(),
+		Created:   repo.GetCreatedAt().Time,
+		Pushed:    repo.GetPushedAt().Time,
+		FetchedAt: time.Now(),
+	}
+	return metadata, nil
+}
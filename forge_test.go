@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/v69/github"
+)
+
+func TestNormalizeRepoURL(t *testing.T) {
+	if a, b := normalizeRepoURL("https://GitHub.com/owner/name.git/"), normalizeRepoURL("https://github.com/owner/name"); a != b {
+		t.Errorf(`normalizeRepoURL() = %q and %q, expected them to be the same`, a, b)
+	}
+}
+
+func TestFetchGitHubMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/someone/project" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"full_name": "someone/project",
+			"fork": true,
+			"parent": {"html_url": "https://github.com/original/project"},
+			"stargazers_count": 42,
+			"created_at": "2015-01-02T03:04:05Z",
+			"pushed_at": "2024-01-02T03:04:05Z"
+		}`))
+	}))
+	defer server.Close()
+
+	client := github.NewClient(server.Client())
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	m, err := fetchGitHubMetadata(context.Background(), client, "https://github.com/someone/project.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsFork || m.Parent != "https://github.com/original/project" || m.Stars != 42 || m.Created.Year() != 2015 || m.Pushed.Year() != 2024 {
+		t.Errorf(`unexpected metadata %+v`, m)
+	}
+
+	if _, err := fetchGitHubMetadata(context.Background(), client, "https://gitlab.com/someone/project"); err != errUnsupportedForge {
+		t.Errorf(`expected repositories on other forges to be unsupported, got %v`, err)
+	}
+}
@@ -6,17 +6,74 @@ import (
 	"errors"
 	"fmt"
 	"math/bits"
+	"strings"
+	"time"
 )
 
 type LineageIdentifier string
 
-// 160 bit or 20 byte hash (40 hex digits)
-type CommitHash [20]byte
+// HashAlgorithm is the object format of a repository, which decides how long its commit hashes are
+type HashAlgorithm uint8
+
+const (
+	HashSHA1 HashAlgorithm = iota
+	HashSHA256
+)
+
+// ErrHashAlgorithmMismatch is returned when commits or lineage IDs using different hash algorithms are mixed.
+// The same history hashes to unrelated values in each of them, so they would only ever share commits by chance
+var ErrHashAlgorithmMismatch = errors.New("lineage IDs with different hash algorithms can't be compared")
+
+// String returns the name git uses for the algorithm in extensions.objectFormat
+func (algorithm HashAlgorithm) String() string {
+	if algorithm == HashSHA256 {
+		return "sha256"
+	}
+	return "sha1"
+}
+
+// Size returns the length of a hash in bytes
+func (algorithm HashAlgorithm) Size() int {
+	if algorithm == HashSHA256 {
+		return 32
+	}
+	return 20
+}
+
+func hashAlgorithmOfSize(size int) (HashAlgorithm, error) {
+	switch size {
+	case 20:
+		return HashSHA1, nil
+	case 32:
+		return HashSHA256, nil
+	}
+	return 0, fmt.Errorf("a %d byte hash is neither SHA-1 nor SHA-256", size)
+}
+
+// parseHashAlgorithm parses the extensions.objectFormat of a repository, which is empty for SHA-1 repositories
+func parseHashAlgorithm(name string) (HashAlgorithm, error) {
+	switch strings.ToLower(name) {
+	case "", "sha1":
+		return HashSHA1, nil
+	case "sha256":
+		return HashSHA256, nil
+	}
+	return 0, fmt.Errorf("unsupported object format %q", name)
+}
+
+// 160 bit or 20 byte hash (40 hex digits) for SHA-1 repositories, 256 bit or 32 byte hash (64 hex digits) for SHA-256 ones
+type CommitHash []byte
+
+func (hash CommitHash) Algorithm() (HashAlgorithm, error) {
+	return hashAlgorithmOfSize(len(hash))
+}
 
 type LineageID struct {
 	idData []byte
 	// the number of bits used from the start of each commit
 	prefixLength uint8
+	// the hash algorithm of the commits
+	algorithm HashAlgorithm
 }
 
 // https://stackoverflow.com/a/10030772/
@@ -90,14 +147,27 @@ func AssembleBytesFromNibbles(nibbles []uint8) ([]byte, error) {
 	return bytes, nil
 }
 
-func LineageIDFromHashes(commit_hashes []CommitHash, prefixLength uint8) *LineageID {
+// LineageIDFromHashes computes the lineage ID of a list of commits that is already in memory, newest commit first.
+// Every commit has to use the same hash algorithm. Use a LineageBuilder to avoid collecting the list in the first place
+func LineageIDFromHashes(commit_hashes []CommitHash, prefixLength uint8) (*LineageID, error) {
+	if prefixLength == 0 || prefixLength > 4 {
+		return nil, fmt.Errorf("prefix length must be between 1 and 4 bits, not %d", prefixLength)
+	}
 	lineageID := []byte{}
 
-	if prefixLength > 8 {
-		fmt.Errorf("prefix lengths > 8 are not yet supported")
+	var algorithm HashAlgorithm
+	if len(commit_hashes) > 0 {
+		var err error
+		algorithm, err = commit_hashes[0].Algorithm()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	for _, commithash := range commit_hashes {
+	for i, commithash := range commit_hashes {
+		if len(commithash) != algorithm.Size() {
+			return nil, fmt.Errorf("commit %d has a %d byte hash but the first one is %s: %w", i, len(commithash), algorithm, ErrHashAlgorithmMismatch)
+		}
 		firstbyte := commithash[0]
 		prefix := firstbyte >> (8 - prefixLength)
 		lineageID = append(lineageID, prefix)
@@ -105,7 +175,157 @@ func LineageIDFromHashes(commit_hashes []CommitHash, prefixLength uint8) *Lineag
 	return &LineageID{
 		idData:       ReverseBytes(lineageID),
 		prefixLength: prefixLength,
+		algorithm:    algorithm,
+	}, nil
+}
+
+// LineageBuilder builds a lineage ID one commit at a time, so that the history of a repository never has to be held
+// in memory: only the prefix of each hash is kept, packed two to a byte. Commits are pushed newest first, which is the
+// order that git log and the forge APIs list them in, and the lineage ID starts with the oldest commit
+type LineageBuilder struct {
+	// the prefixes in the order they were pushed, the first one of each byte in its high half
+	packed []byte
+	count  int
+	// the number of bits used from the start of each commit
+	prefixLength uint8
+	// the hash algorithm of the commits, known once the first one is pushed
+	algorithm HashAlgorithm
+	// the commit time of the root commit, known once it is pushed (see SetFirstCommit)
+	firstCommit time.Time
+}
+
+// NewLineageBuilder returns a builder that keeps the first prefixLength bits of every commit hash.
+// Every prefix is written as one hex digit, so prefixes longer than 4 bits are not supported
+func NewLineageBuilder(prefixLength uint8) (*LineageBuilder, error) {
+	if prefixLength == 0 || prefixLength > 4 {
+		return nil, fmt.Errorf("prefix length must be between 1 and 4 bits, not %d", prefixLength)
 	}
+	return &LineageBuilder{prefixLength: prefixLength}, nil
+}
+
+func (builder *LineageBuilder) pushPrefix(firstByte byte) {
+	prefix := firstByte >> (8 - builder.prefixLength)
+	if builder.count%2 == 0 {
+		builder.packed = append(builder.packed, prefix<<4)
+	} else {
+		builder.packed[len(builder.packed)-1] |= prefix
+	}
+	builder.count++
+}
+
+func (builder *LineageBuilder) setAlgorithm(algorithm HashAlgorithm) error {
+	if builder.count > 0 && algorithm != builder.algorithm {
+		return ErrHashAlgorithmMismatch
+	}
+	builder.algorithm = algorithm
+	return nil
+}
+
+// Push adds the next (older) commit to the lineage ID. Every commit has to use the same hash algorithm
+func (builder *LineageBuilder) Push(hash CommitHash) error {
+	algorithm, err := hash.Algorithm()
+	if err != nil {
+		return err
+	}
+	if err := builder.setAlgorithm(algorithm); err != nil {
+		return err
+	}
+	builder.pushPrefix(hash[0])
+	return nil
+}
+
+// PushHex adds the next (older) commit to the lineage ID given its hash as hex, as the forge APIs return it.
+// Only as much of the hash as the prefix needs is decoded
+func (builder *LineageBuilder) PushHex(hash string) error {
+	if len(hash)%2 != 0 {
+		return fmt.Errorf("invalid commit hash %q", hash)
+	}
+	algorithm, err := hashAlgorithmOfSize(len(hash) / 2)
+	if err != nil {
+		return fmt.Errorf("invalid commit hash %q: %w", hash, err)
+	}
+	firstByte, err := hex.DecodeString(hash[:2])
+	if err != nil {
+		return fmt.Errorf("invalid commit hash %q: %w", hash, err)
+	}
+	if err := builder.setAlgorithm(algorithm); err != nil {
+		return err
+	}
+	builder.pushPrefix(firstByte[0])
+	return nil
+}
+
+// SetFirstCommit records the commit time of the root commit, the one without parents that is pushed last.
+// Walkers call it when they reach that commit, since only they know when a commit has no parents
+func (builder *LineageBuilder) SetFirstCommit(when time.Time) {
+	builder.firstCommit = when
+}
+
+// FirstCommit returns the commit time of the root commit, or the zero time if the walker did not know it
+func (builder *LineageBuilder) FirstCommit() time.Time {
+	return builder.firstCommit
+}
+
+// Algorithm returns the hash algorithm of the commits pushed so far
+func (builder *LineageBuilder) Algorithm() HashAlgorithm {
+	return builder.algorithm
+}
+
+// pushed returns the prefix of the i-th commit pushed
+func (builder *LineageBuilder) pushed(i int) byte {
+	b := builder.packed[i/2]
+	if i%2 == 0 {
+		b >>= 4
+	}
+	return b & 0xf
+}
+
+// Len returns the number of commits pushed so far
+func (builder *LineageBuilder) Len() int {
+	return builder.count
+}
+
+// String returns the lineage ID of the commits pushed so far as hex, oldest commit first
+func (builder *LineageBuilder) String() string {
+	id := make([]byte, builder.count)
+	for i := 0; i < builder.count; i++ {
+		id[builder.count-1-i] = hexDigits[builder.pushed(i)]
+	}
+	return string(id)
+}
+
+// LineageID returns the lineage ID of the commits pushed so far
+func (builder *LineageBuilder) LineageID() *LineageID {
+	idData := make([]byte, builder.count)
+	for i := 0; i < builder.count; i++ {
+		idData[builder.count-1-i] = builder.pushed(i)
+	}
+	return &LineageID{
+		idData:       idData,
+		prefixLength: builder.prefixLength,
+		algorithm:    builder.algorithm,
+	}
+}
+
+// ParseLineageID parses a lineage ID from the hex form it is cached in, given the prefix length
+// and hash algorithm it was computed with
+func ParseLineageID(hexID string, prefixLength uint8, algorithm HashAlgorithm) (*LineageID, error) {
+	if prefixLength == 0 || prefixLength > 4 {
+		return nil, fmt.Errorf("prefix length must be between 1 and 4 bits, not %d", prefixLength)
+	}
+	idData := make([]byte, len(hexID))
+	for i := 0; i < len(hexID); i++ {
+		prefix := strings.IndexByte(hexDigits, hexID[i]|0x20)
+		if prefix < 0 || prefix >= 1<<prefixLength {
+			return nil, fmt.Errorf("invalid lineage ID %q: %q is not a %d bit prefix", hexID, hexID[i], prefixLength)
+		}
+		idData[i] = byte(prefix)
+	}
+	return &LineageID{
+		idData:       idData,
+		prefixLength: prefixLength,
+		algorithm:    algorithm,
+	}, nil
 }
 
 func (lineageID *LineageID) String() string {
@@ -130,6 +350,11 @@ func (lineageID *LineageID) StringB64() string {
 	return base64.StdEncoding.EncodeToString(lineageID.idData)
 }
 
+// Algorithm returns the hash algorithm of the repository the lineage ID belongs to
+func (lineageID *LineageID) Algorithm() HashAlgorithm {
+	return lineageID.algorithm
+}
+
 func (lineageID *LineageID) Bytes() []byte {
 	return lineageID.idData
 }
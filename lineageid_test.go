@@ -3,7 +3,16 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
 )
 
 func hashesFromStrings(hashes []string) []CommitHash {
@@ -30,10 +39,20 @@ func TestFromHashes(t *testing.T) {
 	}
 	hashdata := hashesFromStrings(hashes)
 
-	id := LineageIDFromHashes(hashdata, 4)
+	id, err := LineageIDFromHashes(hashdata, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if id.StringHex() != "9ee37c" {
 		t.Errorf(`LineageIDFromHashes() = %q, was not %q`, id.StringHex(), "9ee37c")
 	}
+
+	// every prefix is one hex digit
+	for _, prefixLength := range []uint8{0, 5, 8} {
+		if _, err := LineageIDFromHashes(hashdata, prefixLength); err == nil {
+			t.Errorf(`LineageIDFromHashes() with a prefix length of %d should fail`, prefixLength)
+		}
+	}
 }
 
 func TestFromOddHashes(t *testing.T) {
@@ -48,7 +67,10 @@ func TestFromOddHashes(t *testing.T) {
 	}
 	hashdata := hashesFromStrings(hashes)
 
-	id := LineageIDFromHashes(hashdata, 4)
+	id, err := LineageIDFromHashes(hashdata, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if id.StringHex() != "e9ee37c" {
 		t.Errorf(`LineageIDFromHashes() = %q, was not %q`, id.StringHex(), "e9ee37c")
 	}
@@ -85,3 +107,203 @@ func TestReverseNibbles(t *testing.T) {
 	}
 
 }
+
+func TestLineageBuilder(t *testing.T) {
+	hashes := []string{
+		"c157c5bb882fffe4932853ee413a36af63c337d9",
+		"75288f635132b98b366e6993be945f3c9ddf8f05",
+		"3cafb499963675d22f44007c91b906e77d45dfb5",
+		"e48d65529880ebd2d061c8bfa13e78b74c411204",
+		"e3a4055fb9d8afe217d73591bfb2724662fa86fc",
+		"94e7ba5ba88de06ad0943bcb6facf12f9a9c2eee",
+		"e48d65529880ebd2d061c8bfa13e78b74c411204",
+	}
+	hashdata := hashesFromStrings(hashes)
+
+	for _, prefixLength := range []uint8{1, 2, 3, 4} {
+		for n := 0; n <= len(hashes); n++ {
+			builder, err := NewLineageBuilder(prefixLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromHex, _ := NewLineageBuilder(prefixLength)
+			for i := 0; i < n; i++ {
+				if err := builder.Push(hashdata[i]); err != nil {
+					t.Fatal(err)
+				}
+				if err := fromHex.PushHex(hashes[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fromHashes, err := LineageIDFromHashes(hashdata[:n], prefixLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := fromHashes.StringHex()
+			if builder.Len() != n || builder.String() != expected {
+				t.Errorf(`LineageBuilder of %d commits = %q, was not %q`, n, builder.String(), expected)
+			}
+			if id := builder.LineageID().StringHex(); id != expected {
+				t.Errorf(`LineageBuilder.LineageID() of %d commits = %q, was not %q`, n, id, expected)
+			}
+			if fromHex.String() != expected {
+				t.Errorf(`LineageBuilder.PushHex() of %d commits = %q, was not %q`, n, fromHex.String(), expected)
+			}
+		}
+	}
+
+	if _, err := NewLineageBuilder(0); err == nil {
+		t.Errorf(`NewLineageBuilder(0) should fail`)
+	}
+	if _, err := NewLineageBuilder(5); err == nil {
+		t.Errorf(`NewLineageBuilder(5) should fail`)
+	}
+	builder, _ := NewLineageBuilder(4)
+	for _, hash := range []string{"", "c", "zz57c5bb"} {
+		if err := builder.PushHex(hash); err == nil {
+			t.Errorf(`PushHex(%q) should fail`, hash)
+		}
+	}
+	if builder.Len() != 0 {
+		t.Errorf(`failed pushes were counted`)
+	}
+}
+
+// syntheticHistory calls push with n pseudo-random commit hashes, as if a repository with n commits was being walked
+func syntheticHistory(b *testing.B, n int, push func(CommitHash) error) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		hash := make(CommitHash, HashSHA1.Size())
+		random.Read(hash)
+		if err := push(hash); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLineageID compares collecting every hash before computing the lineage ID with streaming them
+// into a LineageBuilder, on a history the size of the Linux kernel's
+func BenchmarkLineageID(b *testing.B) {
+	const commits = 1_300_000
+	var before, after runtime.MemStats
+	measure := func(b *testing.B, retained any) {
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/commits, "heap-bytes/commit")
+		runtime.KeepAlive(retained)
+	}
+
+	b.Run("collect", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			var commit_hashes []CommitHash
+			syntheticHistory(b, commits, func(hash CommitHash) error {
+				commit_hashes = append(commit_hashes, hash)
+				return nil
+			})
+			b.StopTimer()
+			measure(b, commit_hashes)
+			b.StartTimer()
+			id, err := LineageIDFromHashes(commit_hashes, 4)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = id.String()
+		}
+	})
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			builder, _ := NewLineageBuilder(4)
+			syntheticHistory(b, commits, builder.Push)
+			b.StopTimer()
+			measure(b, builder)
+			b.StartTimer()
+			_ = builder.String()
+		}
+	})
+}
+
+// storeObject writes an object to the object storage of a repository
+func storeObject(tb testing.TB, repo *git.Repository, o object.Object) plumbing.Hash {
+	obj := repo.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		tb.Fatal(err)
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return hash
+}
+
+// storeCommit writes an empty commit to a repository without touching any references.
+// Commits are only told apart by their message and parents
+func storeCommit(tb testing.TB, repo *git.Repository, message string, parents ...plumbing.Hash) plumbing.Hash {
+	signature := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)}
+	return storeObject(tb, repo, &object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      message,
+		TreeHash:     storeObject(tb, repo, &object.Tree{}),
+		ParentHashes: parents,
+	})
+}
+
+// setHead points the master branch (and with it HEAD) of a repository at a commit
+func setHead(tb testing.TB, repo *git.Repository, commit plumbing.Hash) {
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/master", commit)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/master")); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// recordObjectFormat sets the object format of a repository created by go-git to the one go-git was built for.
+// go-git doesn't record it by default, even though it writes SHA-256 objects when built with the sha256 tag
+func recordObjectFormat(tb testing.TB, repo *git.Repository) {
+	if err := setRepoHashAlgorithm(repo, compiledHashAlgorithm); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// syntheticRepository creates an in-memory repository with a linear history of n empty commits
+func syntheticRepository(tb testing.TB, n int) *git.Repository {
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	recordObjectFormat(tb, repo)
+	var head plumbing.Hash
+	for i := 0; i < n; i++ {
+		if head.IsZero() {
+			head = storeCommit(tb, repo, "commit "+strconv.Itoa(i))
+		} else {
+			head = storeCommit(tb, repo, "commit "+strconv.Itoa(i), head)
+		}
+	}
+	setHead(tb, repo, head)
+	return repo
+}
+
+func BenchmarkLineageIDFromRepo(b *testing.B) {
+	const commits = 50_000
+	repo := syntheticRepository(b, commits)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id, err := getLineageIDFromRepo(repo, 4)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(id) != commits {
+			b.Fatalf(`lineage ID has %d commits, expected %d`, len(id), commits)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*commits), "ns/commit")
+}
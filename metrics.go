@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+// SimilarityMetric selects how the relationship between two lineage IDs is turned into a single number.
+// All of them are derived from three lengths: the number of commits in A, in B, and in their shared prefix
+type SimilarityMetric string
+
+const (
+	// shared / max(len(A), len(B)): the fraction of the longer history that both repositories have.
+	// 1 for identical histories, 0 for unrelated ones
+	MetricSharedFraction SimilarityMetric = "shared-fraction"
+	// shared / (len(A) + len(B) - shared): the commits both repositories have out of all the commits either one has.
+	// 1 for identical histories, 0 for unrelated ones
+	MetricJaccard SimilarityMetric = "jaccard"
+	// shared / len(A): how much of the history of A is also part of B.
+	// 1 when A is contained in B (A is a mirror of B or B continued from A), 0 for unrelated ones
+	MetricContainment SimilarityMetric = "containment"
+	// (unique to A + unique to B) / (len(A) + len(B)): the proportion of commits that are not shared.
+	// 0 for identical histories, 1 for unrelated ones
+	MetricDivergence SimilarityMetric = "divergence"
+	// unique to A + unique to B: the raw number of commits since the histories diverged, as used by SimilarityScore.
+	// Not normalized, so it favors small repositories over large forks that share most of their history
+	MetricDistance SimilarityMetric = "distance"
+)
+
+var SimilarityMetrics = []SimilarityMetric{MetricSharedFraction, MetricJaccard, MetricContainment, MetricDivergence, MetricDistance}
+
+// LowerIsCloser reports whether smaller values of the metric mean more closely related repositories
+func (metric SimilarityMetric) LowerIsCloser() bool {
+	return metric == MetricDivergence || metric == MetricDistance
+}
+
+// LineageComparison holds the lengths that every similarity metric is computed from
+type LineageComparison struct {
+	LengthA int
+	LengthB int
+	Shared  int
+}
+
+// CompareLineages compares two lineage IDs directly, without needing a tree
+func CompareLineages(a string, b string) LineageComparison {
+	return LineageComparison{
+		LengthA: len(a),
+		LengthB: len(b),
+		Shared:  len(utils.GetLongestPrefix(a, b)),
+	}
+}
+
+// Compare compares two lineage IDs, which have to use the same hash algorithm
+func (lineageID *LineageID) Compare(other *LineageID) (LineageComparison, error) {
+	if lineageID.algorithm != other.algorithm {
+		return LineageComparison{}, ErrHashAlgorithmMismatch
+	}
+	return CompareLineages(lineageID.StringHex(), other.StringHex()), nil
+}
+
+// Compare two sources that are part of the tree.
+// The shared prefix of two leaves is the full value of their closest common ancestor
+func (graph *SimilarityTree) Compare(sourceA string, sourceB string) (LineageComparison, error) {
+	leafA, hasA := graph.Leaves[sourceA]
+	leafB, hasB := graph.Leaves[sourceB]
+	if !hasA || !hasB {
+		return LineageComparison{}, errors.New("source is not part of the tree")
+	}
+	ancestor, err := leafA.CommonAncestorWith(leafB)
+	if err != nil {
+		return LineageComparison{}, err
+	}
+	return LineageComparison{
+		LengthA: int(leafA.end()),
+		LengthB: int(leafB.end()),
+		Shared:  int(ancestor.end()),
+	}, nil
+}
+
+// SourcePair is a comparison of two sources in the tree
+type SourcePair struct {
+	A string
+	B string
+	LineageComparison
+}
+
+// RelatedPairs compares every pair of sources in the tree that share any history, with A sorted before B.
+// Two sources share exactly the full value of their closest common ancestor, so every pair is found in a single walk
+// up the tree: at each node, the sources ending there and the sources below each of its children are paired up with
+// each other, which is the same as what Compare would find for each of those pairs
+func (graph *SimilarityTree) RelatedPairs() []SourcePair {
+	type below struct {
+		source string
+		length int
+	}
+	preorder := []*SimilarityTreeNode{}
+	stack := []*SimilarityTreeNode{graph.Root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = append(stack[:len(stack)-1], node.kids...)
+		preorder = append(preorder, node)
+	}
+
+	pairs := []SourcePair{}
+	pair := func(a below, b below, shared int) {
+		if a.source > b.source {
+			a, b = b, a
+		}
+		pairs = append(pairs, SourcePair{a.source, b.source, LineageComparison{LengthA: a.length, LengthB: b.length, Shared: shared}})
+	}
+	// the sources at or below each node whose parent hasn't been reached yet, going bottom up
+	sourcesBelow := map[*SimilarityTreeNode][]below{}
+	for i := len(preorder) - 1; i >= 0; i-- {
+		node := preorder[i]
+		shared := int(node.end())
+		groups := [][]below{{}}
+		for _, source := range graph.SourcesAt(node) {
+			groups[0] = append(groups[0], below{source, shared})
+		}
+		for _, child := range node.kids {
+			groups = append(groups, sourcesBelow[child])
+			delete(sourcesBelow, child)
+		}
+
+		all := []below{}
+		for g, group := range groups {
+			if shared > 0 {
+				// mirrors ending at this node share all of it
+				for j, a := range group {
+					if g == 0 {
+						for _, b := range group[j+1:] {
+							pair(a, b, shared)
+						}
+					}
+					for _, other := range groups[g+1:] {
+						for _, b := range other {
+							pair(a, b, shared)
+						}
+					}
+				}
+			}
+			all = append(all, group...)
+		}
+		sourcesBelow[node] = all
+	}
+
+	slices.SortFunc(pairs, func(a, b SourcePair) int {
+		if c := strings.Compare(a.A, b.A); c != 0 {
+			return c
+		}
+		return strings.Compare(a.B, b.B)
+	})
+	return pairs
+}
+
+// Swap returns the comparison of B with A, for asymmetric metrics like containment
+func (pair SourcePair) Swap() SourcePair {
+	return SourcePair{pair.B, pair.A, LineageComparison{LengthA: pair.LengthB, LengthB: pair.LengthA, Shared: pair.Shared}}
+}
+
+func (c LineageComparison) UniqueToA() int {
+	return c.LengthA - c.Shared
+}
+
+func (c LineageComparison) UniqueToB() int {
+	return c.LengthB - c.Shared
+}
+
+// ratio avoids dividing by zero when comparing empty lineages, which share nothing
+func ratio(numerator int, denominator int) float64 {
+	if denominator == 0 {
+		return 0
+	}
+	return float64(numerator) / float64(denominator)
+}
+
+func (c LineageComparison) SharedFraction() float64 {
+	return ratio(c.Shared, max(c.LengthA, c.LengthB))
+}
+
+func (c LineageComparison) Jaccard() float64 {
+	return ratio(c.Shared, c.LengthA+c.LengthB-c.Shared)
+}
+
+// Containment of A in B. Swap the arguments of the comparison for the containment of B in A
+func (c LineageComparison) Containment() float64 {
+	return ratio(c.Shared, c.LengthA)
+}
+
+func (c LineageComparison) Divergence() float64 {
+	return ratio(c.UniqueToA()+c.UniqueToB(), c.LengthA+c.LengthB)
+}
+
+func (c LineageComparison) Distance() int {
+	return c.UniqueToA() + c.UniqueToB()
+}
+
+// Metric returns the value of the given metric for this comparison
+func (c LineageComparison) Metric(metric SimilarityMetric) (float64, error) {
+	switch metric {
+	case MetricSharedFraction:
+		return c.SharedFraction(), nil
+	case MetricJaccard:
+		return c.Jaccard(), nil
+	case MetricContainment:
+		return c.Containment(), nil
+	case MetricDivergence:
+		return c.Divergence(), nil
+	case MetricDistance:
+		return float64(c.Distance()), nil
+	}
+	return 0, fmt.Errorf("unknown similarity metric %q", metric)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSimilarityMetrics(t *testing.T) {
+	fixtures := []struct {
+		name     string
+		a, b     string
+		expected map[SimilarityMetric]float64
+	}{
+		{"identical", "0123456789", "0123456789", map[SimilarityMetric]float64{
+			MetricSharedFraction: 1, MetricJaccard: 1, MetricContainment: 1, MetricDivergence: 0, MetricDistance: 0,
+		}},
+		{"unrelated", "0123", "fedc", map[SimilarityMetric]float64{
+			MetricSharedFraction: 0, MetricJaccard: 0, MetricContainment: 0, MetricDivergence: 1, MetricDistance: 8,
+		}},
+		{"a contained in b", "0123", "01234567", map[SimilarityMetric]float64{
+			MetricSharedFraction: 0.5, MetricJaccard: 0.5, MetricContainment: 1, MetricDivergence: 1.0 / 3, MetricDistance: 4,
+		}},
+		{"b contained in a", "01234567", "0123", map[SimilarityMetric]float64{
+			MetricSharedFraction: 0.5, MetricJaccard: 0.5, MetricContainment: 0.5, MetricDivergence: 1.0 / 3, MetricDistance: 4,
+		}},
+		{"forked", "0123456789", "01234567ab", map[SimilarityMetric]float64{
+			MetricSharedFraction: 0.8, MetricJaccard: 8.0 / 12, MetricContainment: 0.8, MetricDivergence: 0.2, MetricDistance: 4,
+		}},
+		{"empty", "", "", map[SimilarityMetric]float64{
+			MetricSharedFraction: 0, MetricJaccard: 0, MetricContainment: 0, MetricDivergence: 0, MetricDistance: 0,
+		}},
+	}
+
+	for _, fixture := range fixtures {
+		comparison := CompareLineages(fixture.a, fixture.b)
+		for _, metric := range SimilarityMetrics {
+			value, err := comparison.Metric(metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fixture.expected[metric]; math.Abs(value-want) > 1e-9 {
+				t.Errorf(`%s: %s = %v, expected %v`, fixture.name, metric, value, want)
+			}
+		}
+	}
+
+	// two large forks should be closer than two tiny unrelated repositories, which raw distance gets wrong
+	large := CompareLineages("0123456789abcdef0123456789abcdef01", "0123456789abcdef0123456789abcdef10")
+	tiny := CompareLineages("0", "f")
+	if large.Distance() <= tiny.Distance() {
+		t.Errorf(`expected raw distance to favor the tiny repositories`)
+	}
+	if large.Jaccard() <= tiny.Jaccard() || large.Divergence() >= tiny.Divergence() {
+		t.Errorf(`normalized metrics should favor the large forks`)
+	}
+
+	if _, err := CompareLineages("0", "0").Metric("nonsense"); err == nil {
+		t.Errorf(`Metric() should fail for an unknown metric`)
+	}
+}
+
+func TestTreeCompare(t *testing.T) {
+	graph := NewSimilarityTree()
+	ids := map[string]string{"a": "0123456789", "b": "01234567ab", "c": "0123", "d": "fedc"}
+	for _, source := range []string{"a", "b", "c", "d"} {
+		graph.Add(source, ids[source])
+	}
+	for a := range ids {
+		for b := range ids {
+			comparison, err := graph.Compare(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := CompareLineages(ids[a], ids[b]); comparison != expected {
+				t.Errorf(`Compare(%q, %q) = %+v, expected %+v`, a, b, comparison, expected)
+			}
+		}
+	}
+}
+
+func TestRelatedPairs(t *testing.T) {
+	ids := map[string]string{
+		"a":      "0123456789",
+		"b":      "01234567ab",
+		"c":      "0123",
+		"d":      "fedc",
+		"e":      "fe",
+		"f":      "7",
+		"mirror": "0123456789",
+	}
+	graph, err := BuildSimilarityTree(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every pair that shares anything, compared directly
+	expected := []SourcePair{}
+	for a := range ids {
+		for b := range ids {
+			if comparison := CompareLineages(ids[a], ids[b]); a < b && comparison.Shared > 0 {
+				expected = append(expected, SourcePair{a, b, comparison})
+			}
+		}
+	}
+	slices.SortFunc(expected, func(a, b SourcePair) int { return strings.Compare(a.A+"\x00"+a.B, b.A+"\x00"+b.B) })
+
+	if pairs := graph.RelatedPairs(); !slices.Equal(pairs, expected) {
+		t.Errorf(`RelatedPairs() = %+v, expected %+v`, pairs, expected)
+	}
+	if swapped := (SourcePair{"c", "a", CompareLineages(ids["c"], ids["a"])}).Swap(); swapped != (SourcePair{"a", "c", CompareLineages(ids["a"], ids["c"])}) {
+		t.Errorf(`Swap() = %+v`, swapped)
+	}
+}
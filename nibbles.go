@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// nibbles is a view of a run of 4 bit values (the hex digits of a lineage ID), packed two to a byte with the
+// first one in the high half, the same way AssembleBytesFromNibbles packs them.
+// Views into the same lineage ID share its bytes, so splitting a tree node does not copy anything.
+// Within the tree, a node's view starts at the same offset as its depth, so the parity of the two
+// always matches and comparing a label to the rest of a lineage ID can be done a byte at a time
+type nibbles struct {
+	data []byte
+	// the nibble offsets of the view into data
+	start, end uint32
+}
+
+// hexValues maps every byte to the value of the hex digit it is, or 0xff if it isn't one
+var hexValues = func() (values [256]byte) {
+	for i := range values {
+		values[i] = 0xff
+	}
+	for i := 0; i < 16; i++ {
+		values[hexDigits[i]] = byte(i)
+		values[strings.ToUpper(hexDigits)[i]] = byte(i)
+	}
+	return values
+}()
+
+func hexValue(c byte) (byte, bool) {
+	v := hexValues[c]
+	return v, v != 0xff
+}
+
+// parseNibbles packs a hex string (such as a lineage ID)
+func parseNibbles(value string) (nibbles, error) {
+	data := make([]byte, (len(value)+1)/2)
+	for i := 0; i+1 < len(value); i += 2 {
+		high, low := hexValues[value[i]], hexValues[value[i+1]]
+		// valid digits never have the high half set
+		if high|low > 0xf {
+			return nibbles{}, fmt.Errorf("%q is not a hex value", value)
+		}
+		data[i/2] = high<<4 | low
+	}
+	if len(value)%2 == 1 {
+		high := hexValues[value[len(value)-1]]
+		if high == 0xff {
+			return nibbles{}, fmt.Errorf("%q is not a hex value", value)
+		}
+		data[len(data)-1] = high << 4
+	}
+	return nibbles{data: data, end: uint32(len(value))}, nil
+}
+
+// mustParseNibbles is parseNibbles for values that are known to be valid hex
+func mustParseNibbles(value string) nibbles {
+	n, err := parseNibbles(value)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func (n nibbles) Len() int {
+	return int(n.end - n.start)
+}
+
+// At returns the i-th nibble of the view
+func (n nibbles) At(i int) byte {
+	offset := n.start + uint32(i)
+	b := n.data[offset/2]
+	if offset%2 == 0 {
+		return b >> 4
+	}
+	return b & 0xf
+}
+
+// Slice returns the view of nibbles [from, to) of this view, sharing its bytes
+func (n nibbles) Slice(from int, to int) nibbles {
+	return nibbles{data: n.data, start: n.start + uint32(from), end: n.start + uint32(to)}
+}
+
+func (n nibbles) String() string {
+	buf := make([]byte, n.Len())
+	n.putHex(buf)
+	return string(buf)
+}
+
+// putHex writes the view as hex to the start of dst, which has to be long enough to hold it
+func (n nibbles) putHex(dst []byte) {
+	for i := 0; i < n.Len(); i++ {
+		dst[i] = hexDigits[n.At(i)]
+	}
+}
+
+// aligned returns the view with its own bytes, starting at an offset with the given parity (0 or 1)
+func (n nibbles) aligned(parity uint32) nibbles {
+	length := uint32(n.Len())
+	out := nibbles{data: make([]byte, (parity+length+1)/2), start: parity, end: parity + length}
+	for i := uint32(0); i < length; i++ {
+		offset := parity + i
+		if offset%2 == 0 {
+			out.data[offset/2] |= n.At(int(i)) << 4
+		} else {
+			out.data[offset/2] |= n.At(int(i))
+		}
+	}
+	return out
+}
+
+// concat returns a new view holding a followed by b, with the same parity as a
+func concat(a nibbles, b nibbles) nibbles {
+	out := nibbles{data: make([]byte, (a.start%2+uint32(a.Len()+b.Len())+1)/2), start: a.start % 2}
+	out.end = out.start + uint32(a.Len()+b.Len())
+	for i := 0; i < a.Len()+b.Len(); i++ {
+		var v byte
+		if i < a.Len() {
+			v = a.At(i)
+		} else {
+			v = b.At(i - a.Len())
+		}
+		offset := out.start + uint32(i)
+		if offset%2 == 0 {
+			out.data[offset/2] |= v << 4
+		} else {
+			out.data[offset/2] |= v
+		}
+	}
+	return out
+}
+
+// commonPrefixLength returns the number of leading nibbles a and b have in common
+func commonPrefixLength(a nibbles, b nibbles) int {
+	limit := min(a.Len(), b.Len())
+	i := 0
+	if a.start%2 == b.start%2 {
+		// same parity: after an odd leading nibble the views line up on whole bytes
+		if a.start%2 == 1 && limit > 0 {
+			if a.At(0) != b.At(0) {
+				return 0
+			}
+			i = 1
+		}
+		byteA, byteB := (a.start+uint32(i))/2, (b.start+uint32(i))/2
+		return i + utils.CommonNibblePrefixLength(a.data[byteA:], limit-i, b.data[byteB:], limit-i)
+	}
+	for i < limit && a.At(i) == b.At(i) {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseNibbles(t *testing.T) {
+	for _, value := range []string{"", "a", "0123456789abcdef", "fedcb"} {
+		n, err := parseNibbles(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Len() != len(value) || n.String() != value {
+			t.Errorf(`parseNibbles(%q) = %q with length %d`, value, n.String(), n.Len())
+		}
+	}
+	if n := mustParseNibbles("ABcd"); n.String() != "abcd" {
+		t.Errorf(`uppercase hex should be accepted, got %q`, n.String())
+	}
+	if _, err := parseNibbles("abcg"); err == nil {
+		t.Errorf(`parseNibbles() of a value that is not hex should fail`)
+	}
+}
+
+func TestNibblesSlice(t *testing.T) {
+	n := mustParseNibbles("0123456789")
+	if s := n.Slice(3, 7); s.String() != "3456" || s.At(0) != 3 {
+		t.Errorf(`Slice(3, 7) = %q`, s.String())
+	}
+	if s := n.Slice(3, 7).Slice(1, 3); s.String() != "45" {
+		t.Errorf(`slice of a slice = %q`, s.String())
+	}
+	if s := n.Slice(5, 5); s.Len() != 0 || s.String() != "" {
+		t.Errorf(`empty slice = %q`, s.String())
+	}
+}
+
+func TestNibblesAlignedAndConcat(t *testing.T) {
+	n := mustParseNibbles("0123456789").Slice(3, 8)
+	for _, parity := range []uint32{0, 1} {
+		a := n.aligned(parity)
+		if a.String() != "34567" || a.start%2 != parity {
+			t.Errorf(`aligned(%d) = %q starting at %d`, parity, a.String(), a.start)
+		}
+	}
+
+	a := mustParseNibbles("abc").Slice(1, 3)
+	b := mustParseNibbles("1234").Slice(1, 4)
+	c := concat(a, b)
+	if c.String() != "bc234" {
+		t.Errorf(`concat() = %q, expected %q`, c.String(), "bc234")
+	}
+	if c.start%2 != a.start%2 {
+		t.Errorf(`concat() should keep the parity of its first argument`)
+	}
+}
+
+func TestCommonPrefixLength(t *testing.T) {
+	id := mustParseNibbles("0123456789abcdef")
+	other := mustParseNibbles("0123456789abcd00")
+
+	cases := []struct {
+		a, b     nibbles
+		expected int
+	}{
+		{id, other, 14},
+		{id, id, 16},
+		{id, nibbles{}, 0},
+		// same parity, odd start
+		{id.Slice(1, 16), other.Slice(1, 16), 13},
+		{id.Slice(3, 6), other.Slice(3, 16), 3},
+		// different parities
+		{id.Slice(2, 16), mustParseNibbles("0123456789abcdef").Slice(2, 16).aligned(1), 14},
+		{id.Slice(1, 16), mustParseNibbles("123f"), 3},
+		{mustParseNibbles("f"), id, 0},
+	}
+	for _, c := range cases {
+		if l := commonPrefixLength(c.a, c.b); l != c.expected {
+			t.Errorf(`commonPrefixLength(%q, %q) = %d, expected %d`, c.a.String(), c.b.String(), l, c.expected)
+		}
+		if l := commonPrefixLength(c.b, c.a); l != c.expected {
+			t.Errorf(`commonPrefixLength(%q, %q) = %d, expected %d`, c.b.String(), c.a.String(), l, c.expected)
+		}
+	}
+}
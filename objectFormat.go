@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	formatcfg "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/hash"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// compiledHashAlgorithm is the object format go-git was built for: SHA-1, or SHA-256 when built with the sha256 tag.
+// go-git can only read the objects of repositories that use it
+var compiledHashAlgorithm, _ = hashAlgorithmOfSize(hash.Size)
+
+// repoHashAlgorithm returns the object format of a repository
+func repoHashAlgorithm(repo *git.Repository) (HashAlgorithm, error) {
+	cfg, err := repo.Config()
+	if err != nil {
+		return 0, err
+	}
+	// go-git writes extensions.objectFormat but doesn't read it back,
+	// so unless go-git set it itself it has to come from the raw config
+	format := string(cfg.Extensions.ObjectFormat)
+	if format == "" {
+		format = cfg.Raw.Section("extensions").Option("objectformat")
+	}
+	return parseHashAlgorithm(format)
+}
+
+// setRepoHashAlgorithm records the object format of a repository in its config, the way git does
+func setRepoHashAlgorithm(repo *git.Repository, algorithm HashAlgorithm) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if algorithm != HashSHA1 {
+		cfg.Core.RepositoryFormatVersion = formatcfg.Version_1
+		cfg.Extensions.ObjectFormat = formatcfg.ObjectFormat(algorithm.String())
+	}
+	return repo.Storer.SetConfig(cfg)
+}
+
+// readReference reads the value of a reference from the .git directory of a repository without parsing it,
+// from its own file if it has one and from packed-refs otherwise
+func readReference(fsys billy.Filesystem, name string) (string, error) {
+	data, err := util.ReadFile(fsys, name)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	packed, err := fsys.Open("packed-refs")
+	if err != nil {
+		return "", fmt.Errorf("reference %s not found: %w", name, err)
+	}
+	defer packed.Close()
+	lines := bufio.NewScanner(packed)
+	for lines.Scan() {
+		// comments and the commits that annotated tags point to
+		if line := lines.Text(); !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "^") {
+			if value, ref, ok := strings.Cut(line, " "); ok && ref == name {
+				return value, nil
+			}
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("reference %s not found: %w", name, fs.ErrNotExist)
+}
+
+// readCommitReference resolves a reference to the hash of the commit it points to, following symbolic references
+func readCommitReference(fsys billy.Filesystem, name string) (CommitHash, error) {
+	// git gives up after 5 levels of symbolic references as well
+	for depth := 0; depth < 5; depth++ {
+		value, err := readReference(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		if target, ok := strings.CutPrefix(value, "ref: "); ok {
+			name = target
+			continue
+		}
+		commit, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("reference %s is not a commit hash: %w", name, err)
+		}
+		if _, err := CommitHash(commit).Algorithm(); err != nil {
+			return nil, fmt.Errorf("reference %s: %w", name, err)
+		}
+		return commit, nil
+	}
+	return nil, fmt.Errorf("reference %s is nested too deeply", name)
+}
+
+// lineageFromCommitGraphOnly walks the history of a repository whose object format go-git was not built
+// for, which means that neither its objects nor its references can be read with go-git. The history comes from the
+// commit-graph instead, which has to be up to date with HEAD since there is no falling back to the objects
+func lineageFromCommitGraphOnly(repo *git.Repository, algorithm HashAlgorithm, prefixLength uint8) (*LineageBuilder, error) {
+	unsupported := fmt.Errorf("this build can only fingerprint %s repositories from their commit-graph, "+
+		"run 'git commit-graph write --reachable' in the repository or build with -tags %s", algorithm, algorithm)
+	storage, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return nil, unsupported
+	}
+	fsys := storage.Filesystem()
+
+	head, err := readCommitReference(fsys, "HEAD")
+	if err != nil {
+		for _, r := range []string{"refs/heads/master", "refs/heads/main"} {
+			head, err = readCommitReference(fsys, r)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if headAlgorithm, _ := head.Algorithm(); headAlgorithm != algorithm {
+		return nil, fmt.Errorf("HEAD of a %s repository is a %s hash: %w", algorithm, headAlgorithm, ErrHashAlgorithmMismatch)
+	}
+
+	graph, err := openCommitGraph(fsys)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, unsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer graph.Close()
+	position, ok := graph.position(head)
+	if !ok {
+		return nil, fmt.Errorf("the commit-graph does not have the HEAD commit %x: %w", []byte(head), unsupported)
+	}
+
+	builder, err := NewLineageBuilder(prefixLength)
+	if err != nil {
+		return nil, err
+	}
+	if err := graph.pushFirstParents(position, builder); err != nil {
+		return nil, err
+	}
+	return builder, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MoralCode/CodeDNA/utils"
+	"github.com/go-git/go-git/v5"
+)
+
+// gitFixture creates a repository with git in the given object format, with a merge that is not on the first-parent
+// history. Returns its path and the lineage ID that git's own first-parent history gives
+func gitFixture(t *testing.T, objectFormat string) (string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	run := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_AUTHOR_DATE=2020-01-01T00:00:00Z",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com", "GIT_COMMITTER_DATE=2020-01-01T00:00:00Z",
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return string(out)
+	}
+	commits := func(name string, n int) {
+		for i := 0; i < n; i++ {
+			run("commit", "-q", "--allow-empty", "-m", name+" "+strconv.Itoa(i))
+		}
+	}
+
+	run("init", "-q", "--object-format="+objectFormat, "--initial-branch=master", ".")
+	commits("master", 5)
+	run("checkout", "-q", "-b", "side")
+	commits("side", 3)
+	run("checkout", "-q", "master")
+	commits("master after branching", 2)
+	run("merge", "-q", "--no-ff", "-m", "merge side", "side")
+	commits("master after merging", 2)
+
+	builder, _ := NewLineageBuilder(4)
+	for _, hash := range strings.Fields(run("rev-list", "--first-parent", "HEAD")) {
+		if err := builder.PushHex(hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, builder.String()
+}
+
+func gitCommand(t *testing.T, dir string, args ...string) {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestSHA256Repository(t *testing.T) {
+	dir, expected := gitFixture(t, "sha256")
+	if len(expected) != 10 {
+		t.Fatalf(`git history has %d first-parent commits, expected 10`, len(expected))
+	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm, err := repoHashAlgorithm(repo); err != nil || algorithm != HashSHA256 {
+		t.Fatalf(`repoHashAlgorithm() = %v, %v`, algorithm, err)
+	}
+
+	// without a commit-graph, only builds with SHA-256 support can read the repository
+	id, err := getLineageIDFromRepo(repo, 4)
+	if compiledHashAlgorithm == HashSHA256 {
+		if err != nil || id != expected {
+			t.Errorf(`getLineageIDFromRepo() = %q, %v, was not %q`, id, err, expected)
+		}
+	} else if err == nil || !strings.Contains(err.Error(), "commit-graph") {
+		t.Errorf(`getLineageIDFromRepo() without a commit-graph = %q, %v, should fail`, id, err)
+	}
+
+	gitCommand(t, dir, "commit-graph", "write", "--reachable")
+	if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+		t.Errorf(`getLineageIDFromRepo() = %q, %v, was not %q`, id, err, expected)
+	}
+
+	// references are read from packed-refs when they have no file of their own
+	gitCommand(t, dir, "pack-refs", "--all")
+	if _, err := os.Stat(dir + "/.git/refs/heads/master"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf(`master was not packed: %v`, err)
+	}
+	if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+		t.Errorf(`getLineageIDFromRepo() with packed references = %q, %v, was not %q`, id, err, expected)
+	}
+}
+
+func TestSHA1RepositoryFromGit(t *testing.T) {
+	dir, expected := gitFixture(t, "sha1")
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := getLineageIDFromRepo(repo, 4)
+	if compiledHashAlgorithm == HashSHA1 && (err != nil || id != expected) {
+		t.Errorf(`getLineageIDFromRepo() = %q, %v, was not %q`, id, err, expected)
+	}
+	gitCommand(t, dir, "commit-graph", "write", "--reachable")
+	if id, err := getLineageIDFromRepo(repo, 4); err != nil || id != expected {
+		t.Errorf(`getLineageIDFromRepo() with a commit-graph = %q, %v, was not %q`, id, err, expected)
+	}
+}
+
+func TestHashAlgorithms(t *testing.T) {
+	sha1 := make(CommitHash, 20)
+	sha256 := make(CommitHash, 32)
+	sha256[0] = 0xf0
+
+	builder, _ := NewLineageBuilder(4)
+	if err := builder.Push(sha256); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.PushHex(strings.Repeat("a", 64)); err != nil {
+		t.Fatal(err)
+	}
+	if builder.Algorithm() != HashSHA256 || builder.String() != "af" {
+		t.Errorf(`SHA-256 lineage ID = %q (%v)`, builder.String(), builder.Algorithm())
+	}
+	if err := builder.Push(sha1); !errors.Is(err, ErrHashAlgorithmMismatch) {
+		t.Errorf(`Push() of a SHA-1 hash after SHA-256 ones = %v`, err)
+	}
+	if err := builder.PushHex(strings.Repeat("a", 40)); !errors.Is(err, ErrHashAlgorithmMismatch) {
+		t.Errorf(`PushHex() of a SHA-1 hash after SHA-256 ones = %v`, err)
+	}
+	if err := builder.Push(make(CommitHash, 16)); err == nil {
+		t.Errorf(`Push() of a 16 byte hash should fail`)
+	}
+
+	a := builder.LineageID()
+	b, err := LineageIDFromHashes([]CommitHash{sha1, sha1}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LineageIDFromHashes([]CommitHash{sha1, sha256}, 4); !errors.Is(err, ErrHashAlgorithmMismatch) {
+		t.Errorf(`LineageIDFromHashes() of SHA-1 and SHA-256 hashes = %v`, err)
+	}
+	if _, err := LineageIDFromHashes([]CommitHash{make(CommitHash, 16)}, 4); err == nil {
+		t.Errorf(`LineageIDFromHashes() of a 16 byte hash should fail`)
+	}
+	if a.Algorithm() != HashSHA256 || b.Algorithm() != HashSHA1 {
+		t.Errorf(`Algorithm() = %v, %v`, a.Algorithm(), b.Algorithm())
+	}
+	if _, err := a.Compare(b); !errors.Is(err, ErrHashAlgorithmMismatch) {
+		t.Errorf(`Compare() of SHA-256 and SHA-1 lineage IDs = %v`, err)
+	}
+	if comparison, err := b.Compare(b); err != nil || comparison.Shared != 2 {
+		t.Errorf(`Compare() = %v, %v`, comparison, err)
+	}
+
+	for name, expected := range map[string]HashAlgorithm{"": HashSHA1, "sha1": HashSHA1, "SHA256": HashSHA256} {
+		if algorithm, err := parseHashAlgorithm(name); err != nil || algorithm != expected {
+			t.Errorf(`parseHashAlgorithm(%q) = %v, %v`, name, algorithm, err)
+		}
+	}
+	if _, err := parseHashAlgorithm("md5"); err == nil {
+		t.Errorf(`parseHashAlgorithm("md5") should fail`)
+	}
+}
+
+func TestCachedHashAlgorithms(t *testing.T) {
+	cache := utils.IdentityCache{
+		Filename: t.TempDir() + "/cache.sqlite",
+	}
+	cache.Add(utils.IdentityValue{URL: "https://example.com/a", Nickname: "a", LineageID: "0123456789"})
+	cache.Add(utils.IdentityValue{URL: "https://example.com/b", Nickname: "b", LineageID: "01234567ab", HashAlgorithm: "sha1"})
+
+	a, _ := cache.Resolve("a")
+	b, _ := cache.Resolve("b")
+	lineageA, err := cachedLineageID(*a)
+	if err != nil || lineageA.Algorithm() != HashSHA1 || lineageA.StringHex() != "0123456789" {
+		t.Fatalf(`cachedLineageID() of a row without a hash algorithm = %v, %v`, lineageA, err)
+	}
+	lineageB, _ := cachedLineageID(*b)
+	if comparison, err := lineageA.Compare(lineageB); err != nil || comparison.Shared != 8 {
+		t.Errorf(`Compare() of cached SHA-1 lineage IDs = %v, %v`, comparison, err)
+	}
+	if _, err := similarityTreeForCache(&cache, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a SHA-256 repository shares no history with SHA-1 ones, whatever its lineage ID looks like
+	cache.UpdateLineage(b.ID, utils.IdentityValue{LineageID: "01234567ab", HashAlgorithm: "sha256", PrefixLength: 4}, "refresh")
+	b, _ = cache.Resolve("b")
+	lineageB, err = cachedLineageID(*b)
+	if err != nil || lineageB.Algorithm() != HashSHA256 {
+		t.Fatalf(`cachedLineageID() of a SHA-256 row = %v, %v`, lineageB, err)
+	}
+	if _, err := lineageA.Compare(lineageB); !errors.Is(err, ErrHashAlgorithmMismatch) {
+		t.Errorf(`Compare() of cached SHA-1 and SHA-256 lineage IDs = %v`, err)
+	}
+	rows, _ := cache.GetAll()
+	if _, _, err := cachedLineageIDs(rows); !errors.Is(err, ErrHashAlgorithmMismatch) {
+		t.Errorf(`cachedLineageIDs() of mixed rows = %v`, err)
+	}
+	for _, rebuild := range []bool{false, true} {
+		if _, err := similarityTreeForCache(&cache, rebuild); !errors.Is(err, ErrHashAlgorithmMismatch) {
+			t.Errorf(`similarityTreeForCache() of a cache with mixed hash algorithms (rebuild %v) = %v`, rebuild, err)
+		}
+	}
+
+	if _, err := ParseLineageID("0123", 1, HashSHA1); err == nil {
+		t.Errorf(`ParseLineageID() of values that don't fit the prefix length should fail`)
+	}
+	if _, err := ParseLineageID("01g3", 4, HashSHA1); err == nil {
+		t.Errorf(`ParseLineageID() of something that is not hex should fail`)
+	}
+}
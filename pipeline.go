@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MoralCode/CodeDNA/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+// fingerprintJob is one repository for the import pipeline to clone (or update) and fingerprint
+type fingerprintJob struct {
+	Source   string
+	Nickname string
+	// the cached value of the repository, if it is being refreshed
+	Existing *utils.IdentityValue
+}
+
+type fingerprintResult struct {
+	Job fingerprintJob
+	// the URL to cache the repository under, which is the source of the job except for archives (see archivedRepoSource)
+	Source    string
+	LineageID string
+	// the hash algorithm of the commits the lineage ID was made from
+	HashAlgorithm HashAlgorithm
+	// the commit time of the root commit
+	FirstCommit time.Time
+	// whether an existing clone was updated instead of cloning from scratch
+	Incremental bool
+	Err         error
+}
+
+// importPipeline clones and fingerprints many repositories concurrently.
+// Only the cloning and fingerprinting happens on the worker goroutines,
+// results are handed back over a channel so that the caller can write them to the cache one at a time
+type importPipeline struct {
+	StorageDir string
+	Workers    int
+	// keep the clones around after fingerprinting so that later refreshes can fetch instead of clone
+	PreserveClones bool
+	// fetch into an existing clone instead of cloning again if there is one
+	Incremental  bool
+	PrefixLength uint8
+}
+
+// Run starts the workers and returns a channel of results, which is closed once every job has finished
+func (p importPipeline) Run(jobs []fingerprintJob) <-chan fingerprintResult {
+	workers := max(p.Workers, 1)
+	queue := make(chan fingerprintJob)
+	results := make(chan fingerprintResult)
+
+	// jobs that share a clone directory (the same repository listed twice) are run one at a time,
+	// so that one of them can't delete or fetch into the clone while another is reading it
+	dirs := map[string]*sync.Mutex{}
+	for _, job := range jobs {
+		dirs[p.cloneDir(job.Source)] = &sync.Mutex{}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				dir := dirs[p.cloneDir(job.Source)]
+				dir.Lock()
+				result := p.fingerprint(job)
+				dir.Unlock()
+				results <- result
+			}
+		}()
+	}
+
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// identity returns a successful result as it would be cached (without a nickname)
+func (p importPipeline) identity(result fingerprintResult) utils.IdentityValue {
+	return utils.IdentityValue{
+		URL:           result.Source,
+		LineageID:     result.LineageID,
+		HashAlgorithm: result.HashAlgorithm.String(),
+		PrefixLength:  p.PrefixLength,
+		FirstCommit:   result.FirstCommit,
+	}
+}
+
+// cloneDirHashLength is the number of hex characters of the hash of the source that end the name of its clone
+const cloneDirHashLength = 12
+
+// cloneDir is where the clone of a source goes. The owner and name of the repository keep it recognizable,
+// and the hash of the full source keeps repositories of the same name on different hosts apart
+func (p importPipeline) cloneDir(source string) string {
+	owner, repoName := repoOwnerAndNameFromURL(source)
+	sum := sha256.Sum256([]byte(source))
+	return p.StorageDir + "/" + owner + "_" + repoName + "_" + hex.EncodeToString(sum[:])[:cloneDirHashLength]
+}
+
+func (p importPipeline) fingerprint(job fingerprintJob) fingerprintResult {
+	result := fingerprintResult{Job: job, Source: job.Source}
+	// bundles and archives of repositories are read in memory instead of being cloned
+	if isArchivedRepo(job.Source) {
+		repo, err := openArchivedRepo(job.Source)
+		if err != nil {
+			result.Err = fmt.Errorf("error opening archive: %w", err)
+			return result
+		}
+		result.Source, err = archivedRepoSource(repo, job.Source)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		result.LineageID, result.HashAlgorithm, result.FirstCommit, result.Err = lineageOf(repo, p.PrefixLength)
+		if result.Err != nil {
+			result.Err = fmt.Errorf("error getting id: %w", result.Err)
+		}
+		return result
+	}
+	cloneDir := p.cloneDir(job.Source)
+
+	// progress output of several clones at once would just be noise
+	var progress io.Writer
+	if p.Workers <= 1 {
+		progress = os.Stdout
+	}
+
+	var repo *git.Repository
+	if p.Incremental {
+		existing, err := git.PlainOpen(cloneDir)
+		if err == nil {
+			err = fetchRepo(existing, progress)
+			if err == nil {
+				repo = existing
+				result.Incremental = true
+			} else {
+				fmt.Println("could not update existing clone of", job.Source, "cloning again:", err)
+			}
+		}
+	}
+
+	if repo == nil {
+		err := os.RemoveAll(cloneDir)
+		if err != nil {
+			result.Err = fmt.Errorf("error removing old clone: %w", err)
+			return result
+		}
+		err = os.MkdirAll(cloneDir, 0755)
+		if err != nil {
+			result.Err = fmt.Errorf("error in mkdir: %w", err)
+			return result
+		}
+		err = cloneRepo(job.Source, cloneDir, progress)
+		if err != nil {
+			result.Err = fmt.Errorf("error in clone: %w", err)
+			if err := os.RemoveAll(cloneDir); err != nil {
+				fmt.Println("error during cleanup of error")
+				fmt.Println(err)
+			}
+			return result
+		}
+		repo, err = git.PlainOpen(cloneDir)
+		if err != nil {
+			result.Err = fmt.Errorf("error opening repo: %w", err)
+			return result
+		}
+	}
+
+	result.LineageID, result.HashAlgorithm, result.FirstCommit, result.Err = lineageOf(repo, p.PrefixLength)
+	if result.Err != nil {
+		result.Err = fmt.Errorf("error getting id: %w", result.Err)
+	}
+
+	if !p.PreserveClones {
+		if err := os.RemoveAll(cloneDir); err != nil {
+			fmt.Println("cleanup error")
+			fmt.Println(err)
+		}
+	}
+	return result
+}
+
+// fetchRepo brings the branch that HEAD points to in a bare clone up to date with origin
+func fetchRepo(repo *git.Repository, progress io.Writer) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	// clones are bare, so the local branch can be updated directly
+	refspec := config.RefSpec("+" + head.Name().String() + ":" + head.Name().String())
+	err = repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{refspec},
+		Tags:       git.NoTags,
+		Progress:   progress,
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitN adds n commits to the (non-bare) repository at path, creating it if needed
+func commitN(t *testing.T, path string, n int) *git.Repository {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		repo, err = git.PlainInit(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recordObjectFormat(t, repo)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%d.txt", time.Now().UnixNano())
+		err := os.WriteFile(filepath.Join(path, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := worktree.Add(name); err != nil {
+			t.Fatal(err)
+		}
+		_, err = worktree.Commit("add "+name, &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func TestImportPipeline(t *testing.T) {
+	if compiledHashAlgorithm != HashSHA1 {
+		// go-git can only clone over the SHA-1 protocol, even from a repository of the compiled object format
+		t.Skip("cloning is not supported in builds for", compiledHashAlgorithm, "objects")
+	}
+	upstreamDir := filepath.Join(t.TempDir(), "owner", "project")
+	upstream := commitN(t, upstreamDir, 5)
+	expected, err := getLineageIDFromRepo(upstream, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline := importPipeline{
+		StorageDir:     t.TempDir(),
+		Workers:        2,
+		PreserveClones: true,
+		PrefixLength:   4,
+	}
+	jobs := []fingerprintJob{{Source: "file://" + upstreamDir, Nickname: "project"}}
+
+	results := []fingerprintResult{}
+	for result := range pipeline.Run(jobs) {
+		results = append(results, result)
+	}
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf(`pipeline returned %+v`, results)
+	}
+	if results[0].LineageID != expected || results[0].Incremental {
+		t.Errorf(`pipeline computed %q (incremental %v), expected a fresh clone with %q`, results[0].LineageID, results[0].Incremental, expected)
+	}
+
+	// new upstream commits are picked up by fetching into the preserved clone
+	upstream = commitN(t, upstreamDir, 3)
+	expected, _ = getLineageIDFromRepo(upstream, 4)
+	pipeline.Incremental = true
+	result := <-pipeline.Run(jobs)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if !result.Incremental {
+		t.Errorf(`expected the preserved clone to be updated incrementally`)
+	}
+	if result.LineageID != expected || len(result.LineageID) != 8 {
+		t.Errorf(`incremental update computed %q, expected %q`, result.LineageID, expected)
+	}
+
+	pipeline.PreserveClones = false
+	<-pipeline.Run(jobs)
+	if _, err := os.Stat(pipeline.cloneDir(jobs[0].Source)); !os.IsNotExist(err) {
+		t.Errorf(`clone was not cleaned up: %v`, err)
+	}
+}
+
+func TestImportPipelineCollidingSources(t *testing.T) {
+	if compiledHashAlgorithm != HashSHA1 {
+		t.Skip("cloning is not supported in builds for", compiledHashAlgorithm, "objects")
+	}
+	// the same owner and name on two hosts, and one of them listed twice
+	hosts := t.TempDir()
+	expected := map[string]string{}
+	sources := []string{}
+	for i, host := range []string{"github.com", "gitlab.com"} {
+		dir := filepath.Join(hosts, host, "a", "b")
+		repo := commitN(t, dir, 3+i)
+		id, err := getLineageIDFromRepo(repo, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := "file://" + dir
+		expected[source] = id
+		sources = append(sources, source)
+	}
+	jobs := []fingerprintJob{{Source: sources[0]}, {Source: sources[1]}, {Source: sources[0]}}
+
+	pipeline := importPipeline{StorageDir: t.TempDir(), Workers: 2, PreserveClones: true, PrefixLength: 4}
+	if a, b := pipeline.cloneDir(sources[0]), pipeline.cloneDir(sources[1]); a == b {
+		t.Fatalf(`both hosts are cloned into %q`, a)
+	}
+	results := 0
+	for result := range pipeline.Run(jobs) {
+		results++
+		if result.Err != nil {
+			t.Errorf(`fingerprinting %s failed: %v`, result.Job.Source, result.Err)
+		} else if result.LineageID != expected[result.Job.Source] {
+			t.Errorf(`%s was fingerprinted as %q, expected %q`, result.Job.Source, result.LineageID, expected[result.Job.Source])
+		}
+	}
+	if results != len(jobs) {
+		t.Errorf(`pipeline returned %d results for %d jobs`, results, len(jobs))
+	}
+}
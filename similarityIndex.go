@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+// The similarity index is the on-disk counterpart of the similarity tree, for corpora too large to hold as a tree
+// in memory. It is a sorted list of lineage IDs along with the length of the prefix each one shares with the one
+// before it (an LCP array), which is enough to find exact matches, everything sharing a prefix and the nearest
+// neighbours of a lineage ID with binary searches and sequential scans. The file is memory-mapped rather than read,
+// so only the parts a query touches are ever loaded.
+//
+// Layout (all integers little endian):
+//
+//	header:  magic (8 bytes), version (uint32), hash algorithm (uint32), count, ids size, names size (uint64 each)
+//	records: count times: id offset, name offset (uint64 each), id length in nibbles, shared prefix length (uint32 each)
+//	ids:     the packed lineage IDs, in sorted order (see compareLineageIDs)
+//	names:   the sources, in the same order
+//
+// The hash algorithm is that of the commits every lineage ID in the index was made from, 0 for SHA-1 and 1 for SHA-256
+// (the field was reserved and always 0 before, and every index written then was of SHA-1 lineage IDs)
+const similarityIndexMagic = "CDNAINDX"
+const similarityIndexVersion = 1
+
+const similarityIndexHeaderSize = 40
+const similarityIndexRecordSize = 24
+
+// IndexedRepository is a repository found in a SimilarityIndex
+type IndexedRepository struct {
+	Source string
+	// the number of commits in its lineage ID
+	Length int
+}
+
+// WriteSimilarityIndex writes the index of a set of lineage IDs (keyed by source), all made from commits of the given hash algorithm
+func WriteSimilarityIndex(w io.Writer, ids map[string]string, algorithm HashAlgorithm) error {
+	entries, err := sortLineages(ids)
+	if err != nil {
+		return err
+	}
+
+	var idsSize, namesSize uint64
+	for _, e := range entries {
+		idsSize += uint64(len(e.id.data))
+		namesSize += uint64(len(e.source))
+	}
+
+	out := bufio.NewWriter(w)
+	var header [similarityIndexHeaderSize]byte
+	copy(header[:], similarityIndexMagic)
+	binary.LittleEndian.PutUint32(header[8:], similarityIndexVersion)
+	binary.LittleEndian.PutUint32(header[12:], uint32(algorithm))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(entries)))
+	binary.LittleEndian.PutUint64(header[24:], idsSize)
+	binary.LittleEndian.PutUint64(header[32:], namesSize)
+	out.Write(header[:])
+
+	var idOffset, nameOffset uint64
+	var previous nibbles
+	for _, e := range entries {
+		var record [similarityIndexRecordSize]byte
+		binary.LittleEndian.PutUint64(record[0:], idOffset)
+		binary.LittleEndian.PutUint64(record[8:], nameOffset)
+		binary.LittleEndian.PutUint32(record[16:], uint32(e.id.Len()))
+		binary.LittleEndian.PutUint32(record[20:], uint32(commonPrefixLength(previous, e.id)))
+		out.Write(record[:])
+		idOffset += uint64(len(e.id.data))
+		nameOffset += uint64(len(e.source))
+		previous = e.id
+	}
+	for _, e := range entries {
+		out.Write(e.id.data)
+	}
+	for _, e := range entries {
+		out.WriteString(e.source)
+	}
+	return out.Flush()
+}
+
+// writeSimilarityIndexFile writes the index to a temporary file first, so that an interrupted build
+// never leaves a truncated index behind for readers that have it mapped
+func writeSimilarityIndexFile(path string, ids map[string]string, algorithm HashAlgorithm) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := WriteSimilarityIndex(f, ids, algorithm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// similarityIndexPath is where the index for a cache database is written by default
+func similarityIndexPath(cache *utils.IdentityCache) string {
+	return cache.Filename + ".index"
+}
+
+// SimilarityIndex is a memory-mapped similarity index file, see WriteSimilarityIndex.
+// It is read-only, so it can be queried from multiple goroutines at once
+type SimilarityIndex struct {
+	data      []byte
+	algorithm HashAlgorithm
+	count     int
+	records   []byte
+	ids       []byte
+	names     []byte
+}
+
+func OpenSimilarityIndex(path string) (*SimilarityIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < similarityIndexHeaderSize {
+		return nil, fmt.Errorf("%s is not a similarity index file", path)
+	}
+	data, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseSimilarityIndex(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return index, nil
+}
+
+func parseSimilarityIndex(data []byte) (*SimilarityIndex, error) {
+	if len(data) < similarityIndexHeaderSize || string(data[:8]) != similarityIndexMagic {
+		return nil, errors.New("not a similarity index file")
+	}
+	if version := binary.LittleEndian.Uint32(data[8:]); version != similarityIndexVersion {
+		return nil, fmt.Errorf("unsupported similarity index version %d", version)
+	}
+	algorithm := HashAlgorithm(binary.LittleEndian.Uint32(data[12:]))
+	if algorithm != HashSHA1 && algorithm != HashSHA256 {
+		return nil, fmt.Errorf("similarity index has an unknown hash algorithm %d", algorithm)
+	}
+	count := binary.LittleEndian.Uint64(data[16:])
+	idsSize := binary.LittleEndian.Uint64(data[24:])
+	namesSize := binary.LittleEndian.Uint64(data[32:])
+
+	rest := uint64(len(data) - similarityIndexHeaderSize)
+	if count > rest/similarityIndexRecordSize || idsSize > rest || namesSize > rest ||
+		count*similarityIndexRecordSize+idsSize+namesSize != rest {
+		return nil, errors.New("similarity index is truncated or corrupt")
+	}
+	recordsEnd := similarityIndexHeaderSize + count*similarityIndexRecordSize
+	index := &SimilarityIndex{
+		data:      data,
+		algorithm: algorithm,
+		count:     int(count),
+		records:   data[similarityIndexHeaderSize:recordsEnd],
+		ids:       data[recordsEnd : recordsEnd+idsSize],
+		names:     data[recordsEnd+idsSize:],
+	}
+	// every record is checked up front so that queries never slice outside of the mapping. This only reads the
+	// records, not the lineage IDs and names they point to
+	var idOffset, nameOffset uint64
+	var previousLength uint32
+	for i := 0; i < index.count; i++ {
+		record := index.record(i)
+		length := binary.LittleEndian.Uint32(record[16:])
+		shared := binary.LittleEndian.Uint32(record[20:])
+		nameStart := binary.LittleEndian.Uint64(record[8:])
+		if binary.LittleEndian.Uint64(record[0:]) != idOffset || nameStart < nameOffset || nameStart > namesSize ||
+			shared > min(length, previousLength) {
+			return nil, fmt.Errorf("similarity index record %d is corrupt", i)
+		}
+		idOffset += (uint64(length) + 1) / 2
+		if idOffset > idsSize {
+			return nil, fmt.Errorf("similarity index record %d is corrupt", i)
+		}
+		nameOffset, previousLength = nameStart, length
+	}
+	if idOffset != idsSize {
+		return nil, errors.New("similarity index is truncated or corrupt")
+	}
+	return index, nil
+}
+
+// Close unmaps the index. Nothing returned by the index refers to the mapping, so all of it remains valid
+func (index *SimilarityIndex) Close() error {
+	if index.data == nil {
+		return nil
+	}
+	err := unmapFile(index.data)
+	*index = SimilarityIndex{}
+	return err
+}
+
+// Len returns the number of repositories in the index
+func (index *SimilarityIndex) Len() int {
+	return index.count
+}
+
+// Algorithm returns the hash algorithm of the commits that the indexed lineage IDs were made from
+func (index *SimilarityIndex) Algorithm() HashAlgorithm {
+	return index.algorithm
+}
+
+func (index *SimilarityIndex) record(i int) []byte {
+	return index.records[i*similarityIndexRecordSize : (i+1)*similarityIndexRecordSize]
+}
+
+// lineageID returns the lineage ID of the i-th repository as a view into the mapping
+func (index *SimilarityIndex) lineageID(i int) nibbles {
+	record := index.record(i)
+	offset := binary.LittleEndian.Uint64(record[0:])
+	length := binary.LittleEndian.Uint32(record[16:])
+	return nibbles{data: index.ids[offset : offset+(uint64(length)+1)/2], end: length}
+}
+
+// shared returns the number of commits the i-th repository shares with the one before it
+func (index *SimilarityIndex) shared(i int) int {
+	return int(binary.LittleEndian.Uint32(index.record(i)[20:]))
+}
+
+func (index *SimilarityIndex) source(i int) string {
+	start := binary.LittleEndian.Uint64(index.record(i)[8:])
+	end := uint64(len(index.names))
+	if i+1 < index.count {
+		end = binary.LittleEndian.Uint64(index.record(i + 1)[8:])
+	}
+	return string(index.names[start:end])
+}
+
+func (index *SimilarityIndex) repository(i int) IndexedRepository {
+	return IndexedRepository{Source: index.source(i), Length: index.lineageID(i).Len()}
+}
+
+// search returns the position of the first repository whose lineage ID sorts at or after the given one
+func (index *SimilarityIndex) search(id nibbles) int {
+	return sort.Search(index.count, func(i int) bool {
+		return compareLineageIDs(index.lineageID(i), id) >= 0
+	})
+}
+
+// Lookup returns (in sorted order) every source with exactly the given lineage ID
+func (index *SimilarityIndex) Lookup(lineageID string) ([]string, error) {
+	id, err := parseNibbles(lineageID)
+	if err != nil {
+		return nil, err
+	}
+	sources := []string{}
+	for i := index.search(id); i < index.count && compareLineageIDs(index.lineageID(i), id) == 0; i++ {
+		sources = append(sources, index.source(i))
+	}
+	return sources, nil
+}
+
+// WithPrefix returns every repository whose lineage ID starts with the given prefix, i.e. every repository that
+// contains that part of the history, in the order of their lineage IDs
+func (index *SimilarityIndex) WithPrefix(prefix string) ([]IndexedRepository, error) {
+	id, err := parseNibbles(prefix)
+	if err != nil {
+		return nil, err
+	}
+	found := []IndexedRepository{}
+	i := index.search(id)
+	if i == index.count || commonPrefixLength(index.lineageID(i), id) < id.Len() {
+		return found, nil
+	}
+	// everything after the first match that shares at least as much with the repository before it matches too
+	for ; i < index.count && (len(found) == 0 || index.shared(i) >= id.Len()); i++ {
+		found = append(found, index.repository(i))
+	}
+	return found, nil
+}
+
+// Nearest finds the repositories whose lineage IDs share the longest prefix with the given one, the same way
+// SimilarityTree.Related does: ordered by shared length and then by distance, at most k of them (all of them if k <= 0).
+// Repositories that share nothing at all and the given sources are left out
+func (index *SimilarityIndex) Nearest(lineageID string, k int, exclude ...string) ([]RelatedRepository, error) {
+	id, err := parseNibbles(lineageID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the repositories sharing the most with the query sort right next to it, and every step away from it
+	// shares at most as much as the step before (and exactly as much as the LCP array says the two steps share)
+	right := index.search(id)
+	left := right - 1
+	sharedRight, sharedLeft := 0, 0
+	if right < index.count {
+		sharedRight = commonPrefixLength(index.lineageID(right), id)
+	}
+	if left >= 0 {
+		sharedLeft = commonPrefixLength(index.lineageID(left), id)
+	}
+
+	results := []RelatedRepository{}
+	for {
+		var i, shared int
+		if right < index.count && (left < 0 || sharedRight >= sharedLeft) {
+			i, shared = right, sharedRight
+			right++
+			if right < index.count {
+				sharedRight = min(sharedRight, index.shared(right))
+			}
+		} else if left >= 0 {
+			i, shared = left, sharedLeft
+			sharedLeft = min(sharedLeft, index.shared(left))
+			left--
+		} else {
+			break
+		}
+		// keep going until everything sharing as much as the last result is found, so that ties are ordered the same
+		if shared == 0 || (k > 0 && len(results) >= k && shared < results[len(results)-1].SharedLength) {
+			break
+		}
+		source := index.source(i)
+		if slices.Contains(exclude, source) {
+			continue
+		}
+		length := index.lineageID(i).Len()
+		results = append(results, RelatedRepository{
+			Source:        source,
+			SharedLength:  shared,
+			DivergesAt:    shared,
+			UniqueToQuery: id.Len() - shared,
+			UniqueToOther: length - shared,
+		})
+	}
+
+	slices.SortFunc(results, func(a, b RelatedRepository) int {
+		if a.SharedLength != b.SharedLength {
+			return b.SharedLength - a.SharedLength
+		}
+		if a.Distance() != b.Distance() {
+			return a.Distance() - b.Distance()
+		}
+		return strings.Compare(a.Source, b.Source)
+	})
+	if k > 0 && len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func openTestIndex(t *testing.T, ids map[string]string) *SimilarityIndex {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cache.sqlite.index")
+	if err := writeSimilarityIndexFile(path, ids, HashSHA1); err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenSimilarityIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+	return index
+}
+
+func TestSimilarityIndex(t *testing.T) {
+	ids := map[string]string{
+		"a":      "0123456789",
+		"b":      "01234567ab",
+		"c":      "0123",
+		"d":      "fedc",
+		"mirror": "0123456789",
+	}
+	index := openTestIndex(t, ids)
+
+	if index.Len() != len(ids) {
+		t.Errorf(`Len() = %d, expected %d`, index.Len(), len(ids))
+	}
+	if sources, err := index.Lookup("0123456789"); err != nil || !slices.Equal(sources, []string{"a", "mirror"}) {
+		t.Errorf(`Lookup() = %v, %v`, sources, err)
+	}
+	if sources, _ := index.Lookup("01234567"); len(sources) != 0 {
+		t.Errorf(`Lookup() of a lineage ID that no source has = %v`, sources)
+	}
+	if _, err := index.Lookup("xyz"); err == nil {
+		t.Errorf(`Lookup() of a value that is not hex should fail`)
+	}
+
+	found, err := index.WithPrefix("012345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []IndexedRepository{{"a", 10}, {"mirror", 10}, {"b", 10}}
+	if !slices.Equal(found, expected) {
+		t.Errorf(`WithPrefix() = %v, expected %v`, found, expected)
+	}
+	if found, _ := index.WithPrefix("5"); len(found) != 0 {
+		t.Errorf(`WithPrefix() of a prefix nothing has = %v`, found)
+	}
+
+	related, err := index.Nearest("0123456789", 2, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(related) != 2 || related[0].Source != "mirror" || related[1].Source != "b" || related[1].SharedLength != 8 {
+		t.Errorf(`Nearest() = %v`, related)
+	}
+}
+
+func TestSimilarityIndexMatchesTree(t *testing.T) {
+	ids := map[string]string{}
+	for i, id := range syntheticLineageIDs(2000, 5) {
+		ids[strconv.Itoa(i)] = id
+	}
+	for i := 0; i < 50; i++ {
+		id := ids[strconv.Itoa(i*11)]
+		ids["mirror-"+strconv.Itoa(i)] = id
+		ids["prefix-"+strconv.Itoa(i)] = id[:1+i%len(id)]
+	}
+	index := openTestIndex(t, ids)
+	graph, err := BuildSimilarityTree(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		source := strconv.Itoa(i * 9)
+		for _, k := range []int{0, 1, 5} {
+			expected, err := graph.Related(source, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := index.Nearest(ids[source], k, source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, expected) {
+				t.Fatalf(`Nearest(%q, %d) = %v, Related() = %v`, source, k, got, expected)
+			}
+		}
+
+		id := ids[source]
+		prefix := id[:1+i%len(id)]
+		found, err := index.WithPrefix(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{}
+		for other, otherID := range ids {
+			if strings.HasPrefix(otherID, prefix) {
+				expected = append(expected, other)
+			}
+		}
+		sources := []string{}
+		for _, r := range found {
+			sources = append(sources, r.Source)
+		}
+		slices.Sort(sources)
+		slices.Sort(expected)
+		if !slices.Equal(sources, expected) {
+			t.Fatalf(`WithPrefix(%q) found %d repositories, expected %d`, prefix, len(sources), len(expected))
+		}
+	}
+}
+
+func TestSimilarityIndexFile(t *testing.T) {
+	empty := openTestIndex(t, map[string]string{})
+	if empty.Len() != 0 {
+		t.Errorf(`empty index has %d repositories`, empty.Len())
+	}
+	if related, err := empty.Nearest("0123", 0); err != nil || len(related) != 0 {
+		t.Errorf(`Nearest() in an empty index = %v, %v`, related, err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index")
+	if err := writeSimilarityIndexFile(path, map[string]string{"a": "0123", "b": "4567"}, HashSHA1); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+
+	truncated := filepath.Join(dir, "truncated")
+	os.WriteFile(truncated, data[:len(data)-1], 0644)
+	if _, err := OpenSimilarityIndex(truncated); err == nil {
+		t.Errorf(`OpenSimilarityIndex() of a truncated index should fail`)
+	}
+
+	other := filepath.Join(dir, "other")
+	os.WriteFile(other, []byte("CDNATREE and then some more bytes to fill the header"), 0644)
+	if _, err := OpenSimilarityIndex(other); err == nil {
+		t.Errorf(`OpenSimilarityIndex() of a file that is not an index should fail`)
+	}
+
+	// records before the last one are checked too
+	for name, corrupt := range map[string]func([]byte){
+		"id length":   func(record []byte) { record[16] = 200 },
+		"name offset": func(record []byte) { record[8] = 200 },
+		"shared":      func(record []byte) { record[20] = 1 },
+	} {
+		corrupted := slices.Clone(data)
+		corrupt(corrupted[similarityIndexHeaderSize:])
+		path := filepath.Join(dir, "corrupt")
+		os.WriteFile(path, corrupted, 0644)
+		if _, err := OpenSimilarityIndex(path); err == nil {
+			t.Errorf(`OpenSimilarityIndex() of an index with a corrupt %s in its first record should fail`, name)
+		}
+	}
+
+	sha256Index := filepath.Join(dir, "sha256")
+	if err := writeSimilarityIndexFile(sha256Index, map[string]string{"a": "0123"}, HashSHA256); err != nil {
+		t.Fatal(err)
+	}
+	if index, err := OpenSimilarityIndex(sha256Index); err != nil || index.Algorithm() != HashSHA256 {
+		t.Errorf(`OpenSimilarityIndex() of a SHA-256 index = %v, %v`, index, err)
+	} else {
+		index.Close()
+	}
+	unknown := filepath.Join(dir, "unknown")
+	corrupt := slices.Clone(data)
+	corrupt[12] = 7
+	os.WriteFile(unknown, corrupt, 0644)
+	if _, err := OpenSimilarityIndex(unknown); err == nil {
+		t.Errorf(`OpenSimilarityIndex() of an index with an unknown hash algorithm should fail`)
+	}
+
+	// sources outlive the mapping
+	index, err := OpenSimilarityIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, _ := index.Lookup("0123")
+	index.Close()
+	if !slices.Equal(sources, []string{"a"}) {
+		t.Errorf(`Lookup() after Close() = %v`, sources)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+//go:embed templates/similarity.html.tmpl
+var reportTemplates embed.FS
+
+var similarityReportTemplate = template.Must(template.ParseFS(reportTemplates, "templates/similarity.html.tmpl"))
+
+type reportSource struct {
+	Name string
+	URL  string
+}
+
+// reportNode is one row of a family's tree, in the order the tree is shown (parents before their children).
+// The rows are kept flat so that the template doesn't have to recurse: Depth is the row's level in the tree
+// and Close is how many of the enclosing <details> end after it (its own and those of the ancestors it is the last row of)
+type reportNode struct {
+	Edge    string
+	Label   string
+	Open    bool
+	Depth   int
+	Close   int
+	Sources []reportSource
+}
+
+type reportRepository struct {
+	Name             string
+	URL              string
+	Family           string
+	FamilyID         string
+	Commits          int
+	SharedWithFamily int
+	Mirrors          []string
+}
+
+type reportFamily struct {
+	ID             string
+	Name           string
+	Repositories   int
+	SharedCommits  int
+	LongestHistory int
+	Mirrors        int
+	Nodes          []reportNode
+}
+
+type similarityReport struct {
+	Generated       time.Time
+	RepositoryCount int
+	Families        []reportFamily
+	Repositories    []reportRepository
+}
+
+// buildSimilarityReport gathers everything the html report shows.
+// Families are found with DefaultFamilyOptions and named after their representative
+func buildSimilarityReport(graph *SimilarityTree, rows []utils.IdentityValue) similarityReport {
+	// sources are linked to their URL, unless it is a path or anything else that would turn into a relative link
+	urls := map[string]string{}
+	for _, v := range rows {
+		if isValidUrl(v.URL) {
+			urls[treeSource(v)] = v.URL
+		}
+	}
+
+	report := similarityReport{
+		Generated:       time.Now(),
+		RepositoryCount: len(graph.Leaves),
+	}
+
+	for _, f := range graph.Families(DefaultFamilyOptions) {
+		family := reportFamily{
+			ID:            f.ID,
+			Name:          f.Representative,
+			Repositories:  len(f.Members),
+			SharedCommits: f.SharedCommits,
+		}
+
+		type step struct {
+			node   *SimilarityTreeNode
+			shared int
+			depth  int
+		}
+		// the tree is walked with an explicit stack, so that deep trees can't overflow the goroutine stack
+		stack := []step{{f.root, len(f.root.FullValue()), 0}}
+		// the nodes in the order they were walked, so that the number of repositories under each of them can be
+		// added up from its children in a single pass back over them
+		walked := []step{}
+		for len(stack) > 0 {
+			s := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			r := reportNode{
+				Edge: collapseValue(s.node.Value(), defaultMaxEdgeLabel),
+				// keep the first few levels unfolded so there is something to look at without clicking
+				Open:  s.depth < 3,
+				Depth: s.depth,
+			}
+			atNode := graph.SourcesAt(s.node)
+			if len(atNode) > 0 {
+				r.Label = strconv.Itoa(s.shared) + " commits"
+			}
+			for _, source := range atNode {
+				r.Sources = append(r.Sources, reportSource{Name: source, URL: urls[source]})
+				mirrors := slices.DeleteFunc(slices.Clone(atNode), func(m string) bool { return m == source })
+				report.Repositories = append(report.Repositories, reportRepository{
+					Name:             source,
+					URL:              urls[source],
+					Family:           family.Name,
+					FamilyID:         family.ID,
+					Commits:          s.shared,
+					SharedWithFamily: family.SharedCommits,
+					Mirrors:          mirrors,
+				})
+				family.LongestHistory = max(family.LongestHistory, s.shared)
+			}
+			if len(atNode) > 1 {
+				family.Mirrors += len(atNode)
+			}
+			family.Nodes = append(family.Nodes, r)
+			walked = append(walked, s)
+			// families made up of just the mirrors at a node do not include what comes after it
+			if f.subtree {
+				// pushed in reverse so that the children come out in order
+				children := s.node.Children()
+				for i := len(children) - 1; i >= 0; i-- {
+					stack = append(stack, step{children[i], s.shared + children[i].Len(), s.depth + 1})
+				}
+			}
+		}
+		// children are walked after their parents, so going backwards sees every node after everything under it
+		under := map[*SimilarityTreeNode]int{}
+		for i := len(walked) - 1; i >= 0; i-- {
+			s := walked[i]
+			count := len(graph.index()[s.node])
+			if f.subtree {
+				for _, child := range s.node.Children() {
+					count += under[child]
+				}
+			}
+			under[s.node] = count
+			if family.Nodes[i].Label == "" {
+				family.Nodes[i].Label = strconv.Itoa(count) + " repositories share " + strconv.Itoa(s.shared) + " commits"
+			}
+		}
+		// a row closes its own <details> and those of the ancestors the next row is not inside of
+		for i := range family.Nodes {
+			next := 0
+			if i+1 < len(family.Nodes) {
+				next = family.Nodes[i+1].Depth
+			}
+			family.Nodes[i].Close = family.Nodes[i].Depth - next + 1
+		}
+		report.Families = append(report.Families, family)
+	}
+
+	slices.SortFunc(report.Repositories, func(a, b reportRepository) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return report
+}
+
+// WriteSimilarityReport renders a self-contained html report (no external scripts or styles) of the tree
+func WriteSimilarityReport(w io.Writer, graph *SimilarityTree, rows []utils.IdentityValue) error {
+	return similarityReportTemplate.Execute(w, buildSimilarityReport(graph, rows))
+}
+
+// WriteSimilarityReportToFile writes the html report to destination
+func WriteSimilarityReportToFile(destination string, graph *SimilarityTree, rows []utils.IdentityValue) error {
+	f, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	err = WriteSimilarityReport(f, graph, rows)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+func TestSimilarityReport(t *testing.T) {
+	rows := []utils.IdentityValue{
+		{Nickname: "a", URL: "https://example.com/a", LineageID: "0123456789"},
+		{Nickname: "mirror", URL: "https://example.com/mirror", LineageID: "0123456789"},
+		{Nickname: "b", URL: "https://example.com/b", LineageID: "01234567ab"},
+		{Nickname: "c", URL: "https://example.com/c", LineageID: "0123"},
+		{Nickname: "<script>", URL: "javascript:alert(1)", LineageID: "fedc"},
+	}
+	graph := NewSimilarityTree()
+	for _, v := range rows {
+		graph.Add(treeSource(v), v.LineageID)
+	}
+
+	report := buildSimilarityReport(&graph, rows)
+	if len(report.Families) != 2 || len(report.Repositories) != 5 {
+		t.Fatalf(`expected %d families and %d repositories, got %d and %d`, 2, 5, len(report.Families), len(report.Repositories))
+	}
+	family := report.Families[0]
+	if family.Name != "c" || family.Repositories != 4 || family.SharedCommits != 4 || family.LongestHistory != 10 || family.Mirrors != 2 {
+		t.Errorf(`unexpected family statistics %+v`, family)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSimilarityReport(&buf, &graph, rows); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{`<a href="https://example.com/mirror">mirror</a>`, `id="search"`, "&lt;script&gt;", "3 repositories share 8 commits"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf(`report is missing %q`, expected)
+		}
+	}
+	if strings.Contains(out, "javascript:alert") || strings.Contains(out, "<script>alert") {
+		t.Errorf(`report does not escape its contents`)
+	}
+	// everything is inline so the report works offline
+	if strings.Contains(out, "src=") || strings.Contains(out, "<link") {
+		t.Errorf(`report references external resources`)
+	}
+}
+
+func TestSimilarityReportLinks(t *testing.T) {
+	rows := []utils.IdentityValue{
+		{Nickname: "remote", URL: "https://example.com/remote", LineageID: "0123456789"},
+		{Nickname: "archive", URL: "/srv/archives/archive.bundle", LineageID: "0123456789ab"},
+		{Nickname: "bare", URL: "github.com/someone/bare", LineageID: "0123456789cd"},
+	}
+	graph := NewSimilarityTree()
+	for _, v := range rows {
+		graph.Add(treeSource(v), v.LineageID)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSimilarityReport(&buf, &graph, rows); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, `<a href="https://example.com/remote">remote</a>`) {
+		t.Errorf(`report does not link the repository with an absolute URL`)
+	}
+	// anything else would become a link relative to wherever the report is opened
+	for _, unlinked := range []string{"/srv/archives/archive.bundle", "github.com/someone/bare"} {
+		if strings.Contains(out, `href="`+unlinked) {
+			t.Errorf(`report links %q`, unlinked)
+		}
+	}
+}
+
+func TestSimilarityReportDeepTree(t *testing.T) {
+	depth := 10_000
+	graph := deepSimilarityGraph(depth)
+
+	var buf bytes.Buffer
+	if err := WriteSimilarityReport(&buf, &graph, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	// the fork off of the root is a family of its own, and the spine under it is the other one
+	if open, closed := strings.Count(out, "<details"), strings.Count(out, "</details>"); open != 2*depth || closed != open {
+		t.Errorf(`report opened %d and closed %d nodes, expected %d`, open, closed, 2*depth)
+	}
+	if !strings.Contains(out, `data-depth="`+strconv.Itoa(depth-1)+`"`) {
+		t.Errorf(`report does not reach the bottom of the tree`)
+	}
+	if label := strconv.Itoa(depth) + " repositories share 2 commits"; !strings.Contains(out, label) {
+		t.Errorf(`report is missing %q`, label)
+	}
+}
@@ -3,31 +3,98 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math/bits"
 	"slices"
 	"strconv"
 	"strings"
-
-	"github.com/MoralCode/CodeDNA/utils"
 )
 
 type SimilarityTreeNode struct {
-	Value string
-	// mapping of a prefix
-	children map[rune]*SimilarityTreeNode
-	Parent   *SimilarityTreeNode
+	// the part of the lineage ID this node adds to its parent's
+	label nibbles
+	// bit i is set when there is a child whose label starts with nibble i
+	childMask uint16
+	// the children, ordered by the first nibble of their label (i.e. by their bit in childMask)
+	kids []*SimilarityTreeNode
+	// whether a lineage ID ends at this node. Nodes without children are always leaves (except for an empty root),
+	// but lineage IDs can also end in the middle of the tree
+	leaf bool
+	// the number of commits (nibbles) in the full values of all ancestors, i.e. where the label starts within the lineage ID.
+	// Split() and Add() keep this up to date so that nothing has to walk up the tree to find it
+	offset uint32
+	Parent *SimilarityTreeNode
+}
+
+func newSimilarityTreeNode(label nibbles, parent *SimilarityTreeNode) *SimilarityTreeNode {
+	node := &SimilarityTreeNode{
+		label:  label,
+		Parent: parent,
+	}
+	if parent != nil {
+		node.offset = parent.end()
+	}
+	return node
+}
+
+// Value returns the part of the lineage ID this node adds to its parent's, as hex
+func (tree *SimilarityTreeNode) Value() string {
+	return tree.label.String()
+}
+
+// Len returns the number of commits (nibbles) in the value of this node
+func (tree *SimilarityTreeNode) Len() int {
+	return tree.label.Len()
+}
+
+// end returns the length of the full value of this node
+func (tree *SimilarityTreeNode) end() uint32 {
+	return tree.offset + uint32(tree.label.Len())
+}
+
+// childIndex returns where in kids the child starting with the given nibble is, or would have to be inserted
+func (tree *SimilarityTreeNode) childIndex(nibble byte) (int, bool) {
+	bit := uint16(1) << nibble
+	return bits.OnesCount16(tree.childMask & (bit - 1)), tree.childMask&bit != 0
+}
 
-	// [16]*SimilarityTree
+func (tree *SimilarityTreeNode) child(nibble byte) *SimilarityTreeNode {
+	if i, has := tree.childIndex(nibble); has {
+		return tree.kids[i]
+	}
+	return nil
+}
+
+// setChild adds a child, or replaces the one that starts with the same nibble
+func (tree *SimilarityTreeNode) setChild(child *SimilarityTreeNode) {
+	nibble := child.label.At(0)
+	i, has := tree.childIndex(nibble)
+	if has {
+		tree.kids[i] = child
+		return
+	}
+	tree.kids = slices.Insert(tree.kids, i, child)
+	tree.childMask |= 1 << nibble
+}
+
+func (tree *SimilarityTreeNode) removeChild(nibble byte) {
+	if i, has := tree.childIndex(nibble); has {
+		tree.kids = slices.Delete(tree.kids, i, i+1)
+		tree.childMask &^= 1 << nibble
+		if len(tree.kids) == 0 {
+			tree.kids = nil
+		}
+	}
 }
 
 // Split a node's value into two nodes at the point specified by the given length
 // This is done in a way that preserves the base node and returns the newly-split node as a value
 func (tree *SimilarityTreeNode) Split(split_length int) (*SimilarityTreeNode, error) {
 	// Step 0. Prerequisites
-	if len((*tree).Value) < 2 {
+	if tree.label.Len() < 2 {
 		return nil, errors.New("not enough characters in value to successfully split")
 	}
 
-	if split_length > len(tree.Value) {
+	if split_length > tree.label.Len() {
 		return nil, errors.New("split length too long to successfully split")
 	}
 
@@ -35,338 +102,292 @@ func (tree *SimilarityTreeNode) Split(split_length int) (*SimilarityTreeNode, er
 		return nil, errors.New("split length too short to successfully split")
 	}
 
-	// Step 1: Create
-	tail := SimilarityTreeNode{
-		Value:  (*tree).Value[split_length:],
-		Parent: tree,
-	}
-
-	newHeadValue := (*tree).Value[:split_length]
-	newHeadChildren := map[rune]*SimilarityTreeNode{
-		rune(tail.Value[0]): &tail,
+	// Step 1: Create the tail, which takes over the children and leaf status of the original node.
+	// Both halves keep pointing into the same bytes
+	tail := &SimilarityTreeNode{
+		label:     tree.label.Slice(split_length, tree.label.Len()),
+		childMask: tree.childMask,
+		kids:      tree.kids,
+		leaf:      tree.leaf,
+		offset:    tree.offset + uint32(split_length),
+		Parent:    tree,
 	}
-
-	// Step 2: Transfer Children
-	tail.children = (*tree).children
-
-	// Step 3: Update HEAD (the original node)
-	(*tree).children = newHeadChildren
-	(*tree).Value = newHeadValue
-
-	// Step 4: connect detached chain to TAIL
-	for _, child := range tail.children {
-		child.Parent = &tail
+	for _, child := range tail.kids {
+		child.Parent = tail
 	}
 
-	// Step 5: Cleanup
-	// jk golang is garbage collected so this should just happen :tm:
+	// Step 2: Update HEAD (the original node)
+	tree.label = tree.label.Slice(0, split_length)
+	tree.kids = []*SimilarityTreeNode{tail}
+	tree.childMask = 1 << tail.label.At(0)
+	tree.leaf = false
 
-	return &tail, nil
-}
-
-// internal function to add a null node to the given tree node
-// this is only meant to be internal behavior, not something that general
-// consumers of this tree structure should need to do
-func (tree *SimilarityTreeNode) addNullNode() (*SimilarityTreeNode, error) {
-	lookupVal, hasLookup := tree.children[rune(0)]
-	if hasLookup {
-		return lookupVal, nil
-	} else {
-		nullNode := SimilarityTreeNode{
-			Parent:   tree,
-			children: map[rune]*SimilarityTreeNode{},
-			Value:    "",
-		}
-		tree.children[rune(0)] = &nullNode
-		return &nullNode, nil
-	}
+	return tail, nil
 }
 
 // Add new nodes to the tree until the entire value has been added
 // Returns:
 //  1. the node that represents the value being added (either created or existing)
-//  2. Any Auxiliary nodes that were created (such as the tail portion of a split node, or the null node for an add)
+//  2. the tail portion of a node that had to be split, if any
 //  3. error (if any)
 func (tree *SimilarityTreeNode) Add(value string) (*SimilarityTreeNode, *SimilarityTreeNode, error) {
+	parsed, err := parseNibbles(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree.add(parsed)
+}
 
-	inValueLen := len(value)
-	treeValueLen := len(tree.Value)
-	sharedPrefixLen := len(utils.GetLongestPrefix(value, tree.Value))
-	maxPossiblePrefixLen := min(inValueLen, treeValueLen)
-
+func (tree *SimilarityTreeNode) add(value nibbles) (*SimilarityTreeNode, *SimilarityTreeNode, error) {
 	// if no value left, base case
-	if inValueLen == 0 {
+	if value.Len() == 0 {
 		// dont try and return nil if we called this on the root node (which has no parent)
 		if tree.Parent != nil {
 			return tree.Parent, nil, nil
 		} else {
 			return tree, nil, nil
 		}
-		//We do not create a new null node here since calling Add() with
-		// a value of len 0 (empty string) is not considered valid.
-		// null nodes should only be created when theres an exact value match with an existing node for some real value
+		// Adding an empty value is not considered valid, so this does not mark anything as a leaf
 	}
 
-	if sharedPrefixLen > maxPossiblePrefixLen {
-		return nil, nil, errors.New("shared prefix has exceeded its maximum possible length")
-	} else if sharedPrefixLen < maxPossiblePrefixLen {
-		//partial match but both the tree and incoming value have more to go
-		// so split and create a new child
-		newSplit, err := (*tree).Split(sharedPrefixLen)
-		if err != nil {
-			return nil, nil, err
-		}
+	for node := tree; ; {
+		inValueLen := value.Len()
+		treeValueLen := node.label.Len()
 
-		newSubValue := value[sharedPrefixLen:]
-		// create a new node representing the differing part of the value
-		node := SimilarityTreeNode{
-			Parent:   tree,
-			children: map[rune]*SimilarityTreeNode{}, //empty map
-			Value:    newSubValue,
-		}
-		// add it to the now-split root node
-		(*tree).children[rune(newSubValue[0])] = &node
-		return &node, newSplit, nil
+		sharedPrefixLen := commonPrefixLength(value, node.label)
+		maxPossiblePrefixLen := min(inValueLen, treeValueLen)
 
-	} else if sharedPrefixLen == maxPossiblePrefixLen {
-		if inValueLen < treeValueLen {
-			// perfect match for part of this node
-			// split
-			newSplit, err := (*tree).Split(sharedPrefixLen)
+		if sharedPrefixLen < maxPossiblePrefixLen {
+			//partial match but both the tree and incoming value have more to go
+			// so split and create a new child
+			newSplit, err := node.Split(sharedPrefixLen)
 			if err != nil {
 				return nil, nil, err
 			}
 
-			_, err = tree.addNullNode()
+			// create a new node representing the differing part of the value
+			// and add it to the now-split node
+			child := newSimilarityTreeNode(value.Slice(sharedPrefixLen, inValueLen), node)
+			child.leaf = true
+			node.setChild(child)
+			return child, newSplit, nil
+		}
+
+		if inValueLen < treeValueLen {
+			// perfect match for part of this node
+			// split, and the head is where the value ends
+			newSplit, err := node.Split(sharedPrefixLen)
 			if err != nil {
 				return nil, nil, err
 			}
-			return tree, newSplit, nil
+			node.leaf = true
+			return node, newSplit, nil
 
 		} else if inValueLen == treeValueLen {
 			// this node matches the value perfectly with no leftovers. search complete
-			// Create null node, but still return the current node as primary
-			nullNode, err := tree.addNullNode()
-			if err != nil {
-				return nil, nil, err
-			}
-			return tree, nullNode, nil
-		} else if inValueLen > treeValueLen {
-			// search limited by current tree value, traverse into children
-			lookupRune := rune(value[sharedPrefixLen])
-			lookupVal, hasLookup := tree.children[lookupRune]
-			if hasLookup {
-				return (*lookupVal).Add(value[sharedPrefixLen:])
-			} else {
-				// no sub value exists, create it
-				node := SimilarityTreeNode{
-					Parent:   tree,
-					children: map[rune]*SimilarityTreeNode{}, //empty map
-					Value:    value[sharedPrefixLen:],
-				}
-				tree.children[lookupRune] = &node
-				return &node, nil, nil
-			}
+			node.leaf = true
+			return node, nil, nil
+		}
+
+		// search limited by current tree value, traverse into children
+		value = value.Slice(sharedPrefixLen, inValueLen)
+		child := node.child(value.At(0))
+		if child == nil {
+			// no sub value exists, create it
+			child = newSimilarityTreeNode(value, node)
+			child.leaf = true
+			node.setChild(child)
+			return child, nil, nil
 		}
+		node = child
 	}
-	return nil, nil, errors.New("add finished without result. This is not supposed to happen")
 }
 
 // Traverse down the tree to find the leaf node representing the given value
 func (tree *SimilarityTreeNode) Find(value string) (*SimilarityTreeNode, error) {
-	inValueLen := len(value)
-	treeValueLen := len(tree.Value)
-	// sharedPrefix :=
-	sharedPrefixLen := len(utils.GetLongestPrefix(value, tree.Value))
-	maxPossiblePrefixLen := min(inValueLen, treeValueLen)
+	parsed, err := parseNibbles(value)
+	if err != nil {
+		return nil, err
+	}
+	return tree.find(parsed)
+}
 
-	if inValueLen == 0 {
+func (tree *SimilarityTreeNode) find(value nibbles) (*SimilarityTreeNode, error) {
+	if value.Len() == 0 {
 		// value found (prior node)
-		// dont try and return nil if we called this on the root node (which has no parent)\
+		// dont try and return nil if we called this on the root node (which has no parent)
 		if tree.Parent != nil {
 			return tree.Parent, nil
 		} else {
 			return tree, nil
 		}
-	} else if sharedPrefixLen < maxPossiblePrefixLen {
-		return nil, errors.New("node does not exist. matches stopped in the middle of a node")
+	}
 
-	} else if sharedPrefixLen == maxPossiblePrefixLen {
-		if inValueLen < treeValueLen {
+	for node := tree; ; {
+		inValueLen := value.Len()
+		treeValueLen := node.label.Len()
+
+		sharedPrefixLen := commonPrefixLength(value, node.label)
+		maxPossiblePrefixLen := min(inValueLen, treeValueLen)
+
+		if sharedPrefixLen < maxPossiblePrefixLen {
+			return nil, errors.New("node does not exist. matches stopped in the middle of a node")
+		} else if inValueLen < treeValueLen {
 			// perfect match for part of this node
 			return nil, errors.New("node does not exist. search key was exhausted in the middle of a node")
-
 		} else if inValueLen == treeValueLen {
 			// this node matches the value perfectly with no leftovers. search complete
-			return tree, nil
+			return node, nil
+		}
 
-		} else if inValueLen > treeValueLen {
-			// search limited by node value, traverse into children
-			lookupRune := rune(value[sharedPrefixLen])
-			lookupVal, hasLookup := tree.children[lookupRune]
-			if hasLookup {
-				return (*lookupVal).Find(value[sharedPrefixLen:])
-			} else {
-				// no sub value exists, error
-				return nil, errors.New("node does not exist. child could not be found")
-			}
+		// search limited by node value, traverse into children
+		value = value.Slice(sharedPrefixLen, inValueLen)
+		node = node.child(value.At(0))
+		if node == nil {
+			// no sub value exists, error
+			return nil, errors.New("node does not exist. child could not be found")
 		}
 	}
-	return nil, errors.New("search finished without result")
 }
 
 func (tree *SimilarityTreeNode) IsLeaf() bool {
-	return len(tree.children) == 0 || tree.children[rune(0)] != nil
+	return tree.leaf
 }
 
 // Get the "full value" of this node (its value, prefixed with the value of all of its parents)
 func (tree *SimilarityTreeNode) FullValue() string {
-	// base case: root node
-	if tree.Parent == nil {
-		return tree.Value
-	}
-
-	return tree.Parent.FullValue() + tree.Value
+	return tree.FullValueTo(nil)
 }
 
-// Get the "full value" of this node (its value, prefixed with the value of all of its parents)
+// Print this node and everything under it, indented by level
 func (tree *SimilarityTreeNode) Print(level int) {
+	tree.print(level, nil)
+}
 
-	indents := strings.Repeat("\t", level)
-	valLen := len(tree.Value)
-
-	val := ""
-	if valLen == 0 {
-		val = "<empty value>"
-	} else if valLen < 10 {
-		val = tree.Value
-	} else {
-		val = tree.Value[0:5] + "..." + tree.Value[valLen-5:] + " (" + strconv.Itoa(valLen) + ")"
-	}
-	if tree.IsLeaf() {
-		val += " [LEAF]"
-	}
-
-	fmt.Println(indents+"Value:", val)
-	for k, v := range tree.children {
-		if k != rune(0) {
-			fmt.Println(indents + "Child " + string(k) + ":")
-			v.Print(level + 1)
+// print is Print with an optional function providing the labels (sources) to show next to leaves.
+// The tree is walked with an explicit stack, so that deep trees can't overflow the goroutine stack
+func (tree *SimilarityTreeNode) print(level int, labels func(*SimilarityTreeNode) []string) {
+	type step struct {
+		node  *SimilarityTreeNode
+		level int
+	}
+	stack := []step{{tree, level}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		indents := strings.Repeat("\t", s.level)
+		valLen := s.node.Len()
+		value := s.node.Value()
+
+		val := ""
+		if valLen == 0 {
+			val = "<empty value>"
+		} else if valLen < 10 {
+			val = value
+		} else {
+			val = value[0:5] + "..." + value[valLen-5:] + " (" + strconv.Itoa(valLen) + ")"
+		}
+		if s.node.IsLeaf() {
+			val += " [LEAF]"
+		}
+		if labels != nil {
+			if sources := labels(s.node); len(sources) > 0 {
+				val += " " + strings.Join(sources, ", ")
+			}
 		}
 
+		if s.node != tree {
+			fmt.Println(strings.Repeat("\t", s.level-1) + "Child " + string(hexDigits[s.node.label.At(0)]) + ":")
+		}
+		fmt.Println(indents+"Value:", val)
+		// pushed in reverse so that the children are printed in order
+		for i := len(s.node.kids) - 1; i >= 0; i-- {
+			stack = append(stack, step{s.node.kids[i], s.level + 1})
+		}
 	}
 }
 
-// Get the "full value" of this node (its value, prefixed with the value of all of its parents)
+// Get the value of this node prefixed with the values of its parents, up to (but not including) the given node.
+// If node is not an ancestor, this is the full value
 func (tree *SimilarityTreeNode) FullValueTo(node *SimilarityTreeNode) string {
-
-	//base case: we found the target node
-	if tree == node {
-		return ""
+	// where the value starts within the full value, so that it can be filled in from the bottom up
+	// with each part only copied once
+	var stop uint32
+	for p := tree; p != nil; p = p.Parent {
+		if p == node {
+			stop = p.end()
+			break
+		}
 	}
-
-	//other base case: root node
-	if tree.Parent == nil {
-		return tree.Value
+	buf := make([]byte, tree.end()-stop)
+	for p := tree; p != nil && p != node; p = p.Parent {
+		p.label.putHex(buf[p.offset-stop:])
 	}
-
-	return tree.Parent.FullValueTo(node) + tree.Value
+	return string(buf)
 }
 
 // Get the "distance" of this node to the root
 func (tree *SimilarityTreeNode) Distance() int {
-	// base case: root node
-	if tree.Parent == nil {
-		return 0
-	}
-
-	return tree.Parent.Distance() + 1
+	return tree.DistanceTo(nil)
 }
 
+// Get the number of nodes between this node and the given ancestor (or the root, if node is not an ancestor)
 func (tree *SimilarityTreeNode) DistanceTo(node *SimilarityTreeNode) int {
-	// base case: root node
-	if tree.Parent == nil {
-		return 0
-	}
-
-	// base case, target node found
-	if tree == node {
-		return 0
+	distance := 0
+	for p := tree; p.Parent != nil && p != node; p = p.Parent {
+		distance++
 	}
-
-	return tree.Parent.DistanceTo(node) + 1
+	return distance
 }
 
 // Get the "distance" of this node to the root
 func (tree *SimilarityTreeNode) NodeCount() int {
-	// base case: no children
-	if len(tree.children) == 0 {
-		return 1 // self
-	}
-
-	totalSubNodes := 0
-	for _, n := range tree.Children() {
-		totalSubNodes += n.NodeCount()
-	}
-	return totalSubNodes + 1
+	count := 0
+	stack := []*SimilarityTreeNode{tree}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = append(stack[:len(stack)-1], node.kids...)
+		count++
+	}
+	return count
 }
 
 func (tree *SimilarityTreeNode) Siblings() []*SimilarityTreeNode {
 	if tree.Parent == nil {
 		return []*SimilarityTreeNode{}
 	}
-
-	siblingMap := tree.Parent.children
-
-	v := make([]*SimilarityTreeNode, 0, len(siblingMap))
-
-	for key, value := range siblingMap {
-		// exclude null nodes because those only serve as pointers from the leaf detection parts of the graph
-		if key != rune(0) {
-			v = append(v, value)
-		}
-	}
-	return v
+	return slices.Clone(tree.Parent.kids)
 }
 
+// Family returns the full value of the closest ancestor where the history of this node is shared
+// with some other repository, i.e. a node that branches or that another repository ends at.
+// Returns "orphan" if the history is not shared with anything.
+// See SimilarityTree.Families for grouping repositories into families
 func (tree *SimilarityTreeNode) Family() string {
-	parents := tree.parentChain()
-
-	for _, p := range parents {
-		if p.Parent != nil && p.Parent.Parent != nil && len(p.Children()) > 0 {
-			return p.Parent.FullValueTo(p.Parent.Parent)
-		} else if p.Parent != nil && p.Parent.Parent != nil && len(p.Children()) > 0 {
-			return p.Parent.FullValue()
-		} else if p.Parent == nil {
-			return "orphan"
+	for p := tree.Parent; p != nil && p.Parent != nil; p = p.Parent {
+		if len(p.kids) > 1 || p.leaf {
+			return p.FullValue()
 		}
 	}
 	return "orphan"
 }
 
-// Allow callers to query the children of a node in the tree
-// the purpose of this function is to both be an abstraction,
-// and to filter out null nodes as they are an internal construct
+// Allow callers to query the children of a node in the tree, ordered by the first nibble of their value.
+// The returned slice belongs to the node and must not be modified
 func (tree *SimilarityTreeNode) Children() []*SimilarityTreeNode {
-	childNodes := []*SimilarityTreeNode{}
-	for k, v := range tree.children {
-		if k != rune(0) {
-			childNodes = append(childNodes, v)
-		}
-	}
-	return childNodes
+	return tree.kids
 }
 
 // Allow callers to query the presence of children in the tree
-// the purpose of this function is to pass through the "has" capability
-// of the golang map underlying this structure since it is private
+// by the hex digit their value starts with
 func (tree *SimilarityTreeNode) Child(value rune) (*SimilarityTreeNode, bool) {
-	if value == rune(0) {
+	nibble := strings.IndexRune(hexDigits, value)
+	if nibble < 0 {
 		return nil, false
 	}
-
-	child, has := tree.children[value]
-	return child, has
+	child := tree.child(byte(nibble))
+	return child, child != nil
 }
 
 // Return all leaf nodes in a particular part of the tree.
@@ -374,82 +395,84 @@ func (tree *SimilarityTreeNode) Child(value rune) (*SimilarityTreeNode, bool) {
 // Since these identifiers can end in the middle of other identifiers
 // (such as an old abandoned repo that was later picked up by a new maintainer but the original remains as is)
 // We expand the traditional "computer science" definition of leaf nodes (i.e. nodes that have no children)
-// to also include nodes that are parents of a null node (child with a key of rune(0)), thus allowing "leaf nodes"
+// to any node with the leaf flag set, thus allowing "leaf nodes"
 // to exist mid-tree (making them more similar to git branches than traditional leaf nodes)
 func (tree *SimilarityTreeNode) Leaves() []*SimilarityTreeNode {
 	leaves := make([]*SimilarityTreeNode, 0, 5)
-	// base case: we are a leaf
-	if len(tree.children) == 0 {
-		leaves = append(leaves, tree)
-
-	} else {
-
-		for key, child := range tree.children {
-			if key == rune(0) {
-				// if we encounter a null node, that means the parent (i.e. the current tree) is also a leaf node
-				leaves = append(leaves, tree)
-			} else {
-				leaves = append(leaves, child.Leaves()...)
-			}
+	// depth first, in the order of the children
+	stack := []*SimilarityTreeNode{tree}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if node.leaf {
+			leaves = append(leaves, node)
+		}
+		for i := len(node.kids) - 1; i >= 0; i-- {
+			stack = append(stack, node.kids[i])
 		}
 	}
-	// TODO: handle leaf values that end in the middle of a tree, perfectly on a node but where that node also has children
-	// maybe this could use the null rune(0) value as the key?
 	return leaves
 }
 
+// TreePath returns the first commit (nibble) of the value of every node from the root down to this one
 func (tree *SimilarityTreeNode) TreePath() string {
-	// base case: root node
-	if tree.Parent == nil {
-		if len(tree.Value) == 0 {
-			return ""
-		} else {
-			return string(tree.Value[0])
+	length := 0
+	for p := tree; p != nil; p = p.Parent {
+		if p.label.Len() > 0 {
+			length++
 		}
 	}
-
-	return tree.Parent.TreePath() + string(tree.Value[0])
+	buf := make([]byte, length)
+	for p := tree; p != nil; p = p.Parent {
+		if p.label.Len() > 0 {
+			length--
+			buf[length] = hexDigits[p.label.At(0)]
+		}
+	}
+	return string(buf)
 }
 
+// parentChain returns this node followed by all of its ancestors, ending with the root
 func (tree *SimilarityTreeNode) parentChain() []*SimilarityTreeNode {
-	// base case: root node
-	if tree.Parent == nil {
-		return []*SimilarityTreeNode{tree}
+	chain := make([]*SimilarityTreeNode, 0, tree.Distance()+1)
+	for p := tree; p != nil; p = p.Parent {
+		chain = append(chain, p)
 	}
-
-	return append([]*SimilarityTreeNode{tree}, tree.Parent.parentChain()...)
+	return chain
 }
 
 // Find the closest common ancestor
 func (a *SimilarityTreeNode) CommonAncestorWith(b *SimilarityTreeNode) (*SimilarityTreeNode, error) {
-
-	chain := a.parentChain()
-
-	parent := b
-
-	for parent != nil {
-		if idx := slices.Index(chain, parent); idx > -1 {
-			return parent, nil
+	// full values only get longer going down the tree, so whichever node has the longer one cannot be
+	// an ancestor of the other. Two different nodes with the same length are on different branches
+	for a != nil && b != nil && a != b {
+		endA, endB := a.end(), b.end()
+		if endA >= endB {
+			a = a.Parent
 		}
-		parent = parent.Parent
+		if endB >= endA {
+			b = b.Parent
+		}
+	}
+	if a == nil || b == nil {
+		return nil, errors.New("no shared parentage between the nodes")
 	}
-	return nil, errors.New("no shared parentage between the nodes")
+	return a, nil
 }
 
+// SimilarityScore is the number of commits either node has since they diverged (MetricDistance).
+// See LineageComparison for metrics that take the amount of shared history into account
 func (root *SimilarityTreeNode) SimilarityScore(source1Node *SimilarityTreeNode, source2Node *SimilarityTreeNode) (int, error) {
 
 	commonAncestor, err := source1Node.CommonAncestorWith(source2Node)
 	if err != nil {
 		return -1, errors.Join(errors.New("failed to calculate common ancestor"), err)
 	}
-	// source1IndependentDistance := source1Node.DistanceTo(commonAncestor)
-	// source2IndependentDistance := source2Node.DistanceTo(commonAncestor)
-
-	source1IndependentDistance := len(source1Node.FullValueTo(commonAncestor))
-	source2IndependentDistance := len(source2Node.FullValueTo(commonAncestor))
+	// the commits each node has since the common ancestor, i.e. len(FullValueTo(commonAncestor))
+	source1IndependentDistance := source1Node.end() - commonAncestor.end()
+	source2IndependentDistance := source2Node.end() - commonAncestor.end()
 
-	fmt.Println(len(commonAncestor.FullValueTo(root)))
-	return source1IndependentDistance + source2IndependentDistance, nil
+	return int(source1IndependentDistance + source2IndependentDistance), nil
 
 }
 
@@ -461,28 +484,206 @@ type SimilarityTree struct {
 	Root *SimilarityTreeNode
 	// map source to the leaf node
 	Leaves map[string]*SimilarityTreeNode
+	// the reverse of Leaves: every source whose leaf is a given node.
+	// More than one source at a node means those repositories are exact mirrors of each other
+	sources map[*SimilarityTreeNode][]string
 }
 
 func NewSimilarityTree() SimilarityTree {
 	return SimilarityTree{
-		Root: &SimilarityTreeNode{
-			Value:    "",
-			children: map[rune]*SimilarityTreeNode{},
-			Parent:   nil,
-		},
-		Leaves: map[string]*SimilarityTreeNode{},
+		Root:    newSimilarityTreeNode(nibbles{}, nil),
+		Leaves:  map[string]*SimilarityTreeNode{},
+		sources: map[*SimilarityTreeNode][]string{},
+	}
+}
+
+// setLeaf points a source at a node, keeping Leaves and the sources index in sync
+func (graph *SimilarityTree) setLeaf(source string, node *SimilarityTreeNode) {
+	graph.unsetLeaf(source)
+	if graph.Leaves == nil {
+		graph.Leaves = map[string]*SimilarityTreeNode{}
 	}
+	graph.Leaves[source] = node
+	graph.index()[node] = append(graph.index()[node], source)
+}
+
+func (graph *SimilarityTree) unsetLeaf(source string) {
+	node, has := graph.Leaves[source]
+	if !has {
+		return
+	}
+	delete(graph.Leaves, source)
+	remaining := slices.DeleteFunc(graph.index()[node], func(s string) bool { return s == source })
+	if len(remaining) == 0 {
+		delete(graph.sources, node)
+	} else {
+		graph.sources[node] = remaining
+	}
+}
+
+// moveLeaves repoints every source at one node to another node
+func (graph *SimilarityTree) moveLeaves(from *SimilarityTreeNode, to *SimilarityTreeNode) {
+	moved := graph.index()[from]
+	delete(graph.sources, from)
+	for _, source := range moved {
+		graph.Leaves[source] = to
+	}
+	if len(moved) > 0 {
+		graph.sources[to] = append(graph.sources[to], moved...)
+	}
+}
+
+// index returns the sources index, (re)building it from Leaves for trees that were not created by NewSimilarityTree
+func (graph *SimilarityTree) index() map[*SimilarityTreeNode][]string {
+	if graph.sources == nil {
+		graph.sources = map[*SimilarityTreeNode][]string{}
+		for source, node := range graph.Leaves {
+			graph.sources[node] = append(graph.sources[node], source)
+		}
+	}
+	return graph.sources
+}
+
+// SourcesAt lists (in sorted order) every source whose lineage ID ends exactly at the given node
+func (graph *SimilarityTree) SourcesAt(node *SimilarityTreeNode) []string {
+	sources := slices.Clone(graph.index()[node])
+	slices.Sort(sources)
+	return sources
+}
+
+// SourcesUnder lists (in sorted order) every source whose leaf is the given node or any of its descendants,
+// i.e. every repository whose history contains the full value of the node
+func (graph *SimilarityTree) SourcesUnder(node *SimilarityTreeNode) []string {
+	sources := []string{}
+	stack := []*SimilarityTreeNode{node}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = append(stack[:len(stack)-1], n.kids...)
+		sources = append(sources, graph.index()[n]...)
+	}
+	slices.Sort(sources)
+	return sources
+}
+
+// compareByLength orders sources by the length of their lineage, then by name
+func compareByLength(graph *SimilarityTree, a string, b string) int {
+	lengthA, lengthB := int(graph.Leaves[a].end()), int(graph.Leaves[b].end())
+	if lengthA != lengthB {
+		return lengthA - lengthB
+	}
+	return strings.Compare(a, b)
+}
+
+// Mirrors returns every group of sources that share an identical lineage ID.
+// Each group is sorted, and groups are ordered by their first source
+func (graph *SimilarityTree) Mirrors() [][]string {
+	groups := [][]string{}
+	for node := range graph.index() {
+		if sources := graph.SourcesAt(node); len(sources) > 1 {
+			groups = append(groups, sources)
+		}
+	}
+	slices.SortFunc(groups, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	return groups
+}
+
+// Print the tree like SimilarityTreeNode.Print, but with the sources at each leaf
+func (graph *SimilarityTree) Print() {
+	graph.Root.print(0, graph.SourcesAt)
 }
 
 func (graph *SimilarityTree) Add(source string, identifier string) error {
+	value, err := parseNibbles(identifier)
+	if err != nil {
+		return err
+	}
 	existingLeaf, has := graph.Leaves[source]
-	var newNode *SimilarityTreeNode
-	newNode, _, err := graph.Root.Add(identifier)
+	if has && existingLeaf.FullValue() != value.String() {
+		// the lineage of this source changed, so its old path has to go
+		err := graph.Remove(source)
+		if err != nil {
+			return err
+		}
+		has = false
+	}
+	newNode, splitTail, err := graph.Root.add(value)
 	if err != nil {
 		return err
 	}
+	// Split() keeps the original node as the head, so any leaves that pointed at the original node
+	// (i.e. its full value) now belong to the tail
+	if splitTail != nil {
+		head := splitTail.Parent
+		graph.moveLeaves(head, splitTail)
+		if existingLeaf == head {
+			existingLeaf = splitTail
+		}
+	}
 	if !has || existingLeaf != newNode {
-		graph.Leaves[source] = newNode
+		graph.setLeaf(source, newNode)
 	}
 	return nil
 }
+
+// Remove a source from the tree.
+// If no other source shares its leaf, the leaf stops being one: nodes left without children are pruned
+// and nodes left with a single child are merged back together with it,
+// so that the tree stays exactly as compressed as if the source had never been added
+func (graph *SimilarityTree) Remove(source string) error {
+	node, has := graph.Leaves[source]
+	if !has {
+		return errors.New("source is not part of the tree")
+	}
+	graph.unsetLeaf(source)
+
+	if len(graph.index()[node]) > 0 {
+		// still a leaf for another source (i.e. a mirror)
+		return nil
+	}
+
+	node.leaf = false
+	for node.Parent != nil {
+		if len(node.kids) == 0 {
+			// nothing left below this node, and nothing points at it
+			parent := node.Parent
+			parent.removeChild(node.label.At(0))
+			node.Parent = nil
+			node = parent
+			if node.leaf {
+				break
+			}
+			continue
+		}
+		if !node.leaf && len(node.kids) == 1 {
+			graph.mergeWithOnlyChild(node)
+		}
+		break
+	}
+	return nil
+}
+
+// mergeWithOnlyChild undoes a Split(): it folds the only child of a node back into it.
+// Leaves pointing at the child now point at the merged node, which represents the same full value
+func (graph *SimilarityTree) mergeWithOnlyChild(node *SimilarityTreeNode) {
+	child := node.kids[0]
+
+	node.label = concat(node.label, child.label)
+	node.kids = child.kids
+	node.childMask = child.childMask
+	node.leaf = child.leaf
+	for _, grandchild := range node.kids {
+		grandchild.Parent = node
+	}
+	graph.moveLeaves(child, node)
+	child.Parent = nil
+	child.kids = nil
+}
+
+// Update changes the lineage ID of a source that is already part of the tree,
+// cleaning up the path to its old leaf the same way Remove does
+func (graph *SimilarityTree) Update(source string, identifier string) error {
+	if _, has := graph.Leaves[source]; !has {
+		return errors.New("source is not part of the tree")
+	}
+	return graph.Add(source, identifier)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// syntheticLineageIDs generates n lineage IDs shaped like a cache full of forge repositories:
+// families of forks that branch off of an upstream at random points, next to a lot of unrelated projects
+func syntheticLineageIDs(n int, seed int64) []string {
+	random := rand.New(rand.NewSource(seed))
+	randomHex := func(length int) []byte {
+		id := make([]byte, length)
+		for i := range id {
+			id[i] = hexDigits[random.Intn(16)]
+		}
+		return id
+	}
+
+	ids := make([]string, 0, n)
+	for len(ids) < n {
+		upstream := randomHex(50 + random.Intn(400))
+		ids = append(ids, string(upstream))
+		// most projects have no forks, a few have many
+		forks := 0
+		if random.Intn(4) == 0 {
+			forks = random.Intn(30)
+		}
+		for i := 0; i < forks && len(ids) < n; i++ {
+			split := 1 + random.Intn(len(upstream))
+			fork := append(append([]byte{}, upstream[:split]...), randomHex(random.Intn(50))...)
+			ids = append(ids, string(fork))
+		}
+	}
+	return ids
+}
+
+func BenchmarkSimilarityTreeAdd(b *testing.B) {
+	for _, n := range []int{10_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			if testing.Short() && n > 100_000 {
+				b.Skip("skipping the largest dataset in short mode")
+			}
+			ids := syntheticLineageIDs(n, 1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				graph := NewSimilarityTree()
+				for j, id := range ids {
+					// fresh copies, as if the rows were just read from the cache, so that whatever
+					// the tree keeps of them counts towards its memory use
+					if err := graph.Add(strconv.Itoa(j), strings.Clone(id)); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.StopTimer()
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(len(ids)), "heap-bytes/repo")
+				runtime.KeepAlive(graph)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(ids)), "ns/repo")
+		})
+	}
+}
+
+// deepSimilarityTree builds the worst case for walking up the tree: a spine of depth nodes with two-commit values,
+// each of which has a fork branching off of it, as if a repository had been forked after nearly every commit.
+// Returns the root and the leaf at the end of the spine
+func deepSimilarityTree(depth int) (*SimilarityTreeNode, *SimilarityTreeNode) {
+	root := newSimilarityTreeNode(nibbles{}, nil)
+	node := root
+	for i := 0; i < depth; i++ {
+		spine := newSimilarityTreeNode(mustParseNibbles("0"+string(hexDigits[i%16])), node)
+		fork := newSimilarityTreeNode(mustParseNibbles("1"+string(hexDigits[i%16])), node)
+		fork.leaf = true
+		node.setChild(spine)
+		node.setChild(fork)
+		node = spine
+	}
+	node.leaf = true
+	return root, node
+}
+
+// deepSimilarityGraph is deepSimilarityTree with a source at each of its leaves, named after its position in Leaves()
+func deepSimilarityGraph(depth int) SimilarityTree {
+	root, _ := deepSimilarityTree(depth)
+	graph := SimilarityTree{Root: root, Leaves: map[string]*SimilarityTreeNode{}}
+	for i, l := range root.Leaves() {
+		graph.Leaves[strconv.Itoa(i)] = l
+	}
+	return graph
+}
+
+func BenchmarkDeepTree(b *testing.B) {
+	for _, depth := range []int{1_000, 10_000, 100_000} {
+		root, leaf := deepSimilarityTree(depth)
+		fork, _ := leaf.Parent.Child('1')
+		// every benchmark reports the time per level of the tree, which stays flat if the walk is linear
+		perLevel := func(b *testing.B) {
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*depth), "ns/level")
+		}
+		b.Run(fmt.Sprintf("FullValue/%d", depth), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				leaf.FullValue()
+			}
+			perLevel(b)
+		})
+		b.Run(fmt.Sprintf("Distance/%d", depth), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				leaf.Distance()
+			}
+			perLevel(b)
+		})
+		b.Run(fmt.Sprintf("TreePath/%d", depth), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				leaf.TreePath()
+			}
+			perLevel(b)
+		})
+		b.Run(fmt.Sprintf("SimilarityScore/%d", depth), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				root.SimilarityScore(leaf, fork)
+			}
+			perLevel(b)
+		})
+		b.Run(fmt.Sprintf("Leaves/%d", depth), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				root.Leaves()
+			}
+			perLevel(b)
+		})
+		b.Run(fmt.Sprintf("NodeCount/%d", depth), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				root.NodeCount()
+			}
+			perLevel(b)
+		})
+	}
+}
+
+func BenchmarkBuildSimilarityTree(b *testing.B) {
+	for _, n := range []int{10_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			if testing.Short() && n > 100_000 {
+				b.Skip("skipping the largest dataset in short mode")
+			}
+			ids := map[string]string{}
+			for j, id := range syntheticLineageIDs(n, 1) {
+				ids[strconv.Itoa(j)] = id
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := BuildSimilarityTree(ids); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(ids)), "ns/repo")
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"slices"
+)
+
+// sortedLineage is a lineage ID along with the source it belongs to
+type sortedLineage struct {
+	source string
+	id     nibbles
+	// the first 8 bytes of the ID, which is all that most comparisons need to look at
+	key uint64
+}
+
+// compareLineageIDs orders packed lineage IDs by their nibbles, with prefixes before the IDs they are a prefix of.
+// Packed IDs start at the high half of their first byte and are padded with zeros, so comparing the bytes gives
+// the same order as comparing the nibbles, except that a prefix padded out to a whole byte ties with the longer ID
+func compareLineageIDs(a nibbles, b nibbles) int {
+	return cmp.Or(
+		bytes.Compare(a.data, b.data),
+		cmp.Compare(a.Len(), b.Len()),
+	)
+}
+
+// sortLineages parses a set of lineage IDs (keyed by source) and sorts them, see compareLineageIDs.
+// Sources with the same lineage ID are sorted by name
+func sortLineages(ids map[string]string) ([]sortedLineage, error) {
+	entries := make([]sortedLineage, 0, len(ids))
+	for source, id := range ids {
+		parsed, err := parseNibbles(id)
+		if err != nil {
+			return nil, err
+		}
+		var key [8]byte
+		copy(key[:], parsed.data)
+		entries = append(entries, sortedLineage{source, parsed, binary.BigEndian.Uint64(key[:])})
+	}
+	slices.SortFunc(entries, func(a, b sortedLineage) int {
+		if a.key != b.key {
+			return cmp.Compare(a.key, b.key)
+		}
+		return cmp.Or(
+			compareLineageIDs(a.id, b.id),
+			cmp.Compare(a.source, b.source),
+		)
+	})
+	return entries, nil
+}
+
+// BuildSimilarityTree builds the tree of a whole set of lineage IDs (keyed by source) at once.
+// It produces the same tree as adding every ID to an empty tree one at a time, but does so in a single pass:
+// lineage IDs start with the oldest commit, so once they are sorted every ID shares the longest possible prefix
+// with the one before it, and only ever branches off of the path that was added last
+func BuildSimilarityTree(ids map[string]string) (SimilarityTree, error) {
+	entries, err := sortLineages(ids)
+	if err != nil {
+		return SimilarityTree{}, err
+	}
+
+	graph := NewSimilarityTree()
+	graph.Leaves = make(map[string]*SimilarityTreeNode, len(entries))
+	graph.sources = make(map[*SimilarityTreeNode][]string, len(entries))
+	// the path from the root to the node that the previous ID ended at
+	path := []*SimilarityTreeNode{graph.Root}
+	var previous nibbles
+	for _, e := range entries {
+		shared := uint32(commonPrefixLength(previous, e.id))
+		previous = e.id
+
+		// back up to the deepest node that does not go past the shared prefix,
+		// splitting the node that the new ID branches off in the middle of
+		var branched *SimilarityTreeNode
+		for path[len(path)-1].end() > shared {
+			branched = path[len(path)-1]
+			path = path[:len(path)-1]
+		}
+		if branched != nil && branched.offset < shared {
+			path = append(path, branched.splitAbove(int(shared-branched.offset)))
+		}
+
+		node := path[len(path)-1]
+		if int(shared) < e.id.Len() {
+			node = newSimilarityTreeNode(e.id.Slice(int(shared), e.id.Len()), node)
+			node.Parent.setChild(node)
+			path = append(path, node)
+		}
+		// an empty lineage ID points at the root without making it a leaf, the same as Add() does
+		if e.id.Len() > 0 {
+			node.leaf = true
+		}
+		// every source only comes up once, so there is no old leaf to unset like setLeaf() does
+		graph.Leaves[e.source] = node
+		graph.sources[node] = append(graph.sources[node], e.source)
+	}
+	return graph, nil
+}
+
+// splitAbove splits a node the other way around from Split(): the node keeps the end of its value (and with it its
+// children and whether it is a leaf), and a new node for the start of the value is put between it and its parent.
+// Leaves pointing at the node stay correct, so nothing needs to be moved. Returns the new node
+func (tree *SimilarityTreeNode) splitAbove(split_length int) *SimilarityTreeNode {
+	head := newSimilarityTreeNode(tree.label.Slice(0, split_length), tree.Parent)
+	tree.label = tree.label.Slice(split_length, tree.label.Len())
+	tree.offset += uint32(split_length)
+	tree.Parent = head
+	head.setChild(tree)
+	// replaces the node, since the head starts with the same nibble
+	head.Parent.setChild(head)
+	return head
+}
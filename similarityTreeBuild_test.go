@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// requireSameTree fails the test unless both trees have the same structure and leaves
+func requireSameTree(t *testing.T, got SimilarityTree, expected SimilarityTree) {
+	t.Helper()
+	gotData, err := got.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedData, err := expected.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotData, expectedData) {
+		t.Fatalf(`built tree has %d nodes and %d leaves, incrementally built one has %d nodes and %d leaves`,
+			got.Root.NodeCount(), len(got.Leaves), expected.Root.NodeCount(), len(expected.Leaves))
+	}
+	for source, leaf := range got.Leaves {
+		if !slices.Equal(got.SourcesAt(leaf), expected.SourcesAt(expected.Leaves[source])) {
+			t.Errorf(`sources index differs at the leaf of %q`, source)
+		}
+	}
+}
+
+func incrementalSimilarityTree(t *testing.T, ids map[string]string) SimilarityTree {
+	graph := NewSimilarityTree()
+	for _, source := range slices.Sorted(maps.Keys(ids)) {
+		if err := graph.Add(source, ids[source]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return graph
+}
+
+func TestBuildSimilarityTree(t *testing.T) {
+	cases := map[string]map[string]string{
+		"empty":  {},
+		"single": {"a": "0123456789"},
+		"forks and mirrors": {
+			"a":      "0123456789",
+			"b":      "01234567ab",
+			"c":      "0123",
+			"d":      "fedc",
+			"mirror": "0123456789",
+		},
+		// prefixes that only differ from each other once padded out to whole bytes
+		"padding": {
+			"a":   "a",
+			"a0":  "a0",
+			"a00": "a00",
+			"a01": "a01",
+			"a1":  "a1",
+			"a0f": "a0f",
+		},
+		"empty id":  {"empty": "", "a": "01"},
+		"uppercase": {"upper": "ABCD", "lower": "abce"},
+	}
+	for name, ids := range cases {
+		t.Run(name, func(t *testing.T) {
+			built, err := BuildSimilarityTree(ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			requireSameTree(t, built, incrementalSimilarityTree(t, ids))
+			checkOffsets(t, &built)
+		})
+	}
+
+	if _, err := BuildSimilarityTree(map[string]string{"a": "xyz"}); err == nil {
+		t.Errorf(`BuildSimilarityTree() of a value that is not hex should fail`)
+	}
+}
+
+func TestBuildSimilarityTreeSynthetic(t *testing.T) {
+	ids := map[string]string{}
+	for i, id := range syntheticLineageIDs(5000, 4) {
+		ids[strconv.Itoa(i)] = id
+	}
+	// a few mirrors and prefixes of existing IDs
+	for i := 0; i < 100; i++ {
+		id := ids[strconv.Itoa(i*7)]
+		ids["mirror-"+strconv.Itoa(i)] = id
+		ids["prefix-"+strconv.Itoa(i)] = id[:1+i%len(id)]
+	}
+
+	built, err := BuildSimilarityTree(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireSameTree(t, built, incrementalSimilarityTree(t, ids))
+	checkOffsets(t, &built)
+
+	// a built tree can be changed incrementally like any other
+	for i := 0; i < 50; i++ {
+		source := strconv.Itoa(i)
+		built.Remove(source)
+		delete(ids, source)
+	}
+	requireSameTree(t, built, incrementalSimilarityTree(t, ids))
+}
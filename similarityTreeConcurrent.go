@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// ConcurrentSimilarityTree is a SimilarityTree that can be shared between goroutines, e.g. to keep answering
+// lookups while new fingerprints are being added. Any number of lookups can run at the same time,
+// while changes wait for them to finish and hold off new ones until they are done.
+//
+// Nodes are split and merged by changes to the tree, so they can't safely be used outside of its lock.
+// Lookups therefore return sources and lineage IDs rather than nodes, and View runs anything else under the lock
+type ConcurrentSimilarityTree struct {
+	lock  sync.RWMutex
+	graph *SimilarityTree
+}
+
+func NewConcurrentSimilarityTree() *ConcurrentSimilarityTree {
+	graph := NewSimilarityTree()
+	return graph.Concurrent()
+}
+
+// Concurrent wraps the tree for use from multiple goroutines. The tree must not be used directly afterwards
+func (graph *SimilarityTree) Concurrent() *ConcurrentSimilarityTree {
+	// lookups only read the sources index, but it is built on first use, so build it now while nothing else can
+	graph.index()
+	return &ConcurrentSimilarityTree{graph: graph}
+}
+
+func (tree *ConcurrentSimilarityTree) Add(source string, identifier string) error {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	return tree.graph.Add(source, identifier)
+}
+
+func (tree *ConcurrentSimilarityTree) Update(source string, identifier string) error {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	return tree.graph.Update(source, identifier)
+}
+
+func (tree *ConcurrentSimilarityTree) Remove(source string) error {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	return tree.graph.Remove(source)
+}
+
+// Find returns (in sorted order) every source with exactly the given lineage ID
+func (tree *ConcurrentSimilarityTree) Find(lineageID string) ([]string, error) {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	node, err := tree.graph.Root.Find(lineageID)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsLeaf() {
+		return nil, errors.New("no source has this lineage ID")
+	}
+	return tree.graph.SourcesAt(node), nil
+}
+
+// LineageID returns the lineage ID a source was added with
+func (tree *ConcurrentSimilarityTree) LineageID(source string) (string, bool) {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	leaf, has := tree.graph.Leaves[source]
+	if !has {
+		return "", false
+	}
+	return leaf.FullValue(), true
+}
+
+// Leaves returns the lineage ID of every source in the tree
+func (tree *ConcurrentSimilarityTree) Leaves() map[string]string {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	leaves := make(map[string]string, len(tree.graph.Leaves))
+	for source, leaf := range tree.graph.Leaves {
+		leaves[source] = leaf.FullValue()
+	}
+	return leaves
+}
+
+// CommonAncestorWith returns the history two sources share, i.e. the full value of the closest common ancestor of their leaves
+func (tree *ConcurrentSimilarityTree) CommonAncestorWith(sourceA string, sourceB string) (string, error) {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	leafA, hasA := tree.graph.Leaves[sourceA]
+	leafB, hasB := tree.graph.Leaves[sourceB]
+	if !hasA || !hasB {
+		return "", errors.New("source is not part of the tree")
+	}
+	ancestor, err := leafA.CommonAncestorWith(leafB)
+	if err != nil {
+		return "", err
+	}
+	return ancestor.FullValue(), nil
+}
+
+func (tree *ConcurrentSimilarityTree) Compare(sourceA string, sourceB string) (LineageComparison, error) {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	return tree.graph.Compare(sourceA, sourceB)
+}
+
+func (tree *ConcurrentSimilarityTree) Related(source string, k int) ([]RelatedRepository, error) {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	return tree.graph.Related(source, k)
+}
+
+func (tree *ConcurrentSimilarityTree) MarshalBinary() ([]byte, error) {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	return tree.graph.MarshalBinary()
+}
+
+// View runs a read-only function against the tree, while no changes can be made to it.
+// The function must not modify the tree or keep any of its nodes around after returning
+func (tree *ConcurrentSimilarityTree) View(view func(graph *SimilarityTree) error) error {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	return view(tree.graph)
+}
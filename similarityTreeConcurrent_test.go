@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentSimilarityTree(t *testing.T) {
+	tree := NewConcurrentSimilarityTree()
+	tree.Add("upstream", "0123456789")
+	tree.Add("mirror", "0123456789")
+	tree.Add("fork", "01234567ab")
+
+	if sources, err := tree.Find("0123456789"); err != nil || !slices.Equal(sources, []string{"mirror", "upstream"}) {
+		t.Errorf(`Find() = %v, %v`, sources, err)
+	}
+	if _, err := tree.Find("01234567"); err == nil {
+		t.Errorf(`Find() of a lineage ID that no source has should fail`)
+	}
+	if id, has := tree.LineageID("fork"); !has || id != "01234567ab" {
+		t.Errorf(`LineageID() = %q, %v`, id, has)
+	}
+	if shared, err := tree.CommonAncestorWith("upstream", "fork"); err != nil || shared != "01234567" {
+		t.Errorf(`CommonAncestorWith() = %q, %v`, shared, err)
+	}
+	if _, err := tree.CommonAncestorWith("upstream", "missing"); err == nil {
+		t.Errorf(`CommonAncestorWith() an unknown source should fail`)
+	}
+
+	tree.Remove("mirror")
+	if leaves := tree.Leaves(); len(leaves) != 2 || leaves["fork"] != "01234567ab" {
+		t.Errorf(`Leaves() = %v`, leaves)
+	}
+}
+
+// TestConcurrentSimilarityTreeStress is meant to be run with -race: it adds, removes and queries repositories
+// from many goroutines at once, then checks that the result is the same tree as adding them one at a time
+func TestConcurrentSimilarityTreeStress(t *testing.T) {
+	ids := syntheticLineageIDs(1000, 3)
+	tree := NewConcurrentSimilarityTree()
+	// a few sources that are always there for the readers to look up
+	for i := 0; i < 10; i++ {
+		tree.Add("fixed-"+strconv.Itoa(i), ids[i])
+	}
+
+	writers, readers := 4, 4
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 10 + w; i < len(ids); i += writers {
+				source := strconv.Itoa(i)
+				if err := tree.Add(source, ids[i]); err != nil {
+					t.Error(err)
+					return
+				}
+				// churn: every third source is removed again, every fifth one changes its lineage
+				switch {
+				case i%3 == 0:
+					if err := tree.Remove(source); err != nil {
+						t.Error(err)
+						return
+					}
+				case i%5 == 0:
+					if err := tree.Update(source, ids[i-1]); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	var readerWG sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readerWG.Add(1)
+		go func(r int) {
+			defer readerWG.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				fixed := "fixed-" + strconv.Itoa(i%10)
+				if sources, err := tree.Find(ids[i%10]); err != nil || !slices.Contains(sources, fixed) {
+					t.Errorf(`Find() of %q = %v, %v`, fixed, sources, err)
+					return
+				}
+				if _, err := tree.CommonAncestorWith(fixed, "fixed-"+strconv.Itoa((i+r)%10)); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%500 == 0 {
+					for source, id := range tree.Leaves() {
+						if source == fixed && id != ids[i%10] {
+							t.Errorf(`Leaves() has %q for %q`, id, source)
+							return
+						}
+					}
+					tree.View(func(graph *SimilarityTree) error {
+						graph.Families(DefaultFamilyOptions)
+						return nil
+					})
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(done)
+	readerWG.Wait()
+
+	expected := NewSimilarityTree()
+	for i := range ids {
+		source := strconv.Itoa(i)
+		switch {
+		case i < 10:
+			expected.Add("fixed-"+source, ids[i])
+		case i%3 == 0:
+		case i%5 == 0:
+			expected.Add(source, ids[i-1])
+		default:
+			expected.Add(source, ids[i])
+		}
+	}
+	got, _ := tree.MarshalBinary()
+	want, _ := expected.MarshalBinary()
+	if !bytes.Equal(got, want) {
+		t.Errorf(`concurrently built tree differs from one built sequentially`)
+	}
+}
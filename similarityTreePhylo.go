@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// phyloNode is the similarity tree reshaped the way phylogenetics tools expect it:
+// every repository is a named leaf. Repositories ending at a node that has children (or that share it with mirrors)
+// become leaves with a branch length of zero hanging off of that node
+type phyloNode struct {
+	Name     string
+	Length   int
+	Children []*phyloNode
+}
+
+func (graph *SimilarityTree) phyloTree() *phyloNode {
+	type step struct {
+		node   *SimilarityTreeNode
+		parent *phyloNode
+	}
+	// children are converted in pre-order with an explicit stack, so that deep trees can't overflow the goroutine
+	// stack, and every node gets its repositories once all of its children are in place
+	root := &phyloNode{Length: graph.Root.Len()}
+	converted := []step{{graph.Root, root}}
+	stack := []step{{graph.Root, root}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		children := s.node.Children()
+		for _, child := range children {
+			s.parent.Children = append(s.parent.Children, &phyloNode{Length: child.Len()})
+		}
+		for i := len(children) - 1; i >= 0; i-- {
+			c := step{children[i], s.parent.Children[i]}
+			converted = append(converted, c)
+			stack = append(stack, c)
+		}
+	}
+	for _, c := range converted {
+		p := c.parent
+		sources := graph.SourcesAt(c.node)
+		if len(sources) == 1 && len(p.Children) == 0 {
+			p.Name = sources[0]
+			continue
+		}
+		for _, source := range sources {
+			p.Children = append(p.Children, &phyloNode{Name: source})
+		}
+	}
+	return root
+}
+
+// newickQuote quotes names containing anything with a special meaning in Newick (URLs, for one) as 'name'
+func newickQuote(name string) string {
+	if name == "" || strings.ContainsAny(name, " \t\n()[]':;,_") {
+		return "'" + strings.ReplaceAll(name, "'", "''") + "'"
+	}
+	return name
+}
+
+// WriteNewick writes the tree in the Newick format, with branch lengths in commits.
+// Children are written in a fixed order so the output is the same on every run
+func (graph *SimilarityTree) WriteNewick(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	// each frame is a node being written and the next of its children to write, so that deep trees
+	// can't overflow the goroutine stack
+	type frame struct {
+		p    *phyloNode
+		next int
+	}
+	write := func(root *phyloNode) {
+		stack := []frame{{root, 0}}
+		for len(stack) > 0 {
+			f := &stack[len(stack)-1]
+			if f.next < len(f.p.Children) {
+				if f.next == 0 {
+					out.WriteByte('(')
+				} else {
+					out.WriteByte(',')
+				}
+				child := f.p.Children[f.next]
+				f.next++
+				stack = append(stack, frame{child, 0})
+				continue
+			}
+			if len(f.p.Children) > 0 {
+				out.WriteByte(')')
+			}
+			if f.p.Name != "" {
+				out.WriteString(newickQuote(f.p.Name))
+			}
+			if len(stack) > 1 {
+				out.WriteString(":" + strconv.Itoa(f.p.Length))
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	root := graph.phyloTree()
+	if len(root.Children) == 0 && root.Name == "" {
+		// an empty tree is still a valid tree
+		out.WriteString("()")
+	} else {
+		write(root)
+	}
+	out.WriteString(";\n")
+	return out.Flush()
+}
+
+// phyloXMLClade and phyloXMLDocument are the shape of the document that WritePhyloXML writes
+type phyloXMLClade struct {
+	Name         string           `xml:"name,omitempty"`
+	BranchLength *int             `xml:"branch_length,omitempty"`
+	Clades       []*phyloXMLClade `xml:"clade"`
+}
+
+type phyloXMLDocument struct {
+	XMLName   xml.Name `xml:"http://www.phyloxml.org phyloxml"`
+	Phylogeny struct {
+		Rooted bool           `xml:"rooted,attr"`
+		Name   string         `xml:"name"`
+		Clade  *phyloXMLClade `xml:"clade"`
+	} `xml:"phylogeny"`
+}
+
+// WritePhyloXML writes the tree as a PhyloXML document, with branch lengths in commits.
+// Clades are written a token at a time from an explicit stack instead of encoding nested structs,
+// which encoding/xml would do recursively
+func (graph *SimilarityTree) WritePhyloXML(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	element := func(name string) xml.StartElement {
+		return xml.StartElement{Name: xml.Name{Local: name}}
+	}
+
+	document := xml.StartElement{Name: xml.Name{Space: "http://www.phyloxml.org", Local: "phyloxml"}}
+	phylogeny := element("phylogeny")
+	phylogeny.Attr = []xml.Attr{{Name: xml.Name{Local: "rooted"}, Value: "true"}}
+	for _, start := range []xml.StartElement{document, phylogeny} {
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+	}
+	if err := encoder.EncodeElement("CodeDNA similarity tree", element("name")); err != nil {
+		return err
+	}
+
+	type frame struct {
+		p    *phyloNode
+		next int
+	}
+	stack := []frame{{graph.phyloTree(), 0}}
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		if f.next == 0 {
+			if err := encoder.EncodeToken(element("clade")); err != nil {
+				return err
+			}
+			if f.p.Name != "" {
+				if err := encoder.EncodeElement(f.p.Name, element("name")); err != nil {
+					return err
+				}
+			}
+			if len(stack) > 1 {
+				if err := encoder.EncodeElement(f.p.Length, element("branch_length")); err != nil {
+					return err
+				}
+			}
+		}
+		if f.next < len(f.p.Children) {
+			child := f.p.Children[f.next]
+			f.next++
+			stack = append(stack, frame{child, 0})
+			continue
+		}
+		if err := encoder.EncodeToken(element("clade").End()); err != nil {
+			return err
+		}
+		stack = stack[:len(stack)-1]
+	}
+
+	for _, start := range []xml.StartElement{phylogeny, document} {
+		if err := encoder.EncodeToken(start.End()); err != nil {
+			return err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriteNewick(t *testing.T) {
+	graph := NewSimilarityTree()
+	graph.Add("https://example.com/a", "0123456789")
+	graph.Add("mirror", "0123456789")
+	graph.Add("b", "01234567ab")
+	graph.Add("c", "0123")
+	graph.Add("o'brien", "fedc")
+
+	expected := "(((('https://example.com/a':0,mirror:0):2,b:2):4,c:0):4,'o''brien':4);\n"
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+		if err := graph.WriteNewick(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected {
+			t.Fatalf(`WriteNewick() = %q, expected %q`, buf.String(), expected)
+		}
+	}
+
+	empty := NewSimilarityTree()
+	var buf bytes.Buffer
+	empty.WriteNewick(&buf)
+	if buf.String() != "();\n" {
+		t.Errorf(`WriteNewick() of an empty tree = %q`, buf.String())
+	}
+}
+
+func TestWritePhyloXML(t *testing.T) {
+	graph := NewSimilarityTree()
+	graph.Add("a", "0123456789")
+	graph.Add("b", "01234567ab")
+
+	var buf bytes.Buffer
+	if err := graph.WritePhyloXML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var document phyloXMLDocument
+	if err := xml.Unmarshal(buf.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	root := document.Phylogeny.Clade
+	if root == nil || root.BranchLength != nil || len(root.Clades) != 1 {
+		t.Fatalf(`unexpected root clade %+v`, root)
+	}
+	shared := root.Clades[0]
+	if *shared.BranchLength != 8 || len(shared.Clades) != 2 {
+		t.Fatalf(`unexpected shared clade %+v`, shared)
+	}
+	if a := shared.Clades[0]; a.Name != "a" || *a.BranchLength != 2 {
+		t.Errorf(`unexpected leaf %+v`, a)
+	}
+}
+
+func TestPhyloDeepTree(t *testing.T) {
+	depth := 10_000
+	graph := deepSimilarityGraph(depth)
+
+	var buf bytes.Buffer
+	if err := graph.WriteNewick(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// one pair of parentheses for each node on the spine
+	if open, closed := strings.Count(buf.String(), "("), strings.Count(buf.String(), ")"); open != depth || closed != depth {
+		t.Errorf(`WriteNewick() opened %d and closed %d clades, expected %d`, open, closed, depth)
+	}
+
+	// every line is indented by its depth, so the output grows with the square of it
+	depth = 2_000
+	graph = deepSimilarityGraph(depth)
+	buf.Reset()
+	if err := graph.WritePhyloXML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// the document is walked token by token, since unmarshalling it recurses once per clade
+	decoder := xml.NewDecoder(&buf)
+	clades, nesting, deepest := 0, 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if token.Name.Local == "clade" {
+				clades++
+				nesting++
+				deepest = max(deepest, nesting)
+			}
+		case xml.EndElement:
+			if token.Name.Local == "clade" {
+				nesting--
+			}
+		}
+	}
+	if clades != 2*depth+1 || deepest != depth+1 {
+		t.Errorf(`WritePhyloXML() wrote %d clades nested %d deep, expected %d nested %d deep`, clades, deepest, 2*depth+1, depth+1)
+	}
+}
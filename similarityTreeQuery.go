@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// RelatedRepository describes how a repository relates to the one that was queried
+type RelatedRepository struct {
+	Source string
+	// the number of commits both lineage IDs have in common
+	SharedLength int
+	// the position of the first commit where the two histories differ.
+	// Lineage IDs start with the oldest commit, so this is the same as SharedLength
+	DivergesAt int
+	// commits only the queried repository has
+	UniqueToQuery int
+	// commits only the related repository has
+	UniqueToOther int
+}
+
+// Distance is the number of commits that are not shared between the two repositories (see SimilarityScore)
+func (r RelatedRepository) Distance() int {
+	return r.UniqueToQuery + r.UniqueToOther
+}
+
+// Related finds the repositories most closely related to source, i.e. the ones sharing the longest prefix of its lineage.
+// Results are ordered by shared length and then by distance, at most k of them are returned (all of them if k <= 0).
+// Exact mirrors come first, followed by repositories that continued the history of source.
+func (graph *SimilarityTree) Related(source string, k int) ([]RelatedRepository, error) {
+	leaf, has := graph.Leaves[source]
+	if !has {
+		return nil, errors.New("source is not part of the tree")
+	}
+	queryLength := len(leaf.FullValue())
+
+	results := []RelatedRepository{}
+	add := func(shared int, node *SimilarityTreeNode, skip *SimilarityTreeNode) {
+		found := []RelatedRepository{}
+		// the length of each node is the length of the lineage ID of a repository ending there
+		type step struct {
+			node   *SimilarityTreeNode
+			length int
+		}
+		stack := []step{{node, shared}}
+		for len(stack) > 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, other := range graph.SourcesAt(n.node) {
+				if other != source {
+					found = append(found, RelatedRepository{
+						Source:        other,
+						SharedLength:  shared,
+						DivergesAt:    shared,
+						UniqueToQuery: queryLength - shared,
+						UniqueToOther: n.length - shared,
+					})
+				}
+			}
+			for _, child := range n.node.Children() {
+				if child != skip {
+					stack = append(stack, step{child, n.length + child.Len()})
+				}
+			}
+		}
+		slices.SortFunc(found, func(a, b RelatedRepository) int {
+			if a.Distance() != b.Distance() {
+				return a.Distance() - b.Distance()
+			}
+			return strings.Compare(a.Source, b.Source)
+		})
+		results = append(results, found...)
+	}
+
+	// everything at or below the leaf shares its whole lineage,
+	// then every step up the tree shares a shorter prefix than the one before.
+	// Repositories that share nothing at all are not related
+	add(queryLength, leaf, nil)
+	shared := queryLength
+	for node := leaf; node.Parent != nil && (k <= 0 || len(results) < k); node = node.Parent {
+		shared -= node.Len()
+		if shared == 0 {
+			break
+		}
+		add(shared, node.Parent, node)
+	}
+
+	if k > 0 && len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRelated(t *testing.T) {
+	graph := NewSimilarityTree()
+	graph.Add("a", "0123456789")
+	graph.Add("mirror", "0123456789")
+	graph.Add("b", "01234567ab")
+	graph.Add("c", "0123")
+	graph.Add("longer", "0123456789abc")
+	graph.Add("unrelated", "fedc")
+
+	results, err := graph.Related("a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := []string{}
+	for _, r := range results {
+		sources = append(sources, r.Source)
+	}
+	expected := []string{"mirror", "longer", "b", "c"}
+	if !slices.Equal(sources, expected) {
+		t.Fatalf(`Related() returned %v, expected %v`, sources, expected)
+	}
+
+	expectedResults := []RelatedRepository{
+		{Source: "mirror", SharedLength: 10, DivergesAt: 10, UniqueToQuery: 0, UniqueToOther: 0},
+		{Source: "longer", SharedLength: 10, DivergesAt: 10, UniqueToQuery: 0, UniqueToOther: 3},
+		{Source: "b", SharedLength: 8, DivergesAt: 8, UniqueToQuery: 2, UniqueToOther: 2},
+		{Source: "c", SharedLength: 4, DivergesAt: 4, UniqueToQuery: 6, UniqueToOther: 0},
+	}
+	for i, r := range results {
+		if r != expectedResults[i] {
+			t.Errorf(`Related() result %d = %+v, expected %+v`, i, r, expectedResults[i])
+		}
+	}
+
+	if results, _ := graph.Related("a", 2); len(results) != 2 || results[1].Source != "longer" {
+		t.Errorf(`Related() with k = 2 returned %+v`, results)
+	}
+	if results, _ := graph.Related("unrelated", 0); len(results) != 0 {
+		t.Errorf(`Related() returned %+v for a repository that shares nothing`, results)
+	}
+	if _, err := graph.Related("missing", 1); err == nil {
+		t.Errorf(`Related() of an unknown source should fail`)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RenderOptions controls how the similarity tree is drawn by WriteDOT and WriteMermaid
+type RenderOptions struct {
+	// group the nodes of each family (see Families) in a box
+	ClusterFamilies bool
+	// the rule deciding which repositories are a family, DefaultFamilyOptions if not set
+	Families *FamilyOptions
+	// edge values longer than this are collapsed to their start and end
+	MaxEdgeLabel int
+}
+
+const defaultMaxEdgeLabel = 12
+
+// collapseValue shortens long node values the same way Print does, keeping the commit count
+func collapseValue(value string, maxLength int) string {
+	if maxLength <= 0 {
+		maxLength = defaultMaxEdgeLabel
+	}
+	if len(value) <= maxLength {
+		return value
+	}
+	keep := max((maxLength-1)/2, 1)
+	return value[:keep] + "…" + value[len(value)-keep:] + " (" + strconv.Itoa(len(value)) + ")"
+}
+
+// renderNode is a node of the tree as it is drawn, with a stable identifier assigned in pre-order
+type renderNode struct {
+	node    *SimilarityTreeNode
+	id      string
+	label   string
+	sources []string
+	parent  *renderNode
+	family  int
+}
+
+// renderNodes walks the tree in a deterministic order and works out the label of every node:
+// repositories that end at a node are listed by name, nodes shared by several repositories show the shared length.
+// Nodes are assigned to the family they belong to, if any
+func (graph *SimilarityTree) renderNodes(families []Family) []*renderNode {
+	subtreeFamilies := map[*SimilarityTreeNode]int{}
+	mirrorFamilies := map[*SimilarityTreeNode]int{}
+	for i, family := range families {
+		if family.subtree {
+			subtreeFamilies[family.root] = i
+		} else {
+			mirrorFamilies[family.root] = i
+		}
+	}
+
+	// pre-order, with an explicit stack so that deep trees can't overflow the goroutine stack
+	type step struct {
+		node   *SimilarityTreeNode
+		parent *renderNode
+		shared int
+		family int
+	}
+	nodes := []*renderNode{}
+	stack := []step{{graph.Root, nil, graph.Root.Len(), -1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		family := s.family
+		if f, has := subtreeFamilies[s.node]; has {
+			family = f
+		}
+		r := &renderNode{
+			node:    s.node,
+			id:      "n" + strconv.Itoa(len(nodes)),
+			sources: graph.SourcesAt(s.node),
+			parent:  s.parent,
+			family:  family,
+		}
+		if f, has := mirrorFamilies[s.node]; has {
+			r.family = f
+		}
+		nodes = append(nodes, r)
+		switch {
+		case s.parent == nil:
+			r.label = "root"
+		case len(r.sources) > 0:
+			r.label = strings.Join(r.sources, "\n") + "\n" + strconv.Itoa(s.shared) + " commits"
+		default:
+			r.label = strconv.Itoa(s.shared) + " shared"
+		}
+		children := s.node.Children()
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, step{children[i], r, s.shared + children[i].Len(), family})
+		}
+	}
+	return nodes
+}
+
+// familiesFor returns the families to cluster by, or nil if clustering is off
+func (graph *SimilarityTree) familiesFor(opts RenderOptions) []Family {
+	if !opts.ClusterFamilies {
+		return nil
+	}
+	if opts.Families != nil {
+		return graph.Families(*opts.Families)
+	}
+	return graph.Families(DefaultFamilyOptions)
+}
+
+// groupByFamily groups rendered nodes by family, in the same order as the families
+func groupByFamily(nodes []*renderNode, families []Family) [][]*renderNode {
+	groups := make([][]*renderNode, len(families))
+	for _, r := range nodes {
+		if r.family >= 0 {
+			groups[r.family] = append(groups[r.family], r)
+		}
+	}
+	return groups
+}
+
+func familyLabel(family Family) string {
+	return "family " + family.ID + " (" + family.Representative + ")"
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+// WriteDOT renders the tree in the Graphviz DOT language (e.g. for `dot -Tsvg`)
+func (graph *SimilarityTree) WriteDOT(w io.Writer, opts RenderOptions) error {
+	out := bufio.NewWriter(w)
+	families := graph.familiesFor(opts)
+	nodes := graph.renderNodes(families)
+
+	fmt.Fprintln(out, "digraph similarity {")
+	fmt.Fprintln(out, "\trankdir=LR;")
+	fmt.Fprintln(out, "\tnode [shape=box, fontname=\"monospace\"];")
+
+	writeNode := func(indent string, r *renderNode) {
+		attributes := "label=" + dotQuote(r.label)
+		if len(r.sources) > 0 {
+			attributes += ", style=filled, fillcolor=lightgrey"
+		} else {
+			attributes += ", shape=ellipse"
+		}
+		fmt.Fprintf(out, "%s%s [%s];\n", indent, r.id, attributes)
+	}
+	for _, r := range nodes {
+		if r.family < 0 {
+			writeNode("\t", r)
+		}
+	}
+	for i, group := range groupByFamily(nodes, families) {
+		fmt.Fprintf(out, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(out, "\t\tlabel=%s;\n", dotQuote(familyLabel(families[i])))
+		for _, r := range group {
+			writeNode("\t\t", r)
+		}
+		fmt.Fprintln(out, "\t}")
+	}
+
+	for _, r := range nodes {
+		if r.parent != nil {
+			fmt.Fprintf(out, "\t%s -> %s [label=%s];\n", r.parent.id, r.id, dotQuote(collapseValue(r.node.Value(), opts.MaxEdgeLabel)))
+		}
+	}
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
+
+func mermaidQuote(s string) string {
+	s = strings.ReplaceAll(s, `"`, "#quot;")
+	return `"` + strings.ReplaceAll(s, "\n", "<br/>") + `"`
+}
+
+// WriteMermaid renders the tree as a Mermaid flowchart (e.g. for markdown reports)
+func (graph *SimilarityTree) WriteMermaid(w io.Writer, opts RenderOptions) error {
+	out := bufio.NewWriter(w)
+	families := graph.familiesFor(opts)
+	nodes := graph.renderNodes(families)
+
+	fmt.Fprintln(out, "flowchart LR")
+	writeNode := func(indent string, r *renderNode) {
+		if len(r.sources) > 0 {
+			fmt.Fprintf(out, "%s%s[%s]\n", indent, r.id, mermaidQuote(r.label))
+		} else {
+			fmt.Fprintf(out, "%s%s((%s))\n", indent, r.id, mermaidQuote(r.label))
+		}
+	}
+	for _, r := range nodes {
+		if r.family < 0 {
+			writeNode("    ", r)
+		}
+	}
+	for i, group := range groupByFamily(nodes, families) {
+		fmt.Fprintf(out, "    subgraph family%d [%s]\n", i, mermaidQuote(familyLabel(families[i])))
+		for _, r := range group {
+			writeNode("        ", r)
+		}
+		fmt.Fprintln(out, "    end")
+	}
+
+	for _, r := range nodes {
+		if r.parent != nil {
+			fmt.Fprintf(out, "    %s -->|%s| %s\n", r.parent.id, mermaidQuote(collapseValue(r.node.Value(), opts.MaxEdgeLabel)), r.id)
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func renderFixture() SimilarityTree {
+	graph := NewSimilarityTree()
+	graph.Add("a", "0123456789abcdef0123")
+	graph.Add("mirror", "0123456789abcdef0123")
+	graph.Add("b", "0123456789abcdef01ff")
+	graph.Add(`quoted "name"`, "fedc")
+	return graph
+}
+
+func TestCollapseValue(t *testing.T) {
+	if v := collapseValue("0123", 12); v != "0123" {
+		t.Errorf(`short values should be left alone, got %q`, v)
+	}
+	if v := collapseValue("0123456789abcdef01", 12); v != "01234…def01 (18)" {
+		t.Errorf(`collapseValue() = %q`, v)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	graph := renderFixture()
+	var buf bytes.Buffer
+	if err := graph.WriteDOT(&buf, RenderOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"digraph similarity {",
+		`label="a\nmirror\n20 commits"`,
+		`label="18 shared"`,
+		`label="quoted \"name\"\n4 commits"`,
+		`n0 -> n1 [label="01234…def01 (18)"];`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf(`DOT output is missing %q:\n%s`, expected, out)
+		}
+	}
+	if strings.Contains(out, "subgraph") {
+		t.Errorf(`families should only be clustered when asked to`)
+	}
+
+	buf.Reset()
+	graph.WriteDOT(&buf, RenderOptions{ClusterFamilies: true})
+	if n := strings.Count(buf.String(), "subgraph cluster_"); n != 2 {
+		t.Errorf(`expected %d family clusters, found %d`, 2, n)
+	}
+
+	// the output is deterministic
+	var again bytes.Buffer
+	graph.WriteDOT(&again, RenderOptions{ClusterFamilies: true})
+	if buf.String() != again.String() {
+		t.Errorf(`DOT output is not deterministic`)
+	}
+}
+
+func TestWriteMermaid(t *testing.T) {
+	graph := renderFixture()
+	var buf bytes.Buffer
+	if err := graph.WriteMermaid(&buf, RenderOptions{ClusterFamilies: true}); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"flowchart LR",
+		`["a<br/>mirror<br/>20 commits"]`,
+		`(("18 shared"))`,
+		`["quoted #quot;name#quot;<br/>4 commits"]`,
+		`n0 -->|"01234…def01 (18)"| n1`,
+		"subgraph family0",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf(`Mermaid output is missing %q:\n%s`, expected, out)
+		}
+	}
+}
+
+func TestRenderDeepTree(t *testing.T) {
+	depth := 10_000
+	graph := deepSimilarityGraph(depth)
+
+	var buf bytes.Buffer
+	if err := graph.WriteDOT(&buf, RenderOptions{ClusterFamilies: true}); err != nil {
+		t.Fatal(err)
+	}
+	// every node but the root hangs off of an edge
+	if n := strings.Count(buf.String(), " -> "); n != 2*depth {
+		t.Errorf(`WriteDOT() wrote %d edges, expected %d`, n, 2*depth)
+	}
+
+	buf.Reset()
+	if err := graph.WriteMermaid(&buf, RenderOptions{ClusterFamilies: true}); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), " -->|"); n != 2*depth {
+		t.Errorf(`WriteMermaid() wrote %d edges, expected %d`, n, 2*depth)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+const treeFileMagic = "CDNATREE"
+const treeFileVersion = 2
+
+// MarshalBinary serializes the tree (nodes, edge values and the Leaves map) into a compact binary form.
+// Nodes are written in pre-order, each one as its value (packed nibbles), whether it is a leaf and its number of children,
+// followed by the leaves as (source, index of the node in pre-order) pairs.
+func (graph *SimilarityTree) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+
+	indices := map[*SimilarityTreeNode]uint64{}
+	stack := []*SimilarityTreeNode{graph.Root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		indices[node] = uint64(len(indices))
+		writeNibbles(w, node.label)
+		var flags byte
+		if node.leaf {
+			flags |= 1
+		}
+		w.WriteByte(flags)
+		writeUvarint(w, uint64(len(node.kids)))
+		// pushed in reverse so that the children are written in order
+		for i := len(node.kids) - 1; i >= 0; i-- {
+			stack = append(stack, node.kids[i])
+		}
+	}
+
+	sources := make([]string, 0, len(graph.Leaves))
+	for source := range graph.Leaves {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	writeUvarint(w, uint64(len(sources)))
+	for _, source := range sources {
+		index, has := indices[graph.Leaves[source]]
+		if !has {
+			return nil, fmt.Errorf("leaf %q points to a node that is not part of the tree", source)
+		}
+		writeString(w, source)
+		writeUvarint(w, index)
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the tree with one previously serialized by MarshalBinary
+func (graph *SimilarityTree) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+
+	root, nodes, err := readNodes(r)
+	if err != nil {
+		return fmt.Errorf("reading tree nodes: %w", err)
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("reading tree leaves: %w", err)
+	}
+	leaves := make(map[string]*SimilarityTreeNode, count)
+	for i := uint64(0); i < count; i++ {
+		source, err := readString(r)
+		if err != nil {
+			return fmt.Errorf("reading tree leaves: %w", err)
+		}
+		index, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("reading tree leaves: %w", err)
+		}
+		if index >= uint64(len(nodes)) {
+			return fmt.Errorf("leaf %q points to node %d, but there are only %d", source, index, len(nodes))
+		}
+		leaves[source] = nodes[index]
+	}
+
+	graph.Root = root
+	graph.Leaves = leaves
+	// the sources index is rebuilt from the leaves on first use
+	graph.sources = nil
+	return nil
+}
+
+// readNodes reads the nodes written by MarshalBinary, returning the root and every node in pre-order
+func readNodes(r *bytes.Reader) (*SimilarityTreeNode, []*SimilarityTreeNode, error) {
+	// the nodes whose children are still being read, along with how many of them are left
+	type pending struct {
+		node     *SimilarityTreeNode
+		children uint64
+	}
+	var root *SimilarityTreeNode
+	nodes := []*SimilarityTreeNode{}
+	stack := []pending{}
+	for root == nil || len(stack) > 0 {
+		var parent *SimilarityTreeNode
+		// labels are stored at the same parity as where they start within the lineage ID
+		var parity uint32
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1].node
+			parity = parent.end() % 2
+		}
+		label, err := readNibbles(r, parity)
+		if err != nil {
+			return nil, nil, err
+		}
+		node := newSimilarityTreeNode(label, parent)
+		nodes = append(nodes, node)
+		flags, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		node.leaf = flags&1 != 0
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if parent == nil {
+			root = node
+		} else {
+			if node.label.Len() == 0 {
+				return nil, nil, errors.New("child node without a value")
+			}
+			if parent.child(node.label.At(0)) != nil {
+				return nil, nil, errors.New("two child nodes start with the same value")
+			}
+			parent.setChild(node)
+			stack[len(stack)-1].children--
+		}
+		if count > 0 {
+			stack = append(stack, pending{node, count})
+		}
+		for len(stack) > 0 && stack[len(stack)-1].children == 0 {
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return root, nodes, nil
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.Write(buf[:n])
+}
+
+func writeString(w *bufio.Writer, s string) {
+	writeUvarint(w, uint64(len(s)))
+	w.WriteString(s)
+}
+
+// writeNibbles writes the length of a label in nibbles followed by its packed bytes
+func writeNibbles(w *bufio.Writer, n nibbles) {
+	packed := n.aligned(0)
+	writeUvarint(w, uint64(packed.Len()))
+	w.Write(packed.data)
+}
+
+// readNibbles reads a label written by writeNibbles, stored starting at the given parity
+func readNibbles(r *bytes.Reader, parity uint32) (nibbles, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nibbles{}, err
+	}
+	size := (length + 1) / 2
+	if size > uint64(r.Len()) {
+		return nibbles{}, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nibbles{}, err
+	}
+	packed := nibbles{data: buf, end: uint32(length)}
+	if parity == 0 {
+		return packed, nil
+	}
+	return packed.aligned(parity), nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// treeSource is the name that a cached repository is known by in the similarity tree
+func treeSource(v utils.IdentityValue) string {
+	if v.Nickname != "" {
+		return v.Nickname
+	}
+	return v.URL
+}
+
+// cachedLineageID parses the lineage ID of a cached repository along with the hash algorithm it was computed with
+func cachedLineageID(v utils.IdentityValue) (*LineageID, error) {
+	algorithm, err := parseHashAlgorithm(v.HashAlgorithm)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", treeSource(v), err)
+	}
+	lineageID, err := ParseLineageID(v.LineageID, v.LineagePrefixLength(), algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", treeSource(v), err)
+	}
+	return lineageID, nil
+}
+
+// cachedLineageIDs returns the lineage ID of every cached repository by the name it has in the similarity tree,
+// and the hash algorithm they were all computed with. Lineage IDs of different hash algorithms share no history
+// even when the repositories do, so they are never put in the same tree or index
+func cachedLineageIDs(rows []utils.IdentityValue) (map[string]string, HashAlgorithm, error) {
+	ids := make(map[string]string, len(rows))
+	algorithm := HashSHA1
+	for i, v := range rows {
+		rowAlgorithm, err := parseHashAlgorithm(v.HashAlgorithm)
+		if err != nil {
+			return nil, algorithm, fmt.Errorf("%s: %w", treeSource(v), err)
+		}
+		if i == 0 {
+			algorithm = rowAlgorithm
+		} else if rowAlgorithm != algorithm {
+			return nil, algorithm, fmt.Errorf("%s is fingerprinted from %s commits but %s from %s ones: %w",
+				treeSource(rows[0]), algorithm, treeSource(v), rowAlgorithm, ErrHashAlgorithmMismatch)
+		}
+		ids[treeSource(v)] = v.LineageID
+	}
+	return ids, algorithm, nil
+}
+
+func lineageHash(lineageID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(lineageID))
+	return h.Sum64()
+}
+
+// similarityTreePath is where the tree for a cache database is persisted
+func similarityTreePath(cache *utils.IdentityCache) string {
+	return cache.Filename + ".tree"
+}
+
+// saveSimilarityTree persists a tree along with a hash of the lineage ID that each source had when it was added,
+// which is what allows a later load to tell which parts of the cache have changed since
+func saveSimilarityTree(path string, graph *SimilarityTree, lineages map[string]uint64) error {
+	data, err := graph.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	w.WriteString(treeFileMagic)
+	writeUvarint(w, treeFileVersion)
+	sources := make([]string, 0, len(lineages))
+	for source := range lineages {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	writeUvarint(w, uint64(len(sources)))
+	for _, source := range sources {
+		writeString(w, source)
+		binary.Write(w, binary.LittleEndian, lineages[source])
+	}
+	writeUvarint(w, uint64(len(data)))
+	w.Write(data)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that an interrupted save never leaves a truncated tree behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadSimilarityTree(path string) (*SimilarityTree, map[string]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(treeFileMagic)) {
+		return nil, nil, fmt.Errorf("%s is not a similarity tree file", path)
+	}
+	r := bytes.NewReader(data[len(treeFileMagic):])
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version != treeFileVersion {
+		return nil, nil, fmt.Errorf("unsupported similarity tree file version %d", version)
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	lineages := make(map[string]uint64, count)
+	for i := uint64(0); i < count; i++ {
+		source, err := readString(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		var hash uint64
+		if err := binary.Read(r, binary.LittleEndian, &hash); err != nil {
+			return nil, nil, err
+		}
+		lineages[source] = hash
+	}
+
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length != uint64(r.Len()) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	graph := &SimilarityTree{}
+	offset := len(data) - r.Len()
+	if err := graph.UnmarshalBinary(data[offset:]); err != nil {
+		return nil, nil, err
+	}
+	return graph, lineages, nil
+}
+
+// similarityTreeForCache returns the similarity tree of every repository in the cache.
+// The tree is loaded from next to the cache database if it was persisted before and brought up to date
+// with whatever changed in the cache since, otherwise (or if rebuild is set) it is built from scratch.
+// Either way the up to date tree is persisted again for next time.
+func similarityTreeForCache(cache *utils.IdentityCache, rebuild bool) (*SimilarityTree, error) {
+	rows, err := cache.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ids, _, err := cachedLineageIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+	path := similarityTreePath(cache)
+
+	var graph *SimilarityTree
+	var lineages map[string]uint64
+	if !rebuild {
+		graph, lineages, err = loadSimilarityTree(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("Could not load the saved similarity tree, rebuilding it:", err)
+		}
+	}
+
+	current := make(map[string]uint64, len(rows))
+	for _, v := range rows {
+		current[treeSource(v)] = lineageHash(v.LineageID)
+	}
+
+	changed := false
+	if graph != nil {
+		for source := range lineages {
+			if _, has := current[source]; !has {
+				if err := graph.Remove(source); err != nil {
+					// the saved lineages don't match the saved tree, so neither can be trusted
+					fmt.Println("Saved similarity tree is inconsistent, rebuilding it:", err)
+					graph = nil
+					break
+				}
+				delete(lineages, source)
+				changed = true
+			}
+		}
+	}
+	if graph == nil {
+		newTree, err := BuildSimilarityTree(ids)
+		if err != nil {
+			return nil, err
+		}
+		graph = &newTree
+		lineages = current
+		changed = true
+	}
+	for _, v := range rows {
+		source := treeSource(v)
+		if hash, has := lineages[source]; has && hash == current[source] {
+			continue
+		}
+		// Add() takes care of replacing the old path of a source whose lineage changed
+		if err := graph.Add(source, v.LineageID); err != nil {
+			return nil, err
+		}
+		lineages[source] = current[source]
+		changed = true
+	}
+
+	if changed {
+		if err := saveSimilarityTree(path, graph, lineages); err != nil {
+			fmt.Println("Could not save the similarity tree:", err)
+		}
+	}
+	return graph, nil
+}
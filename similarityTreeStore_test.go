@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+func TestTreeMarshalRoundTrip(t *testing.T) {
+	graph := NewSimilarityTree()
+	ids := map[string]string{
+		"a":      "0123456789",
+		"b":      "01234567ab",
+		"c":      "0123",
+		"d":      "fedc",
+		"mirror": "0123456789",
+	}
+	for source, id := range ids {
+		if err := graph.Add(source, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := graph.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := SimilarityTree{}
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, b := graph.Root.NodeCount(), loaded.Root.NodeCount(); a != b {
+		t.Errorf(`loaded tree has %d nodes, expected %d`, b, a)
+	}
+	for source, id := range ids {
+		leaf, has := loaded.Leaves[source]
+		if !has {
+			t.Errorf(`leaf %q is missing from the loaded tree`, source)
+			continue
+		}
+		if leaf.FullValue() != graph.Leaves[source].FullValue() || !leaf.IsLeaf() {
+			t.Errorf(`leaf %q has value %q, expected %q`, source, leaf.FullValue(), id)
+		}
+	}
+	if loaded.Leaves["a"] != loaded.Leaves["mirror"] {
+		t.Errorf(`identical lineage IDs should share a node after loading`)
+	}
+
+	again, _ := loaded.MarshalBinary()
+	if !bytes.Equal(data, again) {
+		t.Errorf(`serialization is not deterministic`)
+	}
+
+	if err := loaded.UnmarshalBinary(data[:len(data)-3]); err == nil {
+		t.Errorf(`UnmarshalBinary() should fail on truncated data`)
+	}
+}
+
+func TestSimilarityTreeForCache(t *testing.T) {
+	cache := utils.IdentityCache{
+		Filename: t.TempDir() + "/cache.sqlite",
+	}
+	cache.Add(utils.IdentityValue{URL: "https://example.com/a", Nickname: "a", LineageID: "0123456789"})
+	cache.Add(utils.IdentityValue{URL: "https://example.com/b", Nickname: "b", LineageID: "01234567ab"})
+
+	graph, err := similarityTreeForCache(&cache, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Leaves) != 2 {
+		t.Fatalf(`expected %d leaves, found %d`, 2, len(graph.Leaves))
+	}
+
+	_, lineages, err := loadSimilarityTree(similarityTreePath(&cache))
+	if err != nil {
+		t.Fatalf(`tree was not saved next to the cache: %v`, err)
+	}
+	if len(lineages) != 2 {
+		t.Errorf(`expected %d saved lineage hashes, found %d`, 2, len(lineages))
+	}
+
+	// new rows are added to the saved tree
+	cache.Add(utils.IdentityValue{URL: "https://example.com/c", LineageID: "0123"})
+	graph, err = similarityTreeForCache(&cache, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, has := graph.Leaves["https://example.com/c"]; !has || leaf.FullValue() != "0123" {
+		t.Errorf(`new cache row was not added to the saved tree`)
+	}
+
+	// changed rows are updated in place
+	a, _ := cache.Resolve("a")
+	cache.UpdateLineage(a.ID, utils.IdentityValue{LineageID: "0123456789ff", HashAlgorithm: "sha1", PrefixLength: 4}, "refresh")
+	graph, err = similarityTreeForCache(&cache, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf := graph.Leaves["a"]; leaf == nil || leaf.FullValue() != "0123456789ff" {
+		t.Errorf(`changed cache row is not reflected in the tree`)
+	}
+	if len(graph.Leaves) != 3 {
+		t.Errorf(`expected %d leaves, found %d`, 3, len(graph.Leaves))
+	}
+
+	// rows that disappear from the cache are removed from the tree
+	b, _ := cache.Resolve("b")
+	c, _ := cache.Resolve("https://example.com/c")
+	cache.Merge(b.ID, c.ID)
+	graph, err = similarityTreeForCache(&cache, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, has := graph.Leaves["https://example.com/c"]; has || len(graph.Leaves) != 2 {
+		t.Errorf(`deleted cache row is still part of the tree`)
+	}
+	rebuilt, _ := similarityTreeForCache(&cache, true)
+	if a, b := graph.Root.NodeCount(), rebuilt.Root.NodeCount(); a != b {
+		t.Errorf(`incrementally updated tree has %d nodes, a rebuilt one has %d`, a, b)
+	}
+
+	// a saved source that is missing from the saved tree can't be removed from it, so the tree is rebuilt
+	empty, _ := BuildSimilarityTree(map[string]string{})
+	inconsistent := map[string]uint64{"gone": lineageHash("0123")}
+	if err := saveSimilarityTree(similarityTreePath(&cache), &empty, inconsistent); err != nil {
+		t.Fatal(err)
+	}
+	graph, err = similarityTreeForCache(&cache, false)
+	if err != nil {
+		t.Fatalf(`similarityTreeForCache() with an inconsistent saved tree: %v`, err)
+	}
+	if len(graph.Leaves) != 2 || graph.Leaves["a"].FullValue() != "0123456789ff" {
+		t.Errorf(`tree was not rebuilt from the cache`)
+	}
+}
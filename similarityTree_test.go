@@ -1,27 +1,58 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"slices"
+	"strconv"
+	"strings"
 	"testing"
 )
 
+// linkTestTree finishes a tree that was written out as node literals: it puts the kids of every node in the order
+// the tree keeps them in, and sets their parents and offsets. Nodes without kids are leaves, and so are nodes with
+// an empty kid, which is how the tree used to mark a lineage ID ending in the middle of it
+func linkTestTree(root *SimilarityTreeNode) {
+	stack := []*SimilarityTreeNode{root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		kids := node.kids
+		node.kids, node.childMask = nil, 0
+		node.leaf = len(kids) == 0
+		for _, kid := range kids {
+			if kid.label.Len() == 0 {
+				node.leaf = true
+				continue
+			}
+			kid.Parent = node
+			kid.offset = node.end()
+			if kid.label.start%2 != kid.offset%2 {
+				kid.label = kid.label.aligned(kid.offset % 2)
+			}
+			node.setChild(kid)
+			stack = append(stack, kid)
+		}
+	}
+}
+
 func TestGetFullValue(t *testing.T) {
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value:    "abcd",
-		children: map[rune]*SimilarityTreeNode{rune('e'): &childNode},
-		Parent:   nil,
+		label:  mustParseNibbles("abcd"),
+		kids:   []*SimilarityTreeNode{&childNode},
+		Parent: nil,
 	}
 
 	childNode.Parent = &rootNode
+	linkTestTree(&rootNode)
 
-	expected := "abcdefgh"
+	expected := "abcdef01"
 	if val := childNode.FullValue(); val != expected {
 		t.Errorf(`FullValue() for child node = %q, was not %q`, val, expected)
 	}
@@ -33,59 +64,58 @@ func TestGetFullValue(t *testing.T) {
 
 func TestGetFullValueTo(t *testing.T) {
 	childNode2 := SimilarityTreeNode{
-		Value:    "ijkl",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("2345"),
+		Parent: nil,
 	}
 
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{rune('i'): &childNode2},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		kids:   []*SimilarityTreeNode{&childNode2},
+		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value:    "abcd",
-		children: map[rune]*SimilarityTreeNode{rune('e'): &childNode},
-		Parent:   nil,
+		label:  mustParseNibbles("abcd"),
+		kids:   []*SimilarityTreeNode{&childNode},
+		Parent: nil,
 	}
 
 	childNode.Parent = &rootNode
 	childNode2.Parent = &childNode
+	linkTestTree(&rootNode)
 
 	if d := childNode.FullValueTo(&childNode); d != "" {
 		t.Errorf(`childNode distance to self was: %q, but should have been %q`, d, "")
 	}
 
-	if d := childNode2.FullValueTo(&childNode); d != "ijkl" {
-		t.Errorf(`childNode2 distance to childnode was: %q, but should have been %q`, d, "ijkl")
+	if d := childNode2.FullValueTo(&childNode); d != "2345" {
+		t.Errorf(`childNode2 distance to childnode was: %q, but should have been %q`, d, "2345")
 	}
 
-	if d := childNode2.FullValueTo(&rootNode); d != "efghijkl" {
-		t.Errorf(`childNode2 distance to root was: %q, but should have been %q`, d, "efghijkl")
+	if d := childNode2.FullValueTo(&rootNode); d != "ef012345" {
+		t.Errorf(`childNode2 distance to root was: %q, but should have been %q`, d, "ef012345")
 	}
 }
 
 func TestAddAppendCase(t *testing.T) {
 	// childNode := SimilarityTreeNode{
-	// 	Value:    "efgh",
-	// 	children: map[rune]*SimilarityTreeNode{},
+	// 	label:    mustParseNibbles("ef01"),
 	// 	Parent:   nil,
 	// }
 
 	rootNode := SimilarityTreeNode{
-		Value:    "abcd",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("abcd"),
+		Parent: nil,
 	}
 
 	// childNode.Parent = &rootNode
+	linkTestTree(&rootNode)
 
 	if len(rootNode.Children()) != 0 {
 		t.Errorf(`rootNode failed initial conditions: children should not be present, but some were`)
 	}
 
-	targetIdVal := "abcdefgh"
+	targetIdVal := "abcdef01"
 	returnedChild, splitChild, err := rootNode.Add(targetIdVal)
 	if err != nil {
 		t.Errorf(`Error: %q`, err)
@@ -105,9 +135,9 @@ func TestAddAppendCase(t *testing.T) {
 	if !exists {
 		t.Errorf("Expected child with key 'e', but it was not found")
 	}
-	expected := "efgh"
-	if val := newChild; val.Value != expected {
-		t.Errorf(`Value for new child = %q, was not %q`, val.Value, expected)
+	expected := "ef01"
+	if val := newChild; val.Value() != expected {
+		t.Errorf(`Value for new child = %q, was not %q`, val.Value(), expected)
 	}
 
 	if newChild.Parent != &rootNode {
@@ -126,10 +156,10 @@ func TestAddAppendCase(t *testing.T) {
 func TestAddSplitCase(t *testing.T) {
 
 	rootNode := &SimilarityTreeNode{
-		Value:    "abcdfghi",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("abcdf012"),
+		Parent: nil,
 	}
+	linkTestTree(rootNode)
 
 	originalValue := rootNode.FullValue()
 
@@ -137,7 +167,7 @@ func TestAddSplitCase(t *testing.T) {
 		t.Errorf(`rootNode failed initial conditions: children should not be present, but some were`)
 	}
 
-	targetIdVal := "abcdefgh"
+	targetIdVal := "abcdef01"
 	returnedChild, splitChild, err := (*rootNode).Add(targetIdVal)
 	if err != nil {
 		t.Errorf(`Error: %q`, err)
@@ -152,9 +182,9 @@ func TestAddSplitCase(t *testing.T) {
 	if !exists {
 		t.Errorf("Expected child with key 'f', but it was not found")
 	}
-	expected := "fghi"
-	if val := *ogChild; val.Value != expected {
-		t.Errorf(`Value for original child = %q, was not %q`, val.Value, expected)
+	expected := "f012"
+	if val := *ogChild; val.Value() != expected {
+		t.Errorf(`Value for original child = %q, was not %q`, val.Value(), expected)
 	}
 
 	if originalValue != splitChild.FullValue() {
@@ -166,9 +196,9 @@ func TestAddSplitCase(t *testing.T) {
 	if !exists {
 		t.Errorf("Expected child with key 'e', but it was not found")
 	}
-	expected = "efgh"
-	if val := newChild; val.Value != expected {
-		t.Errorf(`Value for new child = %q, was not %q`, val.Value, expected)
+	expected = "ef01"
+	if val := newChild; val.Value() != expected {
+		t.Errorf(`Value for new child = %q, was not %q`, val.Value(), expected)
 	}
 
 	if fullVal := (*newChild).FullValue(); fullVal != targetIdVal {
@@ -187,10 +217,10 @@ func TestAddSplitCase(t *testing.T) {
 func TestAddShorterCase(t *testing.T) {
 
 	rootNode := &SimilarityTreeNode{
-		Value:    "abcdfghi",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("abcdf012"),
+		Parent: nil,
 	}
+	linkTestTree(rootNode)
 
 	if len((*rootNode).Children()) != 0 {
 		t.Errorf(`rootNode failed initial conditions: children should not be present, but some were`)
@@ -207,44 +237,53 @@ func TestAddShorterCase(t *testing.T) {
 	if !exists {
 		t.Errorf("Expected child with key 'd', but it was not found")
 	}
-	expected := "dfghi"
-	if val := *ogChild; val.Value != expected {
-		t.Errorf(`Value for original child = %q, was not %q`, val.Value, expected)
+	expected := "df012"
+	if val := *ogChild; val.Value() != expected {
+		t.Errorf(`Value for original child = %q, was not %q`, val.Value(), expected)
+	}
+}
+
+func TestAddRejectsNonHex(t *testing.T) {
+	rootNode := &SimilarityTreeNode{}
+	if _, _, err := rootNode.Add("abcdwxyz"); err == nil {
+		t.Errorf(`Add() of a value that is not hex should fail`)
+	}
+	graph := NewSimilarityTree()
+	if err := graph.Add("a", "xyz"); err == nil {
+		t.Errorf(`SimilarityTree.Add() of a value that is not hex should fail`)
 	}
 }
 
 func TestFind(t *testing.T) {
 	childNode2 := SimilarityTreeNode{
-		Value:    "ijkl",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("2345"),
+		Parent: nil,
 	}
 
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{rune('i'): &childNode2},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		kids:   []*SimilarityTreeNode{&childNode2},
+		Parent: nil,
 	}
 
 	childNodeA := SimilarityTreeNode{
-		Value:    "wxyz",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("9876"),
+		Parent: nil,
 	}
 
 	rootValueNode := SimilarityTreeNode{
-		Value: "abcd",
-		children: map[rune]*SimilarityTreeNode{
-			rune('e'): &childNode,
-			rune('w'): &childNodeA,
+		label: mustParseNibbles("abcd"),
+		kids: []*SimilarityTreeNode{
+			&childNode,
+			&childNodeA,
 		},
 		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value: "",
-		children: map[rune]*SimilarityTreeNode{
-			rune('a'): &rootValueNode,
+		label: mustParseNibbles(""),
+		kids: []*SimilarityTreeNode{
+			&rootValueNode,
 		},
 		Parent: nil,
 	}
@@ -253,47 +292,48 @@ func TestFind(t *testing.T) {
 	childNodeA.Parent = &rootValueNode
 	childNode2.Parent = &childNode
 	rootValueNode.Parent = &rootNode
+	linkTestTree(&rootNode)
 
 	if d, err := rootNode.Find(""); d != &rootNode || err != nil {
-		t.Errorf(`find exact value of root node (empty) returned node with value %q, but should have been node with value %q`, d.Value, rootNode.Value)
+		t.Errorf(`find exact value of root node (empty) returned node with value %q, but should have been node with value %q`, d.Value(), rootNode.Value())
 	}
 
 	if d, err := rootNode.Find("abcd"); d != &rootValueNode || err != nil {
-		t.Errorf(`find exact value of root node returned node with value %q, but should have been node with value %q`, d.Value, rootValueNode.Value)
+		t.Errorf(`find exact value of root node returned node with value %q, but should have been node with value %q`, d.Value(), rootValueNode.Value())
 	}
 
 	if d, err := rootNode.Find("abcde"); d != nil || err == nil {
-		t.Errorf(`find value after root node returned node with value %q, but should have been an error`, d.Value)
+		t.Errorf(`find value after root node returned node with value %q, but should have been an error`, d.Value())
 	}
 
-	if d, err := rootNode.Find("abcdehgf"); d != nil || err == nil {
-		t.Errorf(`find value when matches stop partway returned value %q, but should have been an error`, d.Value)
+	if d, err := rootNode.Find("abcde10f"); d != nil || err == nil {
+		t.Errorf(`find value when matches stop partway returned value %q, but should have been an error`, d.Value())
 	}
 
-	if d, err := rootNode.Find("abcdihgf"); d != nil || err == nil {
-		t.Errorf(`find value when matches stop at node boundary returned value %q, but should have been an error`, d.Value)
+	if d, err := rootNode.Find("abcd210f"); d != nil || err == nil {
+		t.Errorf(`find value when matches stop at node boundary returned value %q, but should have been an error`, d.Value())
 	}
 
-	if d, err := rootNode.Find("abcdwxyz"); d != &childNodeA || err != nil {
-		t.Errorf(`find value of child returned node with value %q, but should have been node with value %q`, d.Value, childNodeA.Value)
+	if d, err := rootNode.Find("abcd9876"); d != &childNodeA || err != nil {
+		t.Errorf(`find value of child returned node with value %q, but should have been node with value %q`, d.Value(), childNodeA.Value())
 	}
 
 }
 
 func TestDistance(t *testing.T) {
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value:    "abcd",
-		children: map[rune]*SimilarityTreeNode{rune('e'): &childNode},
-		Parent:   nil,
+		label:  mustParseNibbles("abcd"),
+		kids:   []*SimilarityTreeNode{&childNode},
+		Parent: nil,
 	}
 
 	childNode.Parent = &rootNode
+	linkTestTree(&rootNode)
 
 	if d := rootNode.Distance(); d != 0 {
 		t.Errorf(`rootNode distance was: %q, but should have been %q`, d, 0)
@@ -308,25 +348,25 @@ func TestDistance(t *testing.T) {
 func TestDistanceTo(t *testing.T) {
 
 	childNode2 := SimilarityTreeNode{
-		Value:    "ijkl",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("2345"),
+		Parent: nil,
 	}
 
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{rune('i'): &childNode2},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		kids:   []*SimilarityTreeNode{&childNode2},
+		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value:    "abcd",
-		children: map[rune]*SimilarityTreeNode{rune('e'): &childNode},
-		Parent:   nil,
+		label:  mustParseNibbles("abcd"),
+		kids:   []*SimilarityTreeNode{&childNode},
+		Parent: nil,
 	}
 
 	childNode.Parent = &rootNode
 	childNode2.Parent = &childNode
+	linkTestTree(&rootNode)
 
 	if d := childNode.DistanceTo(&childNode); d != 0 {
 		t.Errorf(`childNode distance to self was: %q, but should have been %q`, d, 0)
@@ -345,28 +385,26 @@ func TestDistanceTo(t *testing.T) {
 func TestCommonAncestor(t *testing.T) {
 
 	childNode2 := SimilarityTreeNode{
-		Value:    "ijkl",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("2345"),
+		Parent: nil,
 	}
 
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{rune('i'): &childNode2},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		kids:   []*SimilarityTreeNode{&childNode2},
+		Parent: nil,
 	}
 
 	childNodeA := SimilarityTreeNode{
-		Value:    "wxyz",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("9876"),
+		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value: "abcd",
-		children: map[rune]*SimilarityTreeNode{
-			rune('e'): &childNode,
-			rune('w'): &childNodeA,
+		label: mustParseNibbles("abcd"),
+		kids: []*SimilarityTreeNode{
+			&childNode,
+			&childNodeA,
 		},
 		Parent: nil,
 	}
@@ -374,48 +412,46 @@ func TestCommonAncestor(t *testing.T) {
 	childNode.Parent = &rootNode
 	childNodeA.Parent = &rootNode
 	childNode2.Parent = &childNode
+	linkTestTree(&rootNode)
 
 	if a, err := childNode.CommonAncestorWith(&childNode2); a != &childNode && err != nil {
-		t.Errorf(`common ancestor between childNode and childnode2 was node with value: %q, but should have been node with value %q`, a.Value, childNode.Value)
+		t.Errorf(`common ancestor between childNode and childnode2 was node with value: %q, but should have been node with value %q`, a.Value(), childNode.Value())
 	}
 
 	if a, err := childNodeA.CommonAncestorWith(&childNode2); a != &rootNode && err != nil {
-		t.Errorf(`common ancestor between childNode and childnode2 was node with value: %q, but should have been node with value %q`, a.Value, rootNode.Value)
+		t.Errorf(`common ancestor between childNode and childnode2 was node with value: %q, but should have been node with value %q`, a.Value(), rootNode.Value())
 	}
 
 }
 
 func TestLeafDetection(t *testing.T) {
 	childNode2 := SimilarityTreeNode{
-		Value:    "ijkl",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("2345"),
+		Parent: nil,
 	}
 
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{rune('i'): &childNode2},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		kids:   []*SimilarityTreeNode{&childNode2},
+		Parent: nil,
 	}
 
 	childNodeA := SimilarityTreeNode{
-		Value:    "wxyz",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("9876"),
+		Parent: nil,
 	}
 
 	nullNode := SimilarityTreeNode{
-		Value:    "",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles(""),
+		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value: "abcd",
-		children: map[rune]*SimilarityTreeNode{
-			rune(0):   &nullNode,
-			rune('e'): &childNode,
-			rune('w'): &childNodeA,
+		label: mustParseNibbles("abcd"),
+		kids: []*SimilarityTreeNode{
+			&nullNode,
+			&childNode,
+			&childNodeA,
 		},
 		Parent: nil,
 	}
@@ -424,6 +460,7 @@ func TestLeafDetection(t *testing.T) {
 	childNodeA.Parent = &rootNode
 	childNode2.Parent = &childNode
 	nullNode.Parent = &rootNode
+	linkTestTree(&rootNode)
 
 	leaves := rootNode.Leaves()
 
@@ -447,35 +484,32 @@ func TestLeafDetection(t *testing.T) {
 
 func TestSiblingDetection(t *testing.T) {
 	childNode2 := SimilarityTreeNode{
-		Value:    "ijkl",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("2345"),
+		Parent: nil,
 	}
 
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{rune('i'): &childNode2},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		kids:   []*SimilarityTreeNode{&childNode2},
+		Parent: nil,
 	}
 
 	childNodeA := SimilarityTreeNode{
-		Value:    "wxyz",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("9876"),
+		Parent: nil,
 	}
 
 	nullNode := SimilarityTreeNode{
-		Value:    "",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles(""),
+		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value: "abcd",
-		children: map[rune]*SimilarityTreeNode{
-			rune(0):   &nullNode,
-			rune('e'): &childNode,
-			rune('w'): &childNodeA,
+		label: mustParseNibbles("abcd"),
+		kids: []*SimilarityTreeNode{
+			&nullNode,
+			&childNode,
+			&childNodeA,
 		},
 		Parent: nil,
 	}
@@ -484,6 +518,7 @@ func TestSiblingDetection(t *testing.T) {
 	childNodeA.Parent = &rootNode
 	childNode2.Parent = &childNode
 	nullNode.Parent = &rootNode
+	linkTestTree(&rootNode)
 
 	siblings := rootNode.Siblings()
 
@@ -513,35 +548,32 @@ func TestSiblingDetection(t *testing.T) {
 
 func TestNodeCount(t *testing.T) {
 	childNode2 := SimilarityTreeNode{
-		Value:    "ijkl",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("2345"),
+		Parent: nil,
 	}
 
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{rune('i'): &childNode2},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		kids:   []*SimilarityTreeNode{&childNode2},
+		Parent: nil,
 	}
 
 	childNodeA := SimilarityTreeNode{
-		Value:    "wxyz",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("9876"),
+		Parent: nil,
 	}
 
 	nullNode := SimilarityTreeNode{
-		Value:    "",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles(""),
+		Parent: nil,
 	}
 
 	rootNode := SimilarityTreeNode{
-		Value: "abcd",
-		children: map[rune]*SimilarityTreeNode{
-			rune(0):   &nullNode,
-			rune('e'): &childNode,
-			rune('w'): &childNodeA,
+		label: mustParseNibbles("abcd"),
+		kids: []*SimilarityTreeNode{
+			&nullNode,
+			&childNode,
+			&childNodeA,
 		},
 		Parent: nil,
 	}
@@ -550,6 +582,7 @@ func TestNodeCount(t *testing.T) {
 	childNodeA.Parent = &rootNode
 	childNode2.Parent = &childNode
 	nullNode.Parent = &rootNode
+	linkTestTree(&rootNode)
 
 	if l := childNodeA.NodeCount(); l != 1 {
 		t.Errorf(`NodeCount() returned incorrect number of siblings for child A, expected %d, got %d`, 1, l)
@@ -565,31 +598,51 @@ func TestNodeCount(t *testing.T) {
 
 }
 
+func TestChildrenOrder(t *testing.T) {
+	rootNode := &SimilarityTreeNode{}
+	for _, value := range []string{"f0", "30", "a0", "00", "7"} {
+		rootNode.Add(value)
+	}
+	first := ""
+	for _, child := range rootNode.Children() {
+		first += child.Value()[:1]
+	}
+	if first != "037af" {
+		t.Errorf(`Children() are in order %q, expected %q`, first, "037af")
+	}
+	for _, key := range "037af" {
+		if _, has := rootNode.Child(key); !has {
+			t.Errorf(`Child(%q) was not found`, key)
+		}
+	}
+	if _, has := rootNode.Child('F'); has {
+		t.Errorf(`Child() should only find lowercase hex digits that have children`)
+	}
+}
+
 func TestLeafMaintainance(t *testing.T) {
 
 	childNode2 := SimilarityTreeNode{
-		Value:    "ijkl",
-		children: map[rune]*SimilarityTreeNode{},
-		Parent:   nil,
+		label:  mustParseNibbles("2345"),
+		Parent: nil,
 	}
 
 	childNode := SimilarityTreeNode{
-		Value:    "efgh",
-		children: map[rune]*SimilarityTreeNode{rune('i'): &childNode2},
-		Parent:   nil,
+		label:  mustParseNibbles("ef01"),
+		kids:   []*SimilarityTreeNode{&childNode2},
+		Parent: nil,
 	}
 
 	// childNodeA := SimilarityTreeNode{
-	// 	Value:    "wxyz",
-	// 	children: map[rune]*SimilarityTreeNode{},
+	// 	label:    mustParseNibbles("9876"),
 	// 	Parent:   nil,
 	// }
 
 	rootNode := SimilarityTreeNode{
-		Value: "abcd",
-		children: map[rune]*SimilarityTreeNode{
-			rune('e'): &childNode,
-			// rune('w'): &childNodeA,
+		label: mustParseNibbles("abcd"),
+		kids: []*SimilarityTreeNode{
+			&childNode,
+			// &childNodeA,
 		},
 		Parent: nil,
 	}
@@ -597,6 +650,7 @@ func TestLeafMaintainance(t *testing.T) {
 	childNode.Parent = &rootNode
 	// childNodeA.Parent = &rootNode
 	childNode2.Parent = &childNode
+	linkTestTree(&rootNode)
 
 	test := SimilarityTree{
 		Root:   &rootNode,
@@ -608,25 +662,322 @@ func TestLeafMaintainance(t *testing.T) {
 		t.Errorf(`similarity tree was expected to have no leaves but instead had: %d`, v)
 	}
 
-	test.Add("w-x-y-z", "abcdwxyz")
+	test.Add("w-x-y-z", "abcd9876")
 
 	if _, has := test.Leaves["w-x-y-z"]; has != true {
-		t.Errorf(`similarity tree was expected to have a leaf at key %q: with value %q, but it doesnt exist`, "w-x-y-z", "wxyz")
+		t.Errorf(`similarity tree was expected to have a leaf at key %q: with value %q, but it doesnt exist`, "w-x-y-z", "9876")
 	}
 
-	if v, has := test.Leaves["w-x-y-z"]; has == true && v.Value != "wxyz" {
-		t.Errorf(`similarity tree was expected to have a leaf at key %q: with value %q, but instead had node with value %q`, "w-x-y-z", "wxyz", v.Value)
+	if v, has := test.Leaves["w-x-y-z"]; has == true && v.Value() != "9876" {
+		t.Errorf(`similarity tree was expected to have a leaf at key %q: with value %q, but instead had node with value %q`, "w-x-y-z", "9876", v.Value())
 	}
 
 	// add a value that will split the just-added value
-	test.Add("w-x", "abcdwx")
+	test.Add("w-x", "abcd98")
 
 	if _, has := test.Leaves["w-x"]; has != true {
-		t.Errorf(`similarity tree was expected to have a leaf at key %q: with value %q, but it doesnt exist`, "w-x", "wx")
+		t.Errorf(`similarity tree was expected to have a leaf at key %q: with value %q, but it doesnt exist`, "w-x", "98")
+	}
+
+	if v, has := test.Leaves["w-x"]; has == true && v.Value() != "98" {
+		t.Errorf(`similarity tree was expected to have a leaf at key %q: with value %q, but instead had node with value %q`, "w-x", "98", v.Value())
+	}
+
+}
+
+// TestAddLeaves checks which nodes end a lineage ID after each way that Add can change the tree
+func TestAddLeaves(t *testing.T) {
+	appended := &SimilarityTreeNode{label: mustParseNibbles("abcd")}
+	linkTestTree(appended)
+	child, _, _ := appended.Add("abcdef01")
+	if !appended.IsLeaf() || !child.IsLeaf() {
+		t.Errorf(`appending should keep the node a leaf and add another leaf`)
 	}
 
-	if v, has := test.Leaves["w-x"]; has == true && v.Value != "wx" {
-		t.Errorf(`similarity tree was expected to have a leaf at key %q: with value %q, but instead had node with value %q`, "w-x", "wx", v.Value)
+	split := &SimilarityTreeNode{label: mustParseNibbles("abcdf012")}
+	linkTestTree(split)
+	_, tail, _ := split.Add("abcdef01")
+	if split.IsLeaf() || !tail.IsLeaf() {
+		t.Errorf(`the head of a split should not be a leaf, but the tail should`)
 	}
 
+	shorter := &SimilarityTreeNode{label: mustParseNibbles("abcdf012")}
+	linkTestTree(shorter)
+	returned, _, _ := shorter.Add("abc")
+	tail, _ = shorter.Child('d')
+	if returned != shorter || !shorter.IsLeaf() || !tail.IsLeaf() {
+		t.Errorf(`both halves of a split at the end of the added value should be leaves`)
+	}
+
+	graph := NewSimilarityTree()
+	graph.Add("w-x-y-z", "abcd9876")
+	graph.Add("w-x", "abcd98")
+	if v := graph.Leaves["w-x-y-z"]; v.FullValue() != "abcd9876" || v.Value() != "76" {
+		t.Errorf(`the leaf that was split should have moved to the tail, but has value %q`, v.Value())
+	}
+}
+
+func TestRemove(t *testing.T) {
+	ids := map[string]string{
+		"a":      "0123456789",
+		"b":      "01234567ab",
+		"c":      "0123",
+		"d":      "fedc",
+		"mirror": "0123456789",
+	}
+	build := func(skip ...string) SimilarityTree {
+		graph := NewSimilarityTree()
+		// insertion order matters for which node ends up as the head of a split, so keep it fixed
+		for _, source := range []string{"a", "b", "c", "d", "mirror"} {
+			if slices.Contains(skip, source) {
+				continue
+			}
+			if err := graph.Add(source, ids[source]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return graph
+	}
+
+	for _, removed := range [][]string{{"b"}, {"c"}, {"d"}, {"mirror"}, {"a", "mirror"}, {"b", "c"}, {"a", "b", "c", "d", "mirror"}} {
+		graph := build()
+		for _, source := range removed {
+			if err := graph.Remove(source); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected := build(removed...)
+		got, _ := graph.MarshalBinary()
+		want, _ := expected.MarshalBinary()
+		if !slices.Equal(got, want) {
+			t.Errorf(`removing %v left a tree with %d nodes, expected %d`, removed, graph.Root.NodeCount(), expected.Root.NodeCount())
+		}
+		for source, leaf := range graph.Leaves {
+			if leaf.FullValue() != ids[source] || !leaf.IsLeaf() {
+				t.Errorf(`after removing %v, leaf %q has value %q, expected %q`, removed, source, leaf.FullValue(), ids[source])
+			}
+		}
+	}
+
+	graph := build()
+	if err := graph.Remove("missing"); err == nil {
+		t.Errorf(`Remove() of an unknown source should fail`)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	graph := NewSimilarityTree()
+	graph.Add("a", "0123456789")
+	graph.Add("b", "01234567ab")
+
+	if err := graph.Update("b", "fedc"); err != nil {
+		t.Fatal(err)
+	}
+	if v := graph.Leaves["b"].FullValue(); v != "fedc" {
+		t.Errorf(`updated leaf has value %q, expected %q`, v, "fedc")
+	}
+	// the split made for the old value of b is merged back together
+	if leaf := graph.Leaves["a"]; leaf.Value() != "0123456789" || leaf.Parent != graph.Root {
+		t.Errorf(`old path was not cleaned up, leaf a has value %q`, leaf.Value())
+	}
+	if n := graph.Root.NodeCount(); n != 3 {
+		t.Errorf(`expected %d nodes after the update, found %d`, 3, n)
+	}
+
+	if err := graph.Update("missing", "0123"); err == nil {
+		t.Errorf(`Update() of an unknown source should fail`)
+	}
+}
+
+func TestSourcesIndex(t *testing.T) {
+	graph := NewSimilarityTree()
+	graph.Add("a", "0123456789")
+	graph.Add("mirror", "0123456789")
+	graph.Add("c", "0123")
+	graph.Add("b", "01234567ab")
+	graph.Add("d", "fedc")
+
+	if s := graph.SourcesAt(graph.Leaves["a"]); !slices.Equal(s, []string{"a", "mirror"}) {
+		t.Errorf(`SourcesAt() = %v, expected both mirrors`, s)
+	}
+	if s := graph.SourcesAt(graph.Leaves["c"]); !slices.Equal(s, []string{"c"}) {
+		t.Errorf(`SourcesAt() = %v, expected %v`, s, []string{"c"})
+	}
+	if s := graph.SourcesUnder(graph.Leaves["c"]); !slices.Equal(s, []string{"a", "b", "c", "mirror"}) {
+		t.Errorf(`SourcesUnder() = %v, expected everything descending from c`, s)
+	}
+	if s := graph.SourcesUnder(graph.Root); len(s) != 5 {
+		t.Errorf(`SourcesUnder() the root = %v, expected every source`, s)
+	}
+	if m := graph.Mirrors(); len(m) != 1 || !slices.Equal(m[0], []string{"a", "mirror"}) {
+		t.Errorf(`Mirrors() = %v`, m)
+	}
+
+	// the index follows leaves through splits and removals
+	graph.Add("e", "012345")
+	graph.Remove("mirror")
+	for source, leaf := range graph.Leaves {
+		if s := graph.SourcesAt(leaf); !slices.Contains(s, source) {
+			t.Errorf(`SourcesAt() the leaf of %q = %v`, source, s)
+		}
+	}
+	if m := graph.Mirrors(); len(m) != 0 {
+		t.Errorf(`Mirrors() = %v after removing the mirror`, m)
+	}
+
+	// trees loaded from disk rebuild the index
+	data, _ := graph.MarshalBinary()
+	loaded := SimilarityTree{}
+	loaded.UnmarshalBinary(data)
+	if s := loaded.SourcesUnder(loaded.Root); len(s) != 5 {
+		t.Errorf(`SourcesUnder() the root of a loaded tree = %v`, s)
+	}
+}
+
+func TestAppendKeepsLeaf(t *testing.T) {
+	graph := NewSimilarityTree()
+	graph.Add("upstream", "0123")
+	graph.Add("fork", "012345")
+
+	if leaf := graph.Leaves["upstream"]; !leaf.IsLeaf() || len(leaf.Children()) != 1 {
+		t.Errorf(`a leaf that gets a child appended should stay a leaf`)
+	}
+	graph.Remove("upstream")
+	if n := graph.Root.NodeCount(); n != 2 || graph.Leaves["fork"].Value() != "012345" {
+		t.Errorf(`removing the leaf should merge its child back, found %d nodes`, n)
+	}
+}
+
+// checkOffsets fails the test if the cached offset of any node does not match the length of its parent's full value
+func checkOffsets(t *testing.T, graph *SimilarityTree) {
+	t.Helper()
+	for _, leaf := range graph.Root.Leaves() {
+		for node := leaf; node.Parent != nil; node = node.Parent {
+			if int(node.offset) != len(node.Parent.FullValue()) {
+				t.Fatalf(`node %q has offset %d, but its parent has value %q`, node.FullValue(), node.offset, node.Parent.FullValue())
+			}
+		}
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	graph := NewSimilarityTree()
+	ids := syntheticLineageIDs(500, 2)
+	for i, id := range ids {
+		if err := graph.Add(strconv.Itoa(i), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkOffsets(t, &graph)
+
+	for i := 0; i < len(ids); i += 3 {
+		if err := graph.Remove(strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkOffsets(t, &graph)
+
+	data, _ := graph.MarshalBinary()
+	loaded := SimilarityTree{}
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	checkOffsets(t, &loaded)
+	for source, leaf := range loaded.Leaves {
+		if leaf.FullValue() != graph.Leaves[source].FullValue() {
+			t.Errorf(`loaded leaf %q has value %q`, source, leaf.FullValue())
+		}
+	}
+}
+
+func TestDeepTree(t *testing.T) {
+	depth := 100_000
+	root, leaf := deepSimilarityTree(depth)
+	fork, _ := leaf.Parent.Child('1')
+
+	full := leaf.FullValue()
+	if len(full) != 2*depth || full[:4] != "0001" || leaf.Distance() != depth {
+		t.Errorf(`the deepest leaf has a value of length %d at distance %d`, len(full), leaf.Distance())
+	}
+	if path := leaf.TreePath(); len(path) != depth || strings.Trim(path, "0") != "" {
+		t.Errorf(`TreePath() of the deepest leaf is %d long`, len(path))
+	}
+	if v := leaf.FullValueTo(fork.Parent); v != leaf.Value() {
+		t.Errorf(`FullValueTo() the parent = %q, expected %q`, v, leaf.Value())
+	}
+	if v := fork.FullValueTo(leaf); v != fork.FullValue() {
+		t.Errorf(`FullValueTo() a node that is not an ancestor should be the full value`)
+	}
+	if a, err := leaf.CommonAncestorWith(fork); err != nil || a != leaf.Parent {
+		t.Errorf(`CommonAncestorWith() a fork off of the parent = %v, %v`, a, err)
+	}
+	if score, _ := root.SimilarityScore(leaf, fork); score != 4 {
+		t.Errorf(`SimilarityScore() = %d, expected %d`, score, 4)
+	}
+	if n := root.NodeCount(); n != 2*depth+1 {
+		t.Errorf(`NodeCount() = %d, expected %d`, n, 2*depth+1)
+	}
+	leaves := root.Leaves()
+	// the spine comes before the forks, so the walk reaches the end of it before backtracking through the forks
+	if len(leaves) != depth+1 || leaves[0] != leaf || leaves[1] != fork || leaves[depth].Distance() != 1 {
+		t.Errorf(`Leaves() returned %d leaves, not in depth first order`, len(leaves))
+	}
+
+	// families compare every member with the others, so a shallower tree keeps the rest of the walks quick
+	depth = 10_000
+	graph := deepSimilarityGraph(depth)
+	root, full = graph.Root, graph.Leaves["0"].FullValue()
+	if sources := graph.SourcesUnder(root); len(sources) != depth+1 {
+		t.Errorf(`SourcesUnder() the root = %d sources`, len(sources))
+	}
+	// the fork off of the root shares nothing with the rest
+	if related, err := graph.Related("0", 0); err != nil || len(related) != depth-1 || related[0].Source != "1" {
+		t.Errorf(`Related() to the deepest leaf found %d repositories, %v`, len(related), err)
+	}
+	if families := graph.Families(DefaultFamilyOptions); len(families) != 2 || len(families[0].Members) != depth {
+		t.Errorf(`Families() = %d families`, len(families))
+	}
+	data, err := graph.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded SimilarityTree
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if n := loaded.Root.NodeCount(); n != 2*depth+1 || loaded.Leaves["0"].FullValue() != full {
+		t.Errorf(`loaded deep tree has %d nodes`, n)
+	}
+}
+
+func TestPrintDeepTree(t *testing.T) {
+	// every line is indented by its depth, so the output grows with the square of it
+	depth := 2_000
+	graph := deepSimilarityGraph(depth)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	lines := make(chan int)
+	go func() {
+		n := 0
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			n++
+		}
+		lines <- n
+	}()
+	graph.Print()
+	w.Close()
+	os.Stdout = stdout
+
+	// a "Value:" line for every node, and a "Child" line for all but the root
+	if n := <-lines; n != 2*(2*depth+1)-1 {
+		t.Errorf(`Print() wrote %d lines, expected %d`, n, 2*(2*depth+1)-1)
+	}
 }
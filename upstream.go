@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+// How much each kind of evidence counts towards the likelihood of a repository being the upstream of its family.
+// Forge metadata is the most direct evidence there is, but it is only available for some repositories
+const (
+	weightLineage    = 0.35
+	weightForge      = 0.4
+	weightAge        = 0.15
+	weightPopularity = 0.1
+)
+
+// UpstreamCandidate is a family member ranked by how likely it is to be the original repository
+type UpstreamCandidate struct {
+	Source string
+	// the weighted average (0 to 1) of every signal that was available for this repository
+	Score float64
+	// the share (0 to 1) of the signal weights that was available
+	Coverage float64
+	// a human readable explanation of each signal
+	Evidence []string
+}
+
+// FamilyUpstream is the result of upstream inference for one family
+type FamilyUpstream struct {
+	Family Family
+	// most likely upstream first
+	Candidates []UpstreamCandidate
+	// how sure the inference is about the first candidate (0 to 1):
+	// the coverage of the first candidate, scaled by how far ahead of the second candidate it is
+	Confidence float64
+}
+
+// UpstreamSignals is the optional information about each source that upstream inference can use on top of the tree
+type UpstreamSignals struct {
+	// by source
+	URLs     map[string]string
+	Metadata map[string]utils.RepoMetadata
+	// the commit time of the root commit, for the sources it was recorded for when they were fingerprinted
+	FirstCommits map[string]time.Time
+}
+
+type upstreamScore struct {
+	weight   float64
+	total    float64
+	evidence []string
+}
+
+func (s *upstreamScore) add(weight float64, value float64, evidence string) {
+	s.weight += weight
+	s.total += weight * value
+	s.evidence = append(s.evidence, evidence)
+}
+
+// InferUpstreams ranks the members of every family with more than one member by how likely each is to be the
+// original that the others were forked or mirrored from. It combines:
+//   - lineage: the total length of history shared with the other members. An upstream shares all of the history
+//     each fork started from, while two forks only share what they had before the earlier of them split off
+//   - forge metadata: being named as the parent of other members, and not being a fork itself
+//   - age: the earliest first commit. Members that share their whole history also share their root commit, but
+//     repositories that were imported with a rewritten or squashed start, or that merged in an older history, do not
+//   - popularity: stars and recent pushes
+//
+// Signals that are not available for a repository are left out of its score instead of counting as zero.
+// Ties go to the member with the shorter history, i.e. the one the others continued from
+func InferUpstreams(graph *SimilarityTree, families []Family, signals UpstreamSignals) []FamilyUpstream {
+	results := []FamilyUpstream{}
+	for _, family := range families {
+		if len(family.Members) < 2 {
+			continue
+		}
+		results = append(results, inferUpstream(graph, family, signals))
+	}
+	return results
+}
+
+func inferUpstream(graph *SimilarityTree, family Family, signals UpstreamSignals) FamilyUpstream {
+	scores := make(map[string]*upstreamScore, len(family.Members))
+	for _, member := range family.Members {
+		scores[member] = &upstreamScore{}
+	}
+
+	// lineage
+	sharedTotals := map[string]int{}
+	maxShared := 0
+	for i, a := range family.Members {
+		for _, b := range family.Members[i+1:] {
+			comparison, err := graph.Compare(a, b)
+			if err != nil {
+				continue
+			}
+			sharedTotals[a] += comparison.Shared
+			sharedTotals[b] += comparison.Shared
+		}
+	}
+	for _, total := range sharedTotals {
+		maxShared = max(maxShared, total)
+	}
+	for _, member := range family.Members {
+		score := 0.0
+		if maxShared > 0 {
+			score = float64(sharedTotals[member]) / float64(maxShared)
+		}
+		scores[member].add(weightLineage, score, fmt.Sprintf("shares %d commits in total with the other %d members", sharedTotals[member], len(family.Members)-1))
+	}
+
+	// forge metadata
+	byURL := map[string]string{}
+	for _, member := range family.Members {
+		if u, has := signals.URLs[member]; has {
+			byURL[normalizeRepoURL(u)] = member
+		}
+	}
+	children := map[string][]string{}
+	for _, member := range family.Members {
+		if m, has := signals.Metadata[member]; has && m.IsFork && m.Parent != "" {
+			if parent, inFamily := byURL[normalizeRepoURL(m.Parent)]; inFamily {
+				children[parent] = append(children[parent], member)
+			}
+		}
+	}
+	for _, member := range family.Members {
+		m, hasMetadata := signals.Metadata[member]
+		switch {
+		case len(children[member]) > 0:
+			// the parent's own metadata may not have been fetched, but its forks' was
+			forge := forgeName(signals.Metadata[children[member][0]])
+			scores[member].add(weightForge, 1, fmt.Sprintf("%s lists it as the parent of %s", forge, strings.Join(children[member], ", ")))
+		case !hasMetadata:
+		case !m.IsFork:
+			scores[member].add(weightForge, 0.8, fmt.Sprintf("not a fork on %s", forgeName(m)))
+		case m.Parent != "":
+			scores[member].add(weightForge, 0, fmt.Sprintf("a fork of %s on %s", m.Parent, forgeName(m)))
+		default:
+			scores[member].add(weightForge, 0, fmt.Sprintf("a fork on %s", forgeName(m)))
+		}
+	}
+
+	// age
+	var earliest, latest time.Time
+	for _, member := range family.Members {
+		if first := signals.FirstCommits[member]; !first.IsZero() {
+			if earliest.IsZero() || first.Before(earliest) {
+				earliest = first
+			}
+			if latest.IsZero() || first.After(latest) {
+				latest = first
+			}
+		}
+	}
+	for _, member := range family.Members {
+		first := signals.FirstCommits[member]
+		if first.IsZero() {
+			continue
+		}
+		score := 1.0
+		if span := latest.Sub(earliest); span > 0 {
+			score = 1 - float64(first.Sub(earliest))/float64(span)
+		}
+		evidence := "first commit on " + first.Format(time.DateOnly)
+		if first.Equal(earliest) {
+			evidence += " (the earliest in the family)"
+		}
+		scores[member].add(weightAge, score, evidence)
+	}
+
+	// popularity
+	maxStars := 0
+	var lastPush time.Time
+	for _, member := range family.Members {
+		m := signals.Metadata[member]
+		maxStars = max(maxStars, m.Stars)
+		if m.Pushed.After(lastPush) {
+			lastPush = m.Pushed
+		}
+	}
+	for _, member := range family.Members {
+		m, has := signals.Metadata[member]
+		if !has || (maxStars == 0 && lastPush.IsZero()) {
+			continue
+		}
+		stars := 0.0
+		if maxStars > 0 {
+			stars = math.Log1p(float64(m.Stars)) / math.Log1p(float64(maxStars))
+		}
+		// activity fades out over the year before the most recent push in the family
+		activity := 0.0
+		if !m.Pushed.IsZero() {
+			activity = max(0, 1-lastPush.Sub(m.Pushed).Hours()/(365*24))
+		}
+		evidence := fmt.Sprintf("%d stars", m.Stars)
+		if !m.Pushed.IsZero() {
+			evidence += ", last pushed " + m.Pushed.Format(time.DateOnly)
+		}
+		scores[member].add(weightPopularity, (stars+activity)/2, evidence)
+	}
+
+	result := FamilyUpstream{Family: family}
+	for _, member := range family.Members {
+		s := scores[member]
+		result.Candidates = append(result.Candidates, UpstreamCandidate{
+			Source:   member,
+			Score:    s.total / s.weight,
+			Coverage: s.weight,
+			Evidence: s.evidence,
+		})
+	}
+	slices.SortFunc(result.Candidates, func(a, b UpstreamCandidate) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return compareByLength(graph, a.Source, b.Source)
+	})
+
+	top := result.Candidates[0]
+	margin := top.Score - result.Candidates[1].Score
+	result.Confidence = top.Coverage * (0.5 + 0.5*margin)
+	return result
+}
+
+func forgeName(m utils.RepoMetadata) string {
+	if m.Forge == "github" {
+		return "GitHub"
+	}
+	if m.Forge == "" {
+		return "the forge"
+	}
+	return m.Forge
+}
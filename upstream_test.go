@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MoralCode/CodeDNA/utils"
+)
+
+func upstreamFixture() (SimilarityTree, []Family) {
+	graph := NewSimilarityTree()
+	// one fork split off a while ago, the other one continued from where the upstream is now.
+	// Both the upstream and late-fork share the same amount of history with the rest of the family,
+	// the tie goes to the one the other continued from
+	graph.Add("upstream", "0123456789abcdef0123456789")
+	graph.Add("early-fork", "0123456789abcdef00")
+	graph.Add("late-fork", "0123456789abcdef0123456789ff")
+	graph.Add("loner", "fedcba9876543210fedcba9876543210")
+	return graph, graph.Families(DefaultFamilyOptions)
+}
+
+func TestInferUpstreamFromLineage(t *testing.T) {
+	graph, families := upstreamFixture()
+	results := InferUpstreams(&graph, families, UpstreamSignals{})
+	if len(results) != 1 {
+		t.Fatalf(`expected only the family with more than one member, got %d`, len(results))
+	}
+	result := results[0]
+	if result.Candidates[0].Source != "upstream" {
+		t.Errorf(`likely upstream = %q, expected %q`, result.Candidates[0].Source, "upstream")
+	}
+	// without metadata only the lineage weight is covered
+	if result.Candidates[0].Coverage != weightLineage || result.Confidence > weightLineage {
+		t.Errorf(`unexpected coverage %v and confidence %v`, result.Candidates[0].Coverage, result.Confidence)
+	}
+}
+
+func TestInferUpstreamFromMetadata(t *testing.T) {
+	graph, families := upstreamFixture()
+	signals := UpstreamSignals{
+		URLs: map[string]string{
+			"upstream":   "https://github.com/original/project",
+			"early-fork": "https://github.com/someone/project",
+			"late-fork":  "https://github.com/other/project",
+		},
+		Metadata: map[string]utils.RepoMetadata{
+			// the forge knows better: late-fork is the original that "upstream" was forked from
+			"upstream":   {Forge: "github", IsFork: true, Parent: "https://github.com/Other/project.git"},
+			"early-fork": {Forge: "github", IsFork: true, Parent: "https://github.com/other/project"},
+			"late-fork":  {Forge: "github", Stars: 500, Pushed: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		// the others were imported with a squashed start
+		FirstCommits: map[string]time.Time{
+			"upstream":   time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+			"early-fork": time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			"late-fork":  time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	result := InferUpstreams(&graph, families, signals)[0]
+	top := result.Candidates[0]
+	if top.Source != "late-fork" {
+		t.Fatalf(`likely upstream = %q, expected %q`, top.Source, "late-fork")
+	}
+	if top.Coverage < 0.999 || result.Confidence <= 0.5 {
+		t.Errorf(`expected full coverage and a confident result, got %v and %v`, top.Coverage, result.Confidence)
+	}
+	evidence := strings.Join(top.Evidence, "\n")
+	for _, expected := range []string{"GitHub lists it as the parent of early-fork, upstream", "first commit on 2015-01-01 (the earliest in the family)", "500 stars"} {
+		if !strings.Contains(evidence, expected) {
+			t.Errorf(`evidence is missing %q:\n%s`, expected, evidence)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type AliasKind string
+
+const (
+	AliasNickname AliasKind = "nickname"
+	AliasURL      AliasKind = "url"
+)
+
+// IdentityAlias is an additional name (or URL) that refers to an existing IdentityValue.
+// The nickname and url columns of the IdentityValue itself remain the "primary" names,
+// aliases exist so that mirrors and renamed projects can be found under all of their names
+type IdentityAlias struct {
+	ID         uint      `gorm:"primaryKey"`
+	IdentityID uint      `gorm:"index"`
+	Kind       AliasKind `gorm:"uniqueIndex:idx_alias_kind_value"`
+	Value      string    `gorm:"uniqueIndex:idx_alias_kind_value"`
+}
+
+// Resolve looks up a repository by any of its names: its nickname, its URL, or any alias of either kind
+func (cache *IdentityCache) Resolve(name string) (*IdentityValue, error) {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+	return resolve(cache.db, name)
+}
+
+func resolve(tx *gorm.DB, name string) (*IdentityValue, error) {
+	var identity IdentityValue
+	result := tx.Take(&identity, "nickname = ? OR url = ?", name, name)
+	if result.Error == nil {
+		return &identity, nil
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
+	}
+
+	var alias IdentityAlias
+	result = tx.Take(&alias, "value = ?", name)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	result = tx.Take(&identity, alias.IdentityID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &identity, nil
+}
+
+// AddAlias records an additional nickname or URL for the repository with the given ID.
+// Adding a name that already refers to the same repository is a no-op,
+// adding a name that refers to a different repository is an error
+func (cache *IdentityCache) AddAlias(identityID uint, kind AliasKind, value string) error {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+	return cache.db.Transaction(func(tx *gorm.DB) error {
+		return addAlias(tx, identityID, kind, value)
+	})
+}
+
+func addAlias(tx *gorm.DB, identityID uint, kind AliasKind, value string) error {
+	if value == "" {
+		return errors.New("alias must not be empty")
+	}
+	if kind != AliasNickname && kind != AliasURL {
+		return fmt.Errorf("unknown alias kind %q", kind)
+	}
+
+	var owner IdentityValue
+	result := tx.Take(&owner, "nickname = ? OR url = ?", value, value)
+	if result.Error == nil {
+		if owner.ID == identityID {
+			return nil
+		}
+		return fmt.Errorf("%q already refers to repository %d", value, owner.ID)
+	} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return result.Error
+	}
+
+	var existing IdentityAlias
+	result = tx.Take(&existing, "value = ?", value)
+	if result.Error == nil {
+		if existing.IdentityID == identityID {
+			return nil
+		}
+		return fmt.Errorf("%q is already an alias of repository %d", value, existing.IdentityID)
+	} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return result.Error
+	}
+
+	return tx.Create(&IdentityAlias{
+		IdentityID: identityID,
+		Kind:       kind,
+		Value:      value,
+	}).Error
+}
+
+// Aliases lists every alias recorded for the repository with the given ID
+func (cache *IdentityCache) Aliases(identityID uint) ([]IdentityAlias, error) {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+	var aliases []IdentityAlias
+	result := cache.db.Order("kind, value").Find(&aliases, "identity_id = ?", identityID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return aliases, nil
+}
+
+// Merge folds the repository `duplicate` into `keep`, for when two rows turn out to be the same project.
+// The nickname and URL of the duplicate become aliases of the kept row, its aliases and history are moved over
+// and the duplicate row is deleted. The kept row's lineage ID is left untouched.
+func (cache *IdentityCache) Merge(keep uint, duplicate uint) error {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+	if keep == duplicate {
+		return errors.New("cannot merge a repository with itself")
+	}
+	return cache.db.Transaction(func(tx *gorm.DB) error {
+		var kept, dup IdentityValue
+		if err := tx.Take(&kept, keep).Error; err != nil {
+			return err
+		}
+		if err := tx.Take(&dup, duplicate).Error; err != nil {
+			return err
+		}
+
+		result := tx.Model(&IdentityAlias{}).Where("identity_id = ?", dup.ID).Update("identity_id", kept.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&IdentityHistory{}).Where("identity_id = ?", dup.ID).Update("identity_id", kept.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		// the names have to be freed up before they can be re-added as aliases
+		if err := tx.Delete(&dup).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("identity_id = ?", dup.ID).Delete(&RepoMetadata{}).Error; err != nil {
+			return err
+		}
+		if err := addAlias(tx, kept.ID, AliasURL, dup.URL); err != nil {
+			return err
+		}
+		if dup.Nickname != "" && dup.Nickname != dup.URL {
+			if err := addAlias(tx, kept.ID, AliasNickname, dup.Nickname); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Split detaches a URL alias from a repository and turns it into a repository of its own,
+// for when a mirror turns out to be a separate project after all.
+// Any nicknames given are moved along with it, the first one becoming the nickname of the new row.
+// The new row starts out with the lineage ID of the original until it is analyzed again.
+func (cache *IdentityCache) Split(identityID uint, url string, nicknames ...string) (*IdentityValue, error) {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+	var created IdentityValue
+	err := cache.db.Transaction(func(tx *gorm.DB) error {
+		var original IdentityValue
+		if err := tx.Take(&original, identityID).Error; err != nil {
+			return err
+		}
+
+		moved := append([]string{url}, nicknames...)
+		for i, name := range moved {
+			kind := AliasNickname
+			if i == 0 {
+				kind = AliasURL
+			}
+			result := tx.Where("identity_id = ? AND kind = ? AND value = ?", original.ID, kind, name).Delete(&IdentityAlias{})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return fmt.Errorf("%q is not a %s alias of repository %d", name, kind, original.ID)
+			}
+		}
+
+		created = IdentityValue{
+			URL:       url,
+			Nickname:  url,
+			LineageID: original.LineageID,
+		}
+		if len(nicknames) > 0 {
+			created.Nickname = nicknames[0]
+		}
+		if err := tx.Create(&created).Error; err != nil {
+			return err
+		}
+		for _, name := range nicknames[min(1, len(nicknames)):] {
+			if err := addAlias(tx, created.ID, AliasNickname, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
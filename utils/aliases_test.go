@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T) IdentityCache {
+	return IdentityCache{
+		Filename: t.TempDir() + "/cache.sqlite",
+	}
+}
+
+func TestResolveAliases(t *testing.T) {
+	cache := newTestCache(t)
+	err := cache.Add(IdentityValue{
+		URL:       "https://example.com/project",
+		Nickname:  "project",
+		LineageID: "abcd1234",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := cache.Resolve("project")
+	if err != nil {
+		t.Fatalf(`Resolve() by nickname failed: %v`, err)
+	}
+
+	if err := cache.AddAlias(original.ID, AliasNickname, "old-name"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.AddAlias(original.ID, AliasURL, "https://mirror.example.org/project"); err != nil {
+		t.Fatal(err)
+	}
+	// re-adding is a no-op
+	if err := cache.AddAlias(original.ID, AliasNickname, "old-name"); err != nil {
+		t.Errorf(`AddAlias() of an existing alias failed: %v`, err)
+	}
+
+	for _, name := range []string{"project", "https://example.com/project", "old-name", "https://mirror.example.org/project"} {
+		v, err := cache.Resolve(name)
+		if err != nil || v.ID != original.ID {
+			t.Errorf(`Resolve(%q) = %v, %v, expected repository %d`, name, v, err, original.ID)
+		}
+	}
+
+	if !cache.Has("mirror.example.org/project") {
+		t.Errorf(`Has() does not match url aliases`)
+	}
+
+	if _, err := cache.Resolve("unknown"); err == nil {
+		t.Errorf(`Resolve() of an unknown name should fail`)
+	}
+
+	aliases, err := cache.Aliases(original.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 2 {
+		t.Errorf(`Aliases() returned %d aliases, expected %d`, len(aliases), 2)
+	}
+}
+
+func TestAliasConflict(t *testing.T) {
+	cache := newTestCache(t)
+	cache.Add(IdentityValue{URL: "https://example.com/a", Nickname: "a", LineageID: "ab"})
+	cache.Add(IdentityValue{URL: "https://example.com/b", Nickname: "b", LineageID: "cd"})
+
+	a, _ := cache.Resolve("a")
+	b, _ := cache.Resolve("b")
+
+	if err := cache.AddAlias(a.ID, AliasNickname, "b"); err == nil {
+		t.Errorf(`AddAlias() should refuse a name that belongs to another repository`)
+	}
+
+	cache.AddAlias(a.ID, AliasNickname, "shared")
+	if err := cache.AddAlias(b.ID, AliasNickname, "shared"); err == nil {
+		t.Errorf(`AddAlias() should refuse an alias that belongs to another repository`)
+	}
+}
+
+func TestMergeAndSplit(t *testing.T) {
+	cache := newTestCache(t)
+	cache.Add(IdentityValue{URL: "https://example.com/a", Nickname: "a", LineageID: "abcd"})
+	cache.Add(IdentityValue{URL: "https://mirror.example.org/a", Nickname: "a-mirror", LineageID: "abcd"})
+
+	keep, _ := cache.Resolve("a")
+	dup, _ := cache.Resolve("a-mirror")
+	cache.AddAlias(dup.ID, AliasNickname, "a-mirror-old")
+	if err := recordHistory(cache.db, dup.ID, "abc", time.Now(), "refresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Merge(keep.ID, dup.ID); err != nil {
+		t.Fatalf(`Merge() failed: %v`, err)
+	}
+
+	all, _ := cache.GetAll()
+	if len(all) != 1 {
+		t.Errorf(`expected %d repositories after merge, found %d`, 1, len(all))
+	}
+
+	for _, name := range []string{"a-mirror", "a-mirror-old", "https://mirror.example.org/a"} {
+		v, err := cache.Resolve(name)
+		if err != nil || v.ID != keep.ID {
+			t.Errorf(`Resolve(%q) after merge = %v, %v, expected repository %d`, name, v, err, keep.ID)
+		}
+	}
+	// the history of the duplicate goes along with it
+	if history, err := cache.History(keep.ID); err != nil || len(history) != 1 || history[0].LineageID != "abc" {
+		t.Errorf(`History() of the kept repository after merge = %+v, %v`, history, err)
+	}
+	if history, _ := cache.History(dup.ID); len(history) != 0 {
+		t.Errorf(`the duplicate still has %d history entries after merge`, len(history))
+	}
+
+	split, err := cache.Split(keep.ID, "https://mirror.example.org/a", "a-mirror", "a-mirror-old")
+	if err != nil {
+		t.Fatalf(`Split() failed: %v`, err)
+	}
+	if split.Nickname != "a-mirror" || split.LineageID != "abcd" {
+		t.Errorf(`Split() created %+v`, split)
+	}
+	for _, name := range []string{"a-mirror", "a-mirror-old", "https://mirror.example.org/a"} {
+		v, err := cache.Resolve(name)
+		if err != nil || v.ID != split.ID {
+			t.Errorf(`Resolve(%q) after split = %v, %v, expected repository %d`, name, v, err, split.ID)
+		}
+	}
+
+	if _, err := cache.Split(keep.ID, "https://not-an-alias.example.org"); err == nil {
+		t.Errorf(`Split() of a url that is not an alias should fail`)
+	}
+}
@@ -1,16 +1,16 @@
 package utils
 
 import (
-	"encoding/csv"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
+	"strings"
 	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -33,16 +33,76 @@ type IdentityValue struct {
 	Timestamp time.Time `gorm:"default:current_timestamp"`
 	URL       string    `gorm:"unique"`
 	LineageID string
+	// the object format of the repository the lineage ID was computed from, as git names it (sha1 or sha256).
+	// Lineage IDs of different object formats can't be compared. Empty for rows cached before it was recorded,
+	// which are all SHA-1
+	HashAlgorithm string
+	// the number of bits of each commit hash that the lineage ID keeps. 0 for rows cached before it was recorded,
+	// which all kept 4 (see LineagePrefixLength)
+	PrefixLength uint8
+	// the commit time of the oldest commit in the lineage ID, zero when it is not known
+	FirstCommit time.Time
+}
+
+// DefaultPrefixLength is the prefix length of lineage IDs that were cached without one
+const DefaultPrefixLength uint8 = 4
+
+// LineagePrefixLength returns the number of bits of each commit hash that the lineage ID keeps
+func (identity IdentityValue) LineagePrefixLength() uint8 {
+	return prefixLengthOrDefault(identity.PrefixLength)
+}
+
+func prefixLengthOrDefault(prefixLength uint8) uint8 {
+	if prefixLength == 0 {
+		return DefaultPrefixLength
+	}
+	return prefixLength
+}
+
+// LineageCommitCount returns the number of commits in a lineage ID. Each commit is written as as many hex digits
+// as it takes to hold its prefix, which is one for every prefix length up to 4 bits
+func LineageCommitCount(lineageID string, prefixLength uint8) int {
+	return len(lineageID) / lineageDigitsPerCommit(prefixLength)
+}
+
+func lineageDigitsPerCommit(prefixLength uint8) int {
+	return max(1, (int(prefixLengthOrDefault(prefixLength))+3)/4)
+}
+
+// DefaultHashAlgorithm is the hash algorithm of lineage IDs that were cached without one
+const DefaultHashAlgorithm = "sha1"
+
+// SameHashAlgorithm reports whether two recorded hash algorithms are the same, taking missing ones as SHA-1
+func SameHashAlgorithm(a string, b string) bool {
+	if a == "" {
+		a = DefaultHashAlgorithm
+	}
+	if b == "" {
+		b = DefaultHashAlgorithm
+	}
+	return strings.EqualFold(a, b)
+}
+
+func gormConfig() *gorm.Config {
+	return &gorm.Config{
+		// lookups that find nothing are expected (that's what Has() and friends are for)
+		Logger: logger.New(log.New(os.Stderr, "\r\n", log.LstdFlags), logger.Config{
+			SlowThreshold:             200 * time.Millisecond,
+			LogLevel:                  logger.Warn,
+			IgnoreRecordNotFoundError: true,
+			Colorful:                  true,
+		}),
+	}
 }
 
 func (cache *IdentityCache) connect(automigrate bool) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(cache.Filename), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(cache.Filename), gormConfig())
 	if err != nil {
 		return nil, err
 	}
 	if automigrate {
 		// Perform database migration
-		err = db.AutoMigrate(&IdentityValue{})
+		err = db.AutoMigrate(&IdentityValue{}, &IdentityAlias{}, &IdentityHistory{}, &RepoMetadata{})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -51,6 +111,17 @@ func (cache *IdentityCache) connect(automigrate bool) (*gorm.DB, error) {
 	return db, nil
 }
 
+// connectReadOnly opens the database without migrating it, for reading a database that belongs to someone else
+// (such as the other side of a merge) without writing anything to it
+func (cache *IdentityCache) connectReadOnly() (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open("file:"+cache.Filename+"?mode=ro"), gormConfig())
+	if err != nil {
+		return nil, err
+	}
+	cache.db = db
+	return db, nil
+}
+
 func (cache *IdentityCache) GetAll() ([]IdentityValue, error) {
 	if cache.db == nil {
 		cache.connect(true)
@@ -67,6 +138,23 @@ func (cache *IdentityCache) GetAll() ([]IdentityValue, error) {
 	return identities, nil
 }
 
+// GetStale returns every repository that was last fingerprinted before the given time
+func (cache *IdentityCache) GetStale(before time.Time) ([]IdentityValue, error) {
+	identities, err := cache.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	// timestamps can be written by sqlite (current_timestamp) or by gorm in different text formats,
+	// so these are compared after parsing rather than in sql
+	stale := []IdentityValue{}
+	for _, v := range identities {
+		if v.Timestamp.Before(before) {
+			stale = append(stale, v)
+		}
+	}
+	return stale, nil
+}
+
 func (cache *IdentityCache) GetByNickname(nickname string) (*IdentityValue, error) {
 	if cache.db == nil {
 		cache.connect(true)
@@ -93,9 +181,10 @@ func (cache *IdentityCache) Has(source string) bool {
 	}
 	var identity IdentityValue
 	result := cache.db.Take(&identity, "url LIKE ?", "%"+source)
-	// one of these is printing an error?
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return false
+		// mirrors and renamed repositories are recorded as url aliases
+		var alias IdentityAlias
+		result = cache.db.Take(&alias, "kind = ? AND value LIKE ?", AliasURL, "%"+source)
 	}
 	if result.Error != nil {
 		return false
@@ -115,36 +204,7 @@ func (cache *IdentityCache) Add(identity IdentityValue) error {
 	return nil
 }
 
-func (cache *IdentityCache) ExportAllToCSV(destination string) {
-	data, err := cache.GetAll()
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	csvFile, err := os.Create(destination)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer csvFile.Close()
-
-	csvWriter := csv.NewWriter(csvFile)
-	err = csvWriter.Write([]string{"id", "source", "lineage_id"})
-	if err != nil {
-		// an error occurred during the flush
-		fmt.Println(err)
-	}
-	for _, v := range data {
-		err = csvWriter.Write([]string{strconv.FormatUint(uint64(v.ID), 10), v.URL, v.LineageID})
-		if err != nil {
-			// an error occurred during the flush
-			fmt.Println(err)
-		}
-	}
-
-	csvWriter.Flush()
-	err = csvWriter.Error()
-	if err != nil {
-		// an error occurred during the flush
-		fmt.Println(err)
-	}
+// ExportAllToCSV writes every cached repository to a CSV file, see Export for the other formats
+func (cache *IdentityCache) ExportAllToCSV(destination string) error {
+	return cache.ExportToFile(destination, FormatCSV)
 }
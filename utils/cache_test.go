@@ -33,3 +33,20 @@ func TestHas(t *testing.T) {
 	}
 
 }
+
+func TestLineageCommitCount(t *testing.T) {
+	for _, c := range []struct {
+		lineageID    string
+		prefixLength uint8
+		expected     int
+	}{
+		{"0f3a", 0, 4},
+		{"0f3a", 4, 4},
+		{"0103", 1, 4},
+		{"", 4, 0},
+	} {
+		if count := LineageCommitCount(c.lineageID, c.prefixLength); count != c.expected {
+			t.Errorf(`LineageCommitCount(%q, %d) = %d, expected %d`, c.lineageID, c.prefixLength, count, c.expected)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ExportSchemaVersion is bumped whenever the layout of exported records changes in a way
+// that older versions of this tool would not be able to read back
+const ExportSchemaVersion = 3
+
+type ExportFormat string
+
+const (
+	FormatCSV    ExportFormat = "csv"
+	FormatJSON   ExportFormat = "json"
+	FormatNDJSON ExportFormat = "ndjson"
+	// parquet is export only, see ExportParquet
+	FormatParquet ExportFormat = "parquet"
+)
+
+var csvExportHeaders = []string{"schema_version", "id", "nickname", "url", "lineage_id", "timestamp", "aliases", "hash_algorithm", "prefix_length", "first_commit",
+	"forge", "is_fork", "parent", "stars", "created", "pushed", "metadata_fetched_at", "history"}
+
+// version 1 exports have no hash_algorithm, prefix_length and first_commit columns, since every lineage ID was SHA-1
+// with 4 bit prefixes back then
+const csvExportV1Columns = 7
+
+// version 2 exports end at first_commit, the forge metadata and history columns were added in version 3
+const csvExportV2Columns = 10
+
+// ExportAlias is the exported form of an IdentityAlias
+type ExportAlias struct {
+	Kind  AliasKind `json:"kind"`
+	Value string    `json:"value"`
+}
+
+// ExportMetadata is the exported form of a RepoMetadata, which belongs to the record it is exported with
+type ExportMetadata struct {
+	Forge     string    `json:"forge"`
+	IsFork    bool      `json:"is_fork"`
+	Parent    string    `json:"parent,omitempty"`
+	Stars     int       `json:"stars"`
+	Created   time.Time `json:"created"`
+	Pushed    time.Time `json:"pushed"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// ExportHistory is the exported form of an IdentityHistory, which belongs to the record it is exported with
+type ExportHistory struct {
+	LineageID  string    `json:"lineage_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	ReplacedAt time.Time `json:"replaced_at"`
+	Reason     string    `json:"reason"`
+}
+
+// ExportRecord carries every field of a cached repository, including its aliases, its forge metadata and the
+// lineage IDs it used to have.
+// ID is informational only, imports match existing rows by URL so that caches from different machines can be combined
+type ExportRecord struct {
+	ID        uint          `json:"id"`
+	Nickname  string        `json:"nickname"`
+	URL       string        `json:"url"`
+	LineageID string        `json:"lineage_id"`
+	Timestamp time.Time     `json:"timestamp"`
+	Aliases   []ExportAlias `json:"aliases,omitempty"`
+	// see IdentityValue.HashAlgorithm, IdentityValue.PrefixLength and IdentityValue.FirstCommit, missing from version 1 exports
+	HashAlgorithm string    `json:"hash_algorithm,omitempty"`
+	PrefixLength  uint8     `json:"prefix_length,omitempty"`
+	FirstCommit   time.Time `json:"first_commit"`
+	// missing from exports before version 3
+	Metadata *ExportMetadata `json:"metadata,omitempty"`
+	History  []ExportHistory `json:"history,omitempty"`
+}
+
+type exportDocument struct {
+	SchemaVersion int            `json:"schema_version"`
+	Repositories  []ExportRecord `json:"repositories"`
+}
+
+// the first line of an ndjson export, every following line is one ExportRecord
+type ndjsonHeader struct {
+	SchemaVersion int `json:"schema_version"`
+}
+
+// ExportFormatFromPath guesses the export format from a file extension
+func ExportFormatFromPath(path string) (ExportFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return FormatCSV, nil
+	case ".json":
+		return FormatJSON, nil
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON, nil
+	case ".parquet":
+		return FormatParquet, nil
+	}
+	return "", fmt.Errorf("cannot determine export format of %q", path)
+}
+
+// ExportRecords reads every cached repository along with its aliases, forge metadata and history
+func (cache *IdentityCache) ExportRecords() ([]ExportRecord, error) {
+	identities, err := cache.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var aliases []IdentityAlias
+	// databases that were opened without migrating them may predate aliases
+	if cache.db.Migrator().HasTable(&IdentityAlias{}) {
+		result := cache.db.Order("identity_id, kind, value").Find(&aliases)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+	}
+	aliasesByIdentity := map[uint][]ExportAlias{}
+	for _, alias := range aliases {
+		aliasesByIdentity[alias.IdentityID] = append(aliasesByIdentity[alias.IdentityID], ExportAlias{Kind: alias.Kind, Value: alias.Value})
+	}
+	var metadata []RepoMetadata
+	if cache.db.Migrator().HasTable(&RepoMetadata{}) {
+		if err := cache.db.Find(&metadata).Error; err != nil {
+			return nil, err
+		}
+	}
+	metadataByIdentity := map[uint]*ExportMetadata{}
+	for _, m := range metadata {
+		metadataByIdentity[m.IdentityID] = &ExportMetadata{
+			Forge:     m.Forge,
+			IsFork:    m.IsFork,
+			Parent:    m.Parent,
+			Stars:     m.Stars,
+			Created:   m.Created,
+			Pushed:    m.Pushed,
+			FetchedAt: m.FetchedAt,
+		}
+	}
+	var history []IdentityHistory
+	if cache.db.Migrator().HasTable(&IdentityHistory{}) {
+		if err := cache.db.Order("identity_id, replaced_at, id").Find(&history).Error; err != nil {
+			return nil, err
+		}
+	}
+	historyByIdentity := map[uint][]ExportHistory{}
+	for _, h := range history {
+		historyByIdentity[h.IdentityID] = append(historyByIdentity[h.IdentityID], ExportHistory{
+			LineageID:  h.LineageID,
+			Timestamp:  h.Timestamp,
+			ReplacedAt: h.ReplacedAt,
+			Reason:     h.Reason,
+		})
+	}
+
+	records := make([]ExportRecord, 0, len(identities))
+	for _, v := range identities {
+		records = append(records, ExportRecord{
+			ID:            v.ID,
+			Nickname:      v.Nickname,
+			URL:           v.URL,
+			LineageID:     v.LineageID,
+			Timestamp:     v.Timestamp,
+			Aliases:       aliasesByIdentity[v.ID],
+			HashAlgorithm: v.HashAlgorithm,
+			PrefixLength:  v.PrefixLength,
+			FirstCommit:   v.FirstCommit,
+			Metadata:      metadataByIdentity[v.ID],
+			History:       historyByIdentity[v.ID],
+		})
+	}
+	return records, nil
+}
+
+// Export writes the whole cache to w in the given format
+func (cache *IdentityCache) Export(w io.Writer, format ExportFormat) error {
+	records, err := cache.ExportRecords()
+	if err != nil {
+		return err
+	}
+	return WriteExport(w, records, format)
+}
+
+// ExportToFile writes the whole cache to the file at destination in the given format
+func (cache *IdentityCache) ExportToFile(destination string, format ExportFormat) error {
+	return writeFile(destination, func(w io.Writer) error {
+		return cache.Export(w, format)
+	})
+}
+
+// WriteExport serializes records in the given format
+func WriteExport(w io.Writer, records []ExportRecord, format ExportFormat) error {
+	switch format {
+	case FormatParquet:
+		return errors.New("parquet exports are written by ExportParquet")
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(exportDocument{
+			SchemaVersion: ExportSchemaVersion,
+			Repositories:  records,
+		})
+	case FormatNDJSON:
+		encoder := json.NewEncoder(w)
+		err := encoder.Encode(ndjsonHeader{SchemaVersion: ExportSchemaVersion})
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			err = encoder.Encode(record)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		csvWriter := csv.NewWriter(w)
+		err := csvWriter.Write(csvExportHeaders)
+		if err != nil {
+			return err
+		}
+		version := strconv.Itoa(ExportSchemaVersion)
+		for _, v := range records {
+			// aliases are stored one per line as kind:value
+			aliases := make([]string, 0, len(v.Aliases))
+			for _, alias := range v.Aliases {
+				aliases = append(aliases, string(alias.Kind)+":"+alias.Value)
+			}
+			// history is stored one entry per line as replaced_at timestamp lineage_id reason
+			history := make([]string, 0, len(v.History))
+			for _, h := range v.History {
+				history = append(history, h.ReplacedAt.Format(time.RFC3339Nano)+" "+h.Timestamp.Format(time.RFC3339Nano)+" "+h.LineageID+" "+h.Reason)
+			}
+			// repositories without forge metadata leave its columns empty
+			metadata := make([]string, 7)
+			if m := v.Metadata; m != nil {
+				metadata = []string{
+					m.Forge,
+					strconv.FormatBool(m.IsFork),
+					m.Parent,
+					strconv.Itoa(m.Stars),
+					formatOptionalTime(m.Created),
+					formatOptionalTime(m.Pushed),
+					m.FetchedAt.Format(time.RFC3339Nano),
+				}
+			}
+			row := []string{
+				version,
+				strconv.FormatUint(uint64(v.ID), 10),
+				v.Nickname,
+				v.URL,
+				v.LineageID,
+				v.Timestamp.Format(time.RFC3339Nano),
+				strings.Join(aliases, "\n"),
+				v.HashAlgorithm,
+				strconv.FormatUint(uint64(v.PrefixLength), 10),
+				formatOptionalTime(v.FirstCommit),
+			}
+			row = append(row, metadata...)
+			err = csvWriter.Write(append(row, strings.Join(history, "\n")))
+			if err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// formatOptionalTime writes unknown (zero) times as an empty CSV field
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// parseOptionalTime reads a time written by formatOptionalTime
+func parseOptionalTime(field string) (time.Time, error) {
+	if field == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, field)
+}
+
+// parseCSVMetadata reads the forge metadata columns of a version 3 export row, which are empty when there is none
+func parseCSVMetadata(columns []string) (*ExportMetadata, error) {
+	if columns[6] == "" {
+		return nil, nil
+	}
+	isFork, err := strconv.ParseBool(columns[1])
+	if err != nil {
+		return nil, err
+	}
+	stars, err := strconv.Atoi(columns[3])
+	if err != nil {
+		return nil, err
+	}
+	created, err := parseOptionalTime(columns[4])
+	if err != nil {
+		return nil, err
+	}
+	pushed, err := parseOptionalTime(columns[5])
+	if err != nil {
+		return nil, err
+	}
+	fetchedAt, err := time.Parse(time.RFC3339Nano, columns[6])
+	if err != nil {
+		return nil, err
+	}
+	return &ExportMetadata{
+		Forge:     columns[0],
+		IsFork:    isFork,
+		Parent:    columns[2],
+		Stars:     stars,
+		Created:   created,
+		Pushed:    pushed,
+		FetchedAt: fetchedAt,
+	}, nil
+}
+
+// parseCSVHistory reads the history column of a version 3 export row
+func parseCSVHistory(column string) ([]ExportHistory, error) {
+	if column == "" {
+		return nil, nil
+	}
+	history := []ExportHistory{}
+	for _, line := range strings.Split(column, "\n") {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid history entry %q", line)
+		}
+		replacedAt, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, err
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, fields[1])
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, ExportHistory{LineageID: fields[2], Timestamp: timestamp, ReplacedAt: replacedAt, Reason: fields[3]})
+	}
+	return history, nil
+}
+
+func checkSchemaVersion(version int) error {
+	if version < 1 || version > ExportSchemaVersion {
+		return fmt.Errorf("unsupported export schema version %d (this build supports up to %d)", version, ExportSchemaVersion)
+	}
+	return nil
+}
+
+// ReadExport parses records previously written by WriteExport
+func ReadExport(r io.Reader, format ExportFormat) ([]ExportRecord, error) {
+	switch format {
+	case FormatJSON:
+		var document exportDocument
+		err := json.NewDecoder(r).Decode(&document)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSchemaVersion(document.SchemaVersion); err != nil {
+			return nil, err
+		}
+		return document.Repositories, nil
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		// lineage IDs of large repositories make for long lines
+		scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("export is empty")
+		}
+		var header ndjsonHeader
+		if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+			return nil, fmt.Errorf("invalid export header: %w", err)
+		}
+		if err := checkSchemaVersion(header.SchemaVersion); err != nil {
+			return nil, err
+		}
+		records := []ExportRecord{}
+		for line := 2; scanner.Scan(); line++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			var record ExportRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			records = append(records, record)
+		}
+		return records, scanner.Err()
+	case FormatCSV:
+		csvReader := csv.NewReader(r)
+		rows, err := csvReader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		columns := 0
+		if len(rows) > 0 {
+			columns = len(rows[0])
+		}
+		if (columns != csvExportV1Columns && columns != csvExportV2Columns && columns != len(csvExportHeaders)) || rows[0][0] != csvExportHeaders[0] {
+			return nil, errors.New("csv file is not an export (missing header)")
+		}
+		records := make([]ExportRecord, 0, len(rows)-1)
+		for i, row := range rows[1:] {
+			version, err := strconv.Atoi(row[0])
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %w", i+1, err)
+			}
+			if err := checkSchemaVersion(version); err != nil {
+				return nil, err
+			}
+			id, err := strconv.ParseUint(row[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %w", i+1, err)
+			}
+			timestamp, err := time.Parse(time.RFC3339Nano, row[5])
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %w", i+1, err)
+			}
+			record := ExportRecord{
+				ID:        uint(id),
+				Nickname:  row[2],
+				URL:       row[3],
+				LineageID: row[4],
+				Timestamp: timestamp,
+			}
+			if len(row) > 7 {
+				record.HashAlgorithm = row[7]
+			}
+			if len(row) > 8 {
+				prefixLength, err := strconv.ParseUint(row[8], 10, 8)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: %w", i+1, err)
+				}
+				record.PrefixLength = uint8(prefixLength)
+			}
+			if len(row) > 9 && row[9] != "" {
+				record.FirstCommit, err = time.Parse(time.RFC3339Nano, row[9])
+				if err != nil {
+					return nil, fmt.Errorf("row %d: %w", i+1, err)
+				}
+			}
+			if len(row) == len(csvExportHeaders) {
+				record.Metadata, err = parseCSVMetadata(row[csvExportV2Columns : len(row)-1])
+				if err != nil {
+					return nil, fmt.Errorf("row %d: %w", i+1, err)
+				}
+				record.History, err = parseCSVHistory(row[len(row)-1])
+				if err != nil {
+					return nil, fmt.Errorf("row %d: %w", i+1, err)
+				}
+			}
+			if row[6] != "" {
+				for _, alias := range strings.Split(row[6], "\n") {
+					kind, value, found := strings.Cut(alias, ":")
+					if !found {
+						return nil, fmt.Errorf("row %d: invalid alias %q", i+1, alias)
+					}
+					record.Aliases = append(record.Aliases, ExportAlias{Kind: AliasKind(kind), Value: value})
+				}
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+	if format == FormatParquet {
+		return nil, errors.New("parquet exports cannot be imported, use json, ndjson or csv instead")
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// ImportSummary counts what happened to each record during an import
+type ImportSummary struct {
+	Added     int
+	Updated   int
+	Unchanged int
+}
+
+// ImportRecords restores exported records into the cache without any network access.
+// Records are matched to existing rows by URL, existing rows take on the exported values (forge metadata included).
+// History entries are added unless the row already has the same entry
+func (cache *IdentityCache) ImportRecords(records []ExportRecord) (ImportSummary, error) {
+	summary := ImportSummary{}
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return summary, fmt.Errorf("database connection is nil")
+	}
+	err := cache.db.Transaction(func(tx *gorm.DB) error {
+		for _, record := range records {
+			if record.URL == "" {
+				return fmt.Errorf("record %d has no url", record.ID)
+			}
+			var identity IdentityValue
+			result := tx.Take(&identity, "url = ?", record.URL)
+			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+				identity = IdentityValue{
+					Nickname:      record.Nickname,
+					URL:           record.URL,
+					LineageID:     record.LineageID,
+					Timestamp:     record.Timestamp,
+					HashAlgorithm: record.HashAlgorithm,
+					PrefixLength:  record.PrefixLength,
+					FirstCommit:   record.FirstCommit,
+				}
+				if err := tx.Create(&identity).Error; err != nil {
+					return fmt.Errorf("adding %s: %w", record.URL, err)
+				}
+				summary.Added += 1
+			} else if result.Error != nil {
+				return result.Error
+			} else if identity.Nickname != record.Nickname || identity.LineageID != record.LineageID || !identity.Timestamp.Equal(record.Timestamp) ||
+				!SameHashAlgorithm(identity.HashAlgorithm, record.HashAlgorithm) ||
+				identity.LineagePrefixLength() != prefixLengthOrDefault(record.PrefixLength) || !identity.FirstCommit.Equal(record.FirstCommit) {
+				identity.Nickname = record.Nickname
+				identity.LineageID = record.LineageID
+				identity.Timestamp = record.Timestamp
+				identity.HashAlgorithm = record.HashAlgorithm
+				identity.PrefixLength = record.PrefixLength
+				identity.FirstCommit = record.FirstCommit
+				if err := tx.Save(&identity).Error; err != nil {
+					return fmt.Errorf("updating %s: %w", record.URL, err)
+				}
+				summary.Updated += 1
+			} else {
+				summary.Unchanged += 1
+			}
+
+			for _, alias := range record.Aliases {
+				if err := addAlias(tx, identity.ID, alias.Kind, alias.Value); err != nil {
+					return fmt.Errorf("adding alias of %s: %w", record.URL, err)
+				}
+			}
+			if m := record.Metadata; m != nil {
+				metadata := RepoMetadata{
+					IdentityID: identity.ID,
+					Forge:      m.Forge,
+					IsFork:     m.IsFork,
+					Parent:     m.Parent,
+					Stars:      m.Stars,
+					Created:    m.Created,
+					Pushed:     m.Pushed,
+					FetchedAt:  m.FetchedAt,
+				}
+				var existing RepoMetadata
+				result := tx.Take(&existing, "identity_id = ?", identity.ID)
+				if result.Error == nil {
+					metadata.ID = existing.ID
+				} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+					return result.Error
+				}
+				if err := tx.Save(&metadata).Error; err != nil {
+					return fmt.Errorf("adding metadata of %s: %w", record.URL, err)
+				}
+			}
+			for _, h := range record.History {
+				var count int64
+				err := tx.Model(&IdentityHistory{}).Where("identity_id = ? AND lineage_id = ? AND replaced_at = ? AND reason = ?",
+					identity.ID, h.LineageID, h.ReplacedAt, h.Reason).Count(&count).Error
+				if err != nil {
+					return err
+				}
+				if count > 0 {
+					continue
+				}
+				err = tx.Create(&IdentityHistory{
+					IdentityID: identity.ID,
+					LineageID:  h.LineageID,
+					Timestamp:  h.Timestamp,
+					ReplacedAt: h.ReplacedAt,
+					Reason:     h.Reason,
+				}).Error
+				if err != nil {
+					return fmt.Errorf("adding history of %s: %w", record.URL, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	return summary, nil
+}
+
+// ImportFromFile restores an export file into the cache
+func (cache *IdentityCache) ImportFromFile(source string, format ExportFormat) (ImportSummary, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	defer f.Close()
+	records, err := ReadExport(f, format)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	return cache.ImportRecords(records)
+}
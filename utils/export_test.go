@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	source := newTestCache(t)
+	timestamp := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	source.Add(IdentityValue{URL: "https://example.com/a", Nickname: "a", LineageID: "abcd", Timestamp: timestamp})
+	source.Add(IdentityValue{URL: "https://example.com/b", Nickname: "b, with \"quotes\"", LineageID: "abce", Timestamp: timestamp.Add(time.Hour), HashAlgorithm: "sha256", PrefixLength: 2, FirstCommit: timestamp.AddDate(-5, 0, 0)})
+	a, _ := source.Resolve("a")
+	source.AddAlias(a.ID, AliasNickname, "a-old")
+	source.AddAlias(a.ID, AliasURL, "https://mirror.example.org/a")
+	metadata := RepoMetadata{IdentityID: a.ID, Forge: "github", IsFork: true, Parent: "https://example.com/upstream", Stars: 3,
+		Created: timestamp.AddDate(-1, 0, 0), FetchedAt: timestamp}
+	if err := source.SetMetadata(metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordHistory(source.db, a.ID, "abc", timestamp.AddDate(0, -1, 0), "refresh"); err != nil {
+		t.Fatal(err)
+	}
+	history, _ := source.History(a.ID)
+
+	for _, format := range []ExportFormat{FormatCSV, FormatJSON, FormatNDJSON} {
+		var buf bytes.Buffer
+		if err := source.Export(&buf, format); err != nil {
+			t.Fatalf(`Export(%s) failed: %v`, format, err)
+		}
+
+		records, err := ReadExport(bytes.NewReader(buf.Bytes()), format)
+		if err != nil {
+			t.Fatalf(`ReadExport(%s) failed: %v`, format, err)
+		}
+
+		destination := newTestCache(t)
+		summary, err := destination.ImportRecords(records)
+		if err != nil {
+			t.Fatalf(`ImportRecords(%s) failed: %v`, format, err)
+		}
+		if summary.Added != 2 {
+			t.Errorf(`%s: expected %d added records, got %+v`, format, 2, summary)
+		}
+
+		b, err := destination.Resolve("b, with \"quotes\"")
+		if err != nil || b.LineageID != "abce" || !b.Timestamp.Equal(timestamp.Add(time.Hour)) || b.HashAlgorithm != "sha256" || b.PrefixLength != 2 ||
+			!b.FirstCommit.Equal(timestamp.AddDate(-5, 0, 0)) {
+			t.Errorf(`%s: restored record = %+v, %v`, format, b, err)
+		}
+		for _, name := range []string{"a-old", "https://mirror.example.org/a"} {
+			if v, err := destination.Resolve(name); err != nil || v.URL != "https://example.com/a" {
+				t.Errorf(`%s: alias %q was not restored: %v`, format, name, err)
+			}
+		}
+		restoredA, _ := destination.Resolve("a")
+		restoredMetadata, err := destination.Metadata()
+		if m, has := restoredMetadata[restoredA.ID]; err != nil || !has || m.Forge != "github" || !m.IsFork || m.Parent != metadata.Parent || m.Stars != 3 ||
+			!m.Created.Equal(metadata.Created) || !m.Pushed.IsZero() || !m.FetchedAt.Equal(timestamp) || len(restoredMetadata) != 1 {
+			t.Errorf(`%s: restored metadata = %+v, %v`, format, restoredMetadata, err)
+		}
+		restoredHistory, err := destination.History(restoredA.ID)
+		if err != nil || len(restoredHistory) != 1 || restoredHistory[0].LineageID != "abc" || restoredHistory[0].Reason != "refresh" ||
+			!restoredHistory[0].Timestamp.Equal(history[0].Timestamp) || !restoredHistory[0].ReplacedAt.Equal(history[0].ReplacedAt) {
+			t.Errorf(`%s: restored history = %+v, %v`, format, restoredHistory, err)
+		}
+
+		// importing again changes nothing
+		summary, err = destination.ImportRecords(records)
+		if err != nil || summary.Unchanged != 2 {
+			t.Errorf(`%s: re-import = %+v, %v`, format, summary, err)
+		}
+		if restoredHistory, _ := destination.History(restoredA.ID); len(restoredHistory) != 1 {
+			t.Errorf(`%s: re-import duplicated the history, %d entries`, format, len(restoredHistory))
+		}
+	}
+}
+
+func TestReadVersion1Export(t *testing.T) {
+	csvExport := "schema_version,id,nickname,url,lineage_id,timestamp,aliases\n" +
+		"1,1,a,https://example.com/a,abcd,2024-03-01T12:30:00Z,\n"
+	jsonExport := `{"schema_version": 1, "repositories": [{"id": 1, "nickname": "a", "url": "https://example.com/a", "lineage_id": "abcd", "timestamp": "2024-03-01T12:30:00Z"}]}`
+	for format, export := range map[ExportFormat]string{FormatCSV: csvExport, FormatJSON: jsonExport} {
+		records, err := ReadExport(strings.NewReader(export), format)
+		if err != nil || len(records) != 1 || records[0].LineageID != "abcd" || records[0].HashAlgorithm != "" {
+			t.Errorf(`%s: ReadExport() of a version 1 export = %+v, %v`, format, records, err)
+		}
+	}
+	if !SameHashAlgorithm("", "sha1") || SameHashAlgorithm("", "sha256") {
+		t.Errorf(`lineage IDs without a hash algorithm should be SHA-1`)
+	}
+}
+
+func TestReadExportRejectsNewerSchema(t *testing.T) {
+	_, err := ReadExport(strings.NewReader(`{"schema_version": 999, "repositories": []}`), FormatJSON)
+	if err == nil {
+		t.Errorf(`ReadExport() should reject unknown schema versions`)
+	}
+
+	_, err = ReadExport(strings.NewReader("url,nickname\nhttps://example.com/a,a\n"), FormatCSV)
+	if err == nil {
+		t.Errorf(`ReadExport() should reject csv files that are not exports`)
+	}
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// IdentityHistory keeps a lineage ID that a repository used to have,
+// so that replacing it (by a merge or a refresh) does not lose information
+type IdentityHistory struct {
+	ID         uint `gorm:"primaryKey"`
+	IdentityID uint `gorm:"index"`
+	LineageID  string
+	// when the old lineage ID was recorded
+	Timestamp time.Time
+	// when it was replaced
+	ReplacedAt time.Time `gorm:"default:current_timestamp"`
+	// what replaced it, e.g. "merge" or "refresh"
+	Reason string
+}
+
+func recordHistory(tx *gorm.DB, identityID uint, lineageID string, timestamp time.Time, reason string) error {
+	return tx.Create(&IdentityHistory{
+		IdentityID: identityID,
+		LineageID:  lineageID,
+		Timestamp:  timestamp,
+		ReplacedAt: time.Now(),
+		Reason:     reason,
+	}).Error
+}
+
+// History lists the previous lineage IDs of the repository with the given ID, oldest first
+func (cache *IdentityCache) History(identityID uint) ([]IdentityHistory, error) {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+	var history []IdentityHistory
+	result := cache.db.Order("replaced_at, id").Find(&history, "identity_id = ?", identityID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return history, nil
+}
+
+// UpdateLineage replaces the lineage ID of a repository (and the hash algorithm, prefix length and first commit that
+// go with it) with the ones of computed, a freshly computed fingerprint of the repository.
+// The previous lineage ID is kept in the repository's history if it changed,
+// either way the timestamp is bumped so that the repository no longer counts as stale.
+// Returns the previous lineage ID.
+func (cache *IdentityCache) UpdateLineage(identityID uint, computed IdentityValue, reason string) (string, error) {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return "", fmt.Errorf("database connection is nil")
+	}
+	var previous string
+	err := cache.db.Transaction(func(tx *gorm.DB) error {
+		var identity IdentityValue
+		if err := tx.Take(&identity, identityID).Error; err != nil {
+			return err
+		}
+		previous = identity.LineageID
+		if previous != computed.LineageID || !SameHashAlgorithm(identity.HashAlgorithm, computed.HashAlgorithm) ||
+			identity.LineagePrefixLength() != computed.LineagePrefixLength() {
+			if err := recordHistory(tx, identity.ID, identity.LineageID, identity.Timestamp, reason); err != nil {
+				return err
+			}
+		}
+		identity.LineageID = computed.LineageID
+		identity.HashAlgorithm = computed.HashAlgorithm
+		identity.PrefixLength = computed.PrefixLength
+		identity.FirstCommit = computed.FirstCommit
+		identity.Timestamp = time.Now()
+		return tx.Save(&identity).Error
+	})
+	return previous, err
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateLineageAndStaleness(t *testing.T) {
+	cache := newTestCache(t)
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	cache.Add(IdentityValue{URL: "https://example.com/old", Nickname: "old", LineageID: "abcd", Timestamp: lastWeek})
+	cache.Add(IdentityValue{URL: "https://example.com/fresh", Nickname: "fresh", LineageID: "ef01"})
+
+	stale, err := cache.GetStale(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].Nickname != "old" {
+		t.Fatalf(`GetStale() = %+v, expected only "old"`, stale)
+	}
+
+	previous, err := cache.UpdateLineage(stale[0].ID, IdentityValue{LineageID: "abcd12", HashAlgorithm: "sha1", PrefixLength: 4}, "refresh")
+	if err != nil || previous != "abcd" {
+		t.Errorf(`UpdateLineage() = %q, %v`, previous, err)
+	}
+
+	updated, _ := cache.Resolve("old")
+	if updated.LineageID != "abcd12" {
+		t.Errorf(`lineage ID was not updated, got %q`, updated.LineageID)
+	}
+	history, _ := cache.History(updated.ID)
+	if len(history) != 1 || history[0].LineageID != "abcd" || history[0].Reason != "refresh" {
+		t.Errorf(`previous lineage ID was not recorded: %+v`, history)
+	}
+
+	if stale, _ := cache.GetStale(time.Now().Add(-24 * time.Hour)); len(stale) != 0 {
+		t.Errorf(`refreshed repository is still stale: %+v`, stale)
+	}
+
+	// an unchanged lineage only bumps the timestamp
+	cache.UpdateLineage(updated.ID, IdentityValue{LineageID: "abcd12", HashAlgorithm: "sha1", PrefixLength: 4}, "refresh")
+	if history, _ := cache.History(updated.ID); len(history) != 1 {
+		t.Errorf(`unchanged lineage ID should not be recorded in history, found %d entries`, len(history))
+	}
+}
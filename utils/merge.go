@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type MergePolicy string
+
+const (
+	// the side with the more recent timestamp wins every conflict, the other value is discarded
+	MergeNewest MergePolicy = "newest"
+	// the more recent lineage ID wins, the other one is kept in the repository's history
+	MergeHistory MergePolicy = "history"
+	// nothing is written, the summary only reports what would happen
+	MergeReport MergePolicy = "report"
+	// every conflict is decided by a MergePrompt, the other lineage ID is kept in the repository's history
+	MergeInteractive MergePolicy = "interactive"
+)
+
+// MergePrompt decides a conflict for the interactive policy, returning true to take the incoming value
+type MergePrompt func(conflict MergeConflict) (bool, error)
+
+type ConflictKind string
+
+const (
+	// the same URL has a different lineage ID in each database
+	ConflictLineage ConflictKind = "lineage"
+	// the same nickname refers to a different URL in each database
+	ConflictNickname ConflictKind = "nickname"
+	// an alias from the other database already belongs to a different repository
+	ConflictAlias ConflictKind = "alias"
+)
+
+type MergeConflict struct {
+	Kind ConflictKind
+	// the URL of the incoming repository
+	URL string
+	// the conflicting values
+	Local    string
+	Incoming string
+	// what was (or would be) done about it
+	Resolution string
+}
+
+func (c MergeConflict) String() string {
+	return fmt.Sprintf("%s conflict for %s: local %q, incoming %q: %s", c.Kind, c.URL, c.Local, c.Incoming, c.Resolution)
+}
+
+type MergeSummary struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	// repositories whose lineage conflict was left unresolved by the report policy,
+	// so that every merged repository is counted exactly once
+	Conflicting int
+	Conflicts   []MergeConflict
+}
+
+// used to roll back the transaction of a report-only merge
+var errMergeDryRun = errors.New("dry run")
+
+// MergeFrom unions every repository of another cache database into this one.
+// Repositories are matched by URL (including url aliases), conflicts are resolved according to the policy.
+// The other database is only read, it is not even migrated. The prompt is only used by the interactive policy
+func (cache *IdentityCache) MergeFrom(other *IdentityCache, policy MergePolicy, prompt MergePrompt) (MergeSummary, error) {
+	summary := MergeSummary{}
+	if policy != MergeNewest && policy != MergeHistory && policy != MergeReport && policy != MergeInteractive {
+		return summary, fmt.Errorf("unknown merge policy %q", policy)
+	}
+	if policy == MergeInteractive && prompt == nil {
+		return summary, errors.New("the interactive merge policy needs a prompt")
+	}
+	if other.db == nil {
+		if _, err := other.connectReadOnly(); err != nil {
+			return summary, err
+		}
+	}
+	records, err := other.ExportRecords()
+	if err != nil {
+		return summary, err
+	}
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return summary, fmt.Errorf("database connection is nil")
+	}
+
+	err = cache.db.Transaction(func(tx *gorm.DB) error {
+		for _, record := range records {
+			if err := mergeRecord(tx, record, policy, prompt, &summary); err != nil {
+				return fmt.Errorf("merging %s: %w", record.URL, err)
+			}
+		}
+		if policy == MergeReport {
+			return errMergeDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errMergeDryRun) {
+		return MergeSummary{}, err
+	}
+	return summary, nil
+}
+
+func mergeRecord(tx *gorm.DB, record ExportRecord, policy MergePolicy, prompt MergePrompt, summary *MergeSummary) error {
+	local, err := resolve(tx, record.URL)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		local = nil
+	} else if err != nil {
+		return err
+	} else if local.URL != record.URL && local.Nickname == record.URL {
+		// the incoming url happens to be used as a nickname, which doesnt make them the same repository
+		local = nil
+	}
+
+	if local == nil {
+		nickname, err := mergeNickname(tx, record, policy, prompt, summary)
+		if err != nil {
+			return err
+		}
+		identity := IdentityValue{
+			Nickname:      nickname,
+			URL:           record.URL,
+			LineageID:     record.LineageID,
+			Timestamp:     record.Timestamp,
+			HashAlgorithm: record.HashAlgorithm,
+			PrefixLength:  record.PrefixLength,
+			FirstCommit:   record.FirstCommit,
+		}
+		if err := tx.Create(&identity).Error; err != nil {
+			return err
+		}
+		summary.Added += 1
+		return mergeAliases(tx, identity.ID, record, summary)
+	}
+
+	if local.LineageID == record.LineageID && SameHashAlgorithm(local.HashAlgorithm, record.HashAlgorithm) &&
+		local.LineagePrefixLength() == prefixLengthOrDefault(record.PrefixLength) {
+		summary.Unchanged += 1
+	} else {
+		conflict := MergeConflict{
+			Kind:     ConflictLineage,
+			URL:      record.URL,
+			Local:    local.LineageID,
+			Incoming: record.LineageID,
+		}
+		takeIncoming := record.Timestamp.After(local.Timestamp)
+		if policy == MergeInteractive {
+			if takeIncoming, err = prompt(conflict); err != nil {
+				return err
+			}
+		}
+		keepHistory := policy == MergeHistory || policy == MergeInteractive
+		switch {
+		case policy == MergeReport:
+			conflict.Resolution = "unresolved"
+			summary.Conflicting += 1
+		case takeIncoming:
+			if keepHistory {
+				if err := recordHistory(tx, local.ID, local.LineageID, local.Timestamp, "merge"); err != nil {
+					return err
+				}
+				conflict.Resolution = "took incoming, local kept as history"
+			} else {
+				conflict.Resolution = "took incoming"
+			}
+			local.LineageID = record.LineageID
+			local.HashAlgorithm = record.HashAlgorithm
+			local.PrefixLength = record.PrefixLength
+			local.FirstCommit = record.FirstCommit
+			local.Timestamp = record.Timestamp
+			if err := tx.Save(local).Error; err != nil {
+				return err
+			}
+			summary.Updated += 1
+		default:
+			if keepHistory {
+				if err := recordHistory(tx, local.ID, record.LineageID, record.Timestamp, "merge"); err != nil {
+					return err
+				}
+				conflict.Resolution = "kept local, incoming kept as history"
+			} else {
+				conflict.Resolution = "kept local"
+			}
+			summary.Unchanged += 1
+		}
+		summary.Conflicts = append(summary.Conflicts, conflict)
+	}
+
+	// the incoming nickname is just another name for the local repository
+	if record.Nickname != "" && record.Nickname != record.URL && record.Nickname != local.Nickname {
+		owner, err := resolve(tx, record.Nickname)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := addAlias(tx, local.ID, AliasNickname, record.Nickname); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if owner.ID != local.ID {
+			conflict := MergeConflict{
+				Kind:     ConflictNickname,
+				URL:      record.URL,
+				Local:    owner.URL,
+				Incoming: record.URL,
+			}
+			takeIncoming := policy == MergeNewest && record.Timestamp.After(owner.Timestamp)
+			if policy == MergeInteractive {
+				if takeIncoming, err = prompt(conflict); err != nil {
+					return err
+				}
+			}
+			if policy == MergeReport {
+				conflict.Resolution = "unresolved"
+			} else if takeIncoming {
+				if err := releaseNickname(tx, owner, record.Nickname); err != nil {
+					return err
+				}
+				if err := addAlias(tx, local.ID, AliasNickname, record.Nickname); err != nil {
+					return err
+				}
+				conflict.Resolution = "took incoming, local uses its url"
+			} else {
+				conflict.Resolution = "kept local"
+			}
+			summary.Conflicts = append(summary.Conflicts, conflict)
+		}
+	}
+	return mergeAliases(tx, local.ID, record, summary)
+}
+
+// mergeNickname decides what nickname an incoming repository gets, freeing it up on the local side if needed.
+// Repositories that lose out on their nickname fall back to their URL, the same as an import without a nickname.
+func mergeNickname(tx *gorm.DB, record ExportRecord, policy MergePolicy, prompt MergePrompt, summary *MergeSummary) (string, error) {
+	if record.Nickname == "" {
+		return record.URL, nil
+	}
+	owner, err := resolve(tx, record.Nickname)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return record.Nickname, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	conflict := MergeConflict{
+		Kind:     ConflictNickname,
+		URL:      record.URL,
+		Local:    owner.URL,
+		Incoming: record.URL,
+	}
+	defer func() {
+		summary.Conflicts = append(summary.Conflicts, conflict)
+	}()
+
+	if policy == MergeReport {
+		conflict.Resolution = "unresolved"
+		return record.URL, nil
+	}
+	takeIncoming := policy == MergeNewest && record.Timestamp.After(owner.Timestamp)
+	if policy == MergeInteractive {
+		if takeIncoming, err = prompt(conflict); err != nil {
+			return "", err
+		}
+	}
+	if !takeIncoming {
+		conflict.Resolution = "kept local, incoming uses its url"
+		return record.URL, nil
+	}
+
+	conflict.Resolution = "took incoming, local uses its url"
+	if err := releaseNickname(tx, owner, record.Nickname); err != nil {
+		return "", err
+	}
+	return record.Nickname, nil
+}
+
+// releaseNickname takes a nickname (or nickname alias) away from a repository
+func releaseNickname(tx *gorm.DB, owner *IdentityValue, nickname string) error {
+	if owner.Nickname == nickname {
+		owner.Nickname = owner.URL
+		return tx.Save(owner).Error
+	}
+	return tx.Where("identity_id = ? AND value = ?", owner.ID, nickname).Delete(&IdentityAlias{}).Error
+}
+
+func mergeAliases(tx *gorm.DB, identityID uint, record ExportRecord, summary *MergeSummary) error {
+	for _, alias := range record.Aliases {
+		owner, err := resolve(tx, alias.Value)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := addAlias(tx, identityID, alias.Kind, alias.Value); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if owner.ID != identityID {
+			summary.Conflicts = append(summary.Conflicts, MergeConflict{
+				Kind:       ConflictAlias,
+				URL:        record.URL,
+				Local:      owner.URL,
+				Incoming:   alias.Value,
+				Resolution: "skipped",
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+func mergeFixtures(t *testing.T) (IdentityCache, IdentityCache) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(24 * time.Hour)
+
+	local := newTestCache(t)
+	local.Add(IdentityValue{URL: "https://example.com/same", Nickname: "same", LineageID: "aaaa", Timestamp: older})
+	local.Add(IdentityValue{URL: "https://example.com/changed", Nickname: "changed", LineageID: "bbbb", Timestamp: older})
+	local.Add(IdentityValue{URL: "https://example.com/local", Nickname: "taken", LineageID: "cccc", Timestamp: older})
+
+	other := newTestCache(t)
+	other.Add(IdentityValue{URL: "https://example.com/same", Nickname: "same-elsewhere", LineageID: "aaaa", Timestamp: older})
+	other.Add(IdentityValue{URL: "https://example.com/changed", Nickname: "changed", LineageID: "bbbbdd", Timestamp: newer})
+	other.Add(IdentityValue{URL: "https://example.com/other", Nickname: "taken", LineageID: "dddd", Timestamp: newer})
+	other.Add(IdentityValue{URL: "https://example.com/new", Nickname: "new", LineageID: "eeee", Timestamp: newer})
+	return local, other
+}
+
+func TestMergeReportChangesNothing(t *testing.T) {
+	local, other := mergeFixtures(t)
+
+	summary, err := local.MergeFrom(&other, MergeReport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Added != 2 || summary.Unchanged != 1 || summary.Conflicting != 1 || len(summary.Conflicts) != 2 {
+		t.Errorf(`unexpected report summary %+v`, summary)
+	}
+
+	all, _ := local.GetAll()
+	if len(all) != 3 {
+		t.Errorf(`report merge wrote to the database, found %d repositories`, len(all))
+	}
+}
+
+func TestMergeNewest(t *testing.T) {
+	local, other := mergeFixtures(t)
+
+	summary, err := local.MergeFrom(&other, MergeNewest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Added != 2 || summary.Updated != 1 || summary.Unchanged != 1 {
+		t.Errorf(`unexpected summary %+v`, summary)
+	}
+
+	changed, _ := local.Resolve("changed")
+	if changed.LineageID != "bbbbdd" {
+		t.Errorf(`newer lineage ID was not taken, got %q`, changed.LineageID)
+	}
+	if history, _ := local.History(changed.ID); len(history) != 0 {
+		t.Errorf(`newest policy should not keep history, found %d entries`, len(history))
+	}
+
+	// the incoming repository is newer, so it takes the nickname
+	taken, _ := local.Resolve("taken")
+	if taken.URL != "https://example.com/other" {
+		t.Errorf(`nickname "taken" resolves to %q`, taken.URL)
+	}
+	if v, err := local.Resolve("https://example.com/local"); err != nil || v.Nickname != v.URL {
+		t.Errorf(`local repository should fall back to its url as nickname, got %+v`, v)
+	}
+
+	same, _ := local.Resolve("same-elsewhere")
+	if same == nil || same.URL != "https://example.com/same" {
+		t.Errorf(`incoming nickname of an existing repository was not added as an alias`)
+	}
+}
+
+func TestMergeHistory(t *testing.T) {
+	local, other := mergeFixtures(t)
+
+	_, err := local.MergeFrom(&other, MergeHistory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, _ := local.Resolve("changed")
+	if changed.LineageID != "bbbbdd" {
+		t.Errorf(`newer lineage ID was not taken, got %q`, changed.LineageID)
+	}
+	history, _ := local.History(changed.ID)
+	if len(history) != 1 || history[0].LineageID != "bbbb" || history[0].Reason != "merge" {
+		t.Errorf(`old lineage ID was not kept as history: %+v`, history)
+	}
+
+	taken, _ := local.Resolve("taken")
+	if taken.URL != "https://example.com/local" {
+		t.Errorf(`history policy should keep the local nickname, "taken" resolves to %q`, taken.URL)
+	}
+}
+
+func TestMergeInteractive(t *testing.T) {
+	local, other := mergeFixtures(t)
+
+	if _, err := local.MergeFrom(&other, MergeInteractive, nil); err == nil {
+		t.Errorf(`interactive merge without a prompt should fail`)
+	}
+
+	asked := []ConflictKind{}
+	prompt := func(conflict MergeConflict) (bool, error) {
+		asked = append(asked, conflict.Kind)
+		// keep the local lineage, but give the nickname to the incoming repository
+		return conflict.Kind == ConflictNickname, nil
+	}
+	summary, err := local.MergeFrom(&other, MergeInteractive, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 2 || summary.Added != 2 || summary.Unchanged != 2 {
+		t.Errorf(`asked about %v, summary %+v`, asked, summary)
+	}
+
+	changed, _ := local.Resolve("changed")
+	if changed.LineageID != "bbbb" {
+		t.Errorf(`local lineage ID was not kept, got %q`, changed.LineageID)
+	}
+	history, _ := local.History(changed.ID)
+	if len(history) != 1 || history[0].LineageID != "bbbbdd" {
+		t.Errorf(`incoming lineage ID was not kept as history: %+v`, history)
+	}
+	taken, _ := local.Resolve("taken")
+	if taken.URL != "https://example.com/other" {
+		t.Errorf(`nickname "taken" resolves to %q`, taken.URL)
+	}
+}
+
+func TestMergeDoesNotWriteOther(t *testing.T) {
+	local := newTestCache(t)
+	local.Add(IdentityValue{URL: "https://example.com/same", Nickname: "same", LineageID: "aaaa"})
+
+	// a database from before aliases and hash algorithms were recorded
+	filename := t.TempDir() + "/other.sqlite"
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE identity_values (id integer PRIMARY KEY, nickname text UNIQUE, timestamp datetime, url text UNIQUE, lineage_id text);
+		INSERT INTO identity_values (nickname, timestamp, url, lineage_id) VALUES ('old', '2024-01-01 00:00:00', 'https://example.com/old', 'ffff')`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(filename)
+
+	other := IdentityCache{Filename: filename}
+	summary, err := local.MergeFrom(&other, MergeNewest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Added != 1 {
+		t.Errorf(`unexpected summary %+v`, summary)
+	}
+	if old, err := local.Resolve("old"); err != nil || old.LineageID != "ffff" {
+		t.Errorf(`repository from the other database was not merged: %+v, %v`, old, err)
+	}
+	if after, _ := os.ReadFile(filename); !bytes.Equal(before, after) {
+		t.Errorf(`merge wrote to the other database`)
+	}
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RepoMetadata is what a forge (e.g. GitHub) knows about a cached repository.
+// It is optional: repositories that were never looked up, or that are not hosted on a supported forge, have none
+type RepoMetadata struct {
+	ID         uint `gorm:"primaryKey"`
+	IdentityID uint `gorm:"uniqueIndex"`
+	// the forge the metadata came from, e.g. "github"
+	Forge  string
+	IsFork bool
+	// the url of the repository this one was forked from, if it is a fork
+	Parent string
+	Stars  int
+	// when the repository was created on the forge and when it was last pushed to
+	Created time.Time
+	Pushed  time.Time
+	// when the metadata was fetched
+	FetchedAt time.Time
+}
+
+// SetMetadata stores the forge metadata of a repository, replacing whatever was stored before
+func (cache *IdentityCache) SetMetadata(metadata RepoMetadata) error {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+	if metadata.FetchedAt.IsZero() {
+		metadata.FetchedAt = time.Now()
+	}
+	return cache.db.Transaction(func(tx *gorm.DB) error {
+		var existing RepoMetadata
+		result := tx.Take(&existing, "identity_id = ?", metadata.IdentityID)
+		if result.Error == nil {
+			metadata.ID = existing.ID
+		} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return result.Error
+		}
+		return tx.Save(&metadata).Error
+	})
+}
+
+// Metadata returns the forge metadata of every repository that has any, by repository ID
+func (cache *IdentityCache) Metadata() (map[uint]RepoMetadata, error) {
+	if cache.db == nil {
+		cache.connect(true)
+	}
+	if cache.db == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+	var rows []RepoMetadata
+	result := cache.db.Find(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	metadata := make(map[uint]RepoMetadata, len(rows))
+	for _, m := range rows {
+		metadata[m.IdentityID] = m
+	}
+	return metadata, nil
+}
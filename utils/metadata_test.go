@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	cache := newTestCache(t)
+	cache.Add(IdentityValue{URL: "https://example.com/a", Nickname: "a", LineageID: "0123"})
+	cache.Add(IdentityValue{URL: "https://example.com/b", Nickname: "b", LineageID: "0123"})
+	a, _ := cache.Resolve("a")
+	b, _ := cache.Resolve("b")
+
+	created := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := cache.SetMetadata(RepoMetadata{IdentityID: a.ID, Forge: "github", Stars: 10, Created: created}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetMetadata(RepoMetadata{IdentityID: b.ID, Forge: "github", IsFork: true, Parent: "https://example.com/a"}); err != nil {
+		t.Fatal(err)
+	}
+	// setting it again replaces the row instead of adding another one
+	if err := cache.SetMetadata(RepoMetadata{IdentityID: a.ID, Forge: "github", Stars: 20, Created: created}); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := cache.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata) != 2 {
+		t.Fatalf(`expected metadata for %d repositories, got %d`, 2, len(metadata))
+	}
+	if m := metadata[a.ID]; m.Stars != 20 || !m.Created.Equal(created) || m.FetchedAt.IsZero() {
+		t.Errorf(`unexpected metadata %+v`, m)
+	}
+	if m := metadata[b.ID]; !m.IsFork || m.Parent != "https://example.com/a" {
+		t.Errorf(`unexpected metadata %+v`, m)
+	}
+
+	// metadata of merged duplicates goes away with them
+	cache.Merge(a.ID, b.ID)
+	metadata, _ = cache.Metadata()
+	if _, has := metadata[b.ID]; has || len(metadata) != 1 {
+		t.Errorf(`metadata of a merged repository was kept`)
+	}
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// ParquetRepository is one row of the parquet export, one per cached repository
+type ParquetRepository struct {
+	ID        int64  `parquet:"id"`
+	Nickname  string `parquet:"nickname"`
+	URL       string `parquet:"url"`
+	LineageID string `parquet:"lineage_id"`
+	// the object format of the commits the lineage ID was made from, lineage IDs of different ones can't be compared
+	HashAlgorithm string `parquet:"hash_algorithm"`
+	// the number of bits of each commit hash that the lineage ID keeps
+	PrefixLength int32 `parquet:"prefix_length"`
+	// the number of commits in the lineage ID, so that histories can be compared without parsing it
+	CommitCount int64     `parquet:"commit_count"`
+	Timestamp   time.Time `parquet:"timestamp,timestamp(millisecond)"`
+	Aliases     []string  `parquet:"aliases,list"`
+}
+
+// ParquetLineagePosition is one row of the exploded lineage table, one per commit of every cached repository.
+// Positions count from the oldest commit (position 0), the same order that lineage IDs are stored in.
+type ParquetLineagePosition struct {
+	RepositoryID int64  `parquet:"repository_id"`
+	URL          string `parquet:"url,dict"`
+	Position     int64  `parquet:"position"`
+	// the value of the commit hash prefix (the first bits of the hash, as many as the repository's prefix length)
+	Prefix int32 `parquet:"prefix"`
+	// only known when the full hashes were available, which is never the case for cached repositories
+	CommitHash *string `parquet:"commit_hash,optional"`
+}
+
+// ExportParquet writes one row per cached repository to w as an Apache Parquet file
+func (cache *IdentityCache) ExportParquet(w io.Writer) error {
+	records, err := cache.ExportRecords()
+	if err != nil {
+		return err
+	}
+	rows := make([]ParquetRepository, 0, len(records))
+	for _, record := range records {
+		aliases := make([]string, 0, len(record.Aliases))
+		for _, alias := range record.Aliases {
+			aliases = append(aliases, alias.Value)
+		}
+		hashAlgorithm := record.HashAlgorithm
+		if hashAlgorithm == "" {
+			hashAlgorithm = DefaultHashAlgorithm
+		}
+		rows = append(rows, ParquetRepository{
+			ID:            int64(record.ID),
+			Nickname:      record.Nickname,
+			URL:           record.URL,
+			LineageID:     record.LineageID,
+			HashAlgorithm: hashAlgorithm,
+			PrefixLength:  int32(prefixLengthOrDefault(record.PrefixLength)),
+			CommitCount:   int64(LineageCommitCount(record.LineageID, record.PrefixLength)),
+			Timestamp:     record.Timestamp,
+			Aliases:       aliases,
+		})
+	}
+
+	writer := parquet.NewGenericWriter[ParquetRepository](w, parquet.Compression(&parquet.Snappy))
+	if _, err := writer.Write(rows); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// ExportLineagePositions writes the exploded (repository, position, prefix) table to w as an Apache Parquet file.
+// Rows are written one repository at a time so that the whole table never has to be in memory.
+func (cache *IdentityCache) ExportLineagePositions(w io.Writer) error {
+	identities, err := cache.GetAll()
+	if err != nil {
+		return err
+	}
+
+	writer := parquet.NewGenericWriter[ParquetLineagePosition](w, parquet.Compression(&parquet.Snappy))
+	rows := []ParquetLineagePosition{}
+	for _, identity := range identities {
+		rows = rows[:0]
+		digits := lineageDigitsPerCommit(identity.PrefixLength)
+		if len(identity.LineageID)%digits != 0 {
+			return fmt.Errorf("lineage ID of %s does not hold whole %d bit prefixes", identity.URL, identity.LineagePrefixLength())
+		}
+		for position := 0; position < len(identity.LineageID)/digits; position++ {
+			prefix, err := strconv.ParseUint(identity.LineageID[position*digits:(position+1)*digits], 16, 32)
+			if err != nil {
+				return fmt.Errorf("lineage ID of %s is not valid hex: %w", identity.URL, err)
+			}
+			rows = append(rows, ParquetLineagePosition{
+				RepositoryID: int64(identity.ID),
+				URL:          identity.URL,
+				Position:     int64(position),
+				Prefix:       int32(prefix),
+			})
+		}
+		if _, err := writer.Write(rows); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// ExportParquetToFile writes the repository table to destination,
+// and the exploded lineage table to positionsDestination if that is not empty
+func (cache *IdentityCache) ExportParquetToFile(destination string, positionsDestination string) error {
+	err := writeFile(destination, cache.ExportParquet)
+	if err != nil {
+		return err
+	}
+	if positionsDestination == "" {
+		return nil
+	}
+	return writeFile(positionsDestination, cache.ExportLineagePositions)
+}
+
+func writeFile(destination string, write func(io.Writer) error) error {
+	f, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestExportParquet(t *testing.T) {
+	cache := newTestCache(t)
+	timestamp := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	cache.Add(IdentityValue{URL: "https://example.com/a", Nickname: "a", LineageID: "0f3a", Timestamp: timestamp})
+	cache.Add(IdentityValue{URL: "https://example.com/b", Nickname: "b", LineageID: "0f3", HashAlgorithm: "sha256", PrefixLength: 3, Timestamp: timestamp})
+	a, _ := cache.Resolve("a")
+	cache.AddAlias(a.ID, AliasNickname, "a-old")
+
+	var buf bytes.Buffer
+	if err := cache.ExportParquet(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parquet.Read[ParquetRepository](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf(`expected %d rows, got %d`, 2, len(rows))
+	}
+	if rows[0].URL != "https://example.com/a" || rows[0].CommitCount != 4 || !rows[0].Timestamp.Equal(timestamp) {
+		t.Errorf(`unexpected row %+v`, rows[0])
+	}
+	if rows[0].PrefixLength != 4 || rows[1].PrefixLength != 3 || rows[1].CommitCount != 3 {
+		t.Errorf(`prefix lengths were exported as %+v and %+v`, rows[0], rows[1])
+	}
+	if rows[0].HashAlgorithm != "sha1" || rows[1].HashAlgorithm != "sha256" {
+		t.Errorf(`hash algorithms were exported as %q and %q`, rows[0].HashAlgorithm, rows[1].HashAlgorithm)
+	}
+	if len(rows[0].Aliases) != 1 || rows[0].Aliases[0] != "a-old" {
+		t.Errorf(`aliases were not exported: %+v`, rows[0].Aliases)
+	}
+
+	buf.Reset()
+	if err := cache.ExportLineagePositions(&buf); err != nil {
+		t.Fatal(err)
+	}
+	positions, err := parquet.Read[ParquetLineagePosition](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 7 {
+		t.Fatalf(`expected one row per commit (%d), got %d`, 7, len(positions))
+	}
+	expected := []int32{0x0, 0xf, 0x3, 0xa}
+	for i, want := range expected {
+		if p := positions[i]; p.Position != int64(i) || p.Prefix != want || p.CommitHash != nil {
+			t.Errorf(`position row %d = %+v, expected prefix %d`, i, p, want)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package utils
 
 import (
-	"strings"
+	"encoding/binary"
+	"math/bits"
+	"unsafe"
 )
 
 // Takes two strings and trims both to be of equal length
@@ -20,40 +22,57 @@ func TrimStringsToEqualLength(str1 string, str2 string) (string, string, string,
 	}
 }
 
+// GetLongestPrefix returns the longest string that both str1 and str2 start with
 func GetLongestPrefix(str1 string, str2 string) string {
+	return str1[:CommonPrefixLength(stringBytes(str1), stringBytes(str2))]
+}
 
-	length := len(str1)
+// stringBytes returns the bytes of a string without copying them. The result must not be modified
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
 
-	if length != len(str2) {
-		str1, str2, _, _ = TrimStringsToEqualLength(str1, str2)
-		length = len(str1)
+// CommonPrefixLength returns the number of leading bytes that a and b have in common.
+// It compares 8 bytes at a time, and the position of the first differing bit within a word
+// tells which byte it is in
+func CommonPrefixLength(a []byte, b []byte) int {
+	length := min(len(a), len(b))
+	i := 0
+	// long shared histories are the common case, so skip over them 32 bytes at a time
+	// before narrowing down on the word that differs
+	for ; i+32 <= length; i += 32 {
+		diff := binary.LittleEndian.Uint64(a[i:]) ^ binary.LittleEndian.Uint64(b[i:])
+		diff |= binary.LittleEndian.Uint64(a[i+8:]) ^ binary.LittleEndian.Uint64(b[i+8:])
+		diff |= binary.LittleEndian.Uint64(a[i+16:]) ^ binary.LittleEndian.Uint64(b[i+16:])
+		diff |= binary.LittleEndian.Uint64(a[i+24:]) ^ binary.LittleEndian.Uint64(b[i+24:])
+		if diff != 0 {
+			break
+		}
 	}
-
-	if length == 0 {
-		return ""
-	} else if length == 1 {
-		if str1 == str2 {
-			return str1
-		} else {
-			return ""
+	for ; i+8 <= length; i += 8 {
+		// little endian so that the first byte ends up in the lowest bits
+		if diff := binary.LittleEndian.Uint64(a[i:]) ^ binary.LittleEndian.Uint64(b[i:]); diff != 0 {
+			return i + bits.TrailingZeros64(diff)/8
 		}
 	}
+	for ; i < length; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return length
+}
 
-	// integer division
-	splitpoint := length / 2
-
-	left1 := str1[:splitpoint]
-	left2 := str2[:splitpoint]
-
-	right1 := str1[splitpoint:]
-	right2 := str2[splitpoint:]
-
-	// if the left half is a prefix for the whole thing
-	if strings.HasPrefix(str1, left2) {
-		// we have half of the prefix, traverse right
-		return left2 + GetLongestPrefix(right1, right2)
-	} else {
-		// prefix is shorter than half, go left, discard right
-		return GetLongestPrefix(left1, left2)
+// CommonNibblePrefixLength returns the number of leading nibbles that two packed lineage IDs have in common.
+// The IDs are packed two nibbles to a byte with the first one in the high half (see AssembleBytesFromNibbles),
+// and aLength and bLength are their lengths in nibbles, so that padding in the last byte is not compared
+func CommonNibblePrefixLength(a []byte, aLength int, b []byte, bLength int) int {
+	length := min(aLength, bLength)
+	size := (length + 1) / 2
+	shared := CommonPrefixLength(a[:size], b[:size])
+	nibbles := 2 * shared
+	if shared < size && a[shared]>>4 == b[shared]>>4 {
+		nibbles++
 	}
+	return min(nibbles, length)
 }
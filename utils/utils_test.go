@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -57,3 +61,161 @@ func TestTrimStringsToEqualLength(t *testing.T) {
 	}
 
 }
+
+func TestCommonPrefixLength(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"abc", "", 0},
+		{"abc", "abc", 3},
+		{"abcdefgh", "abcdefgh", 8},
+		{"abcdefghijklmnop", "abcdefghijklmnoq", 15},
+		{"abcdefghijk", "abcdefgxijk", 7},
+		{"abcdefghijklmnopqrstu", "abcdefghijklmnopqrs", 19},
+		{"xbcdefghijk", "abcdefghijk", 0},
+	}
+	for _, c := range cases {
+		if l := CommonPrefixLength([]byte(c.a), []byte(c.b)); l != c.expected {
+			t.Errorf(`CommonPrefixLength(%q, %q) = %d, want %d`, c.a, c.b, l, c.expected)
+		}
+	}
+}
+
+func TestCommonNibblePrefixLength(t *testing.T) {
+	cases := []struct {
+		a        []byte
+		aLength  int
+		b        []byte
+		bLength  int
+		expected int
+	}{
+		{[]byte{0xab, 0xcd}, 4, []byte{0xab, 0xcd}, 4, 4},
+		{[]byte{0xab, 0xcd}, 4, []byte{0xab, 0xce}, 4, 3},
+		{[]byte{0xab, 0xcd}, 4, []byte{0xab, 0xdd}, 4, 2},
+		{[]byte{0xab, 0xcd}, 4, []byte{0xbb, 0xcd}, 4, 0},
+		// padding in the last byte is not part of the ID
+		{[]byte{0xab, 0xc0}, 3, []byte{0xab, 0xcf}, 4, 3},
+		{[]byte{0xab, 0xc0}, 3, []byte{0xab, 0xc5}, 3, 3},
+		{[]byte{0xab}, 2, []byte{0xab, 0xcd}, 4, 2},
+		{[]byte{}, 0, []byte{0xab}, 2, 0},
+	}
+	for _, c := range cases {
+		if l := CommonNibblePrefixLength(c.a, c.aLength, c.b, c.bLength); l != c.expected {
+			t.Errorf(`CommonNibblePrefixLength(%x, %d, %x, %d) = %d, want %d`, c.a, c.aLength, c.b, c.bLength, l, c.expected)
+		}
+	}
+}
+
+// naivePrefixLength is the reference that the word at a time implementations are checked against
+func naivePrefixLength(a []byte, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func naiveNibble(data []byte, i int) byte {
+	if i%2 == 0 {
+		return data[i/2] >> 4
+	}
+	return data[i/2] & 0xf
+}
+
+func FuzzCommonPrefixLength(f *testing.F) {
+	f.Add([]byte("abcdefghijklmnop"), []byte("abcdefghijklmnoq"))
+	f.Add([]byte("abc"), []byte(""))
+	f.Add([]byte("0123456789abcdef0123"), []byte("0123456789abcdef01234567"))
+	f.Fuzz(func(t *testing.T, a []byte, b []byte) {
+		expected := naivePrefixLength(a, b)
+		if l := CommonPrefixLength(a, b); l != expected {
+			t.Errorf(`CommonPrefixLength(%x, %x) = %d, want %d`, a, b, l, expected)
+		}
+		if p := GetLongestPrefix(string(a), string(b)); p != string(a[:expected]) {
+			t.Errorf(`GetLongestPrefix(%q, %q) = %q, want %q`, a, b, p, a[:expected])
+		}
+		// a shared prefix long enough to need the word at a time comparison
+		prefix := []byte(strings.Repeat("\x5a", 17))
+		a, b = append(prefix, a...), append(prefix, b...)
+		if l := CommonPrefixLength(a, b); l != naivePrefixLength(a, b) {
+			t.Errorf(`CommonPrefixLength(%x, %x) = %d, want %d`, a, b, l, naivePrefixLength(a, b))
+		}
+	})
+}
+
+func FuzzCommonNibblePrefixLength(f *testing.F) {
+	f.Add([]byte{0xab, 0xcd, 0xef}, []byte{0xab, 0xcd, 0xe0}, uint8(5), uint8(6))
+	f.Add([]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01}, []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x11}, uint8(18), uint8(17))
+	f.Fuzz(func(t *testing.T, a []byte, b []byte, aLength uint8, bLength uint8) {
+		lengthA, lengthB := min(int(aLength), 2*len(a)), min(int(bLength), 2*len(b))
+		expected := 0
+		for expected < lengthA && expected < lengthB && naiveNibble(a, expected) == naiveNibble(b, expected) {
+			expected++
+		}
+		if l := CommonNibblePrefixLength(a, lengthA, b, lengthB); l != expected {
+			t.Errorf(`CommonNibblePrefixLength(%x, %d, %x, %d) = %d, want %d`, a, lengthA, b, lengthB, l, expected)
+		}
+	})
+}
+
+// binarySplitLongestPrefix is how GetLongestPrefix used to work, kept as the baseline for the benchmarks
+func binarySplitLongestPrefix(str1 string, str2 string) string {
+	str1, str2, _, _ = TrimStringsToEqualLength(str1, str2)
+	length := len(str1)
+	if length == 0 {
+		return ""
+	} else if length == 1 {
+		if str1 == str2 {
+			return str1
+		}
+		return ""
+	}
+	splitpoint := length / 2
+	if strings.HasPrefix(str1, str2[:splitpoint]) {
+		return str2[:splitpoint] + binarySplitLongestPrefix(str1[splitpoint:], str2[splitpoint:])
+	}
+	return binarySplitLongestPrefix(str1[:splitpoint], str2[:splitpoint])
+}
+
+// prefixBenchmarkPair returns two random hex lineage IDs of the given length that diverge three quarters of the way in
+func prefixBenchmarkPair(length int) (string, string) {
+	random := rand.New(rand.NewSource(1))
+	a := make([]byte, length)
+	for i := range a {
+		a[i] = "0123456789abcdef"[random.Intn(16)]
+	}
+	b := []byte(string(a))
+	if b[length*3/4] == '0' {
+		b[length*3/4] = '1'
+	} else {
+		b[length*3/4] = '0'
+	}
+	return string(a), string(b)
+}
+
+func BenchmarkLongestPrefix(b *testing.B) {
+	for _, length := range []int{64, 1024, 65536} {
+		a, c := prefixBenchmarkPair(length)
+		b.Run("BinarySplit/"+strconv.Itoa(length), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				binarySplitLongestPrefix(a, c)
+			}
+		})
+		b.Run("GetLongestPrefix/"+strconv.Itoa(length), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				GetLongestPrefix(a, c)
+			}
+		})
+		packedA, _ := hex.DecodeString(a)
+		packedC, _ := hex.DecodeString(c)
+		b.Run("CommonNibblePrefixLength/"+strconv.Itoa(length), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				CommonNibblePrefixLength(packedA, length, packedC, length)
+			}
+		})
+	}
+}